@@ -5,16 +5,26 @@ import (
 	"github.com/feng212/csi-driver-lustre/pkg/lustre"
 	"k8s.io/klog/v2"
 	"os"
+	"strings"
+	"time"
 )
 
 var (
 	endpoint                     = flag.String("endpoint", "unix://tmp/csi.sock", "CSI endpoint")
 	nodeID                       = flag.String("nodeid", "", "node id")
-	mountPermissions             = flag.Uint64("mount-permissions", 0750, "mounted folder permissions")
+	mountPermissions             = flag.Uint64("mount-permissions", 0750, "permissions (octal) of the volume subdirectories and mount points created by the driver, overridden by the mountPermissions parameter, 0 for 0777")
 	driverName                   = flag.String("drivername", lustre.DefaultDriverName, "name of the driver")
 	workingMountDir              = flag.String("working-mount-dir", "/tmp", "working directory for provisioner to mount lustre shares temporarily")
+	nodeMountDir                 = flag.String("node-mount-dir", "/var/lib/kubelet/plugins/lustre.csi.k8s.io/mounts", "directory under which the node plugin mounts each lustre filesystem once and shares it between volumes")
+	ephemeralBaseDir             = flag.String("ephemeral-base-dir", "csi-ephemeral", "directory in the lustre filesystem under which the node plugin creates the scratch subdirectories of ephemeral inline volumes")
+	stateDir                     = flag.String("state-dir", "/var/lib/kubelet/plugins/lustre.csi.k8s.io/state", "node local directory where the node plugin records ephemeral inline volumes so that they can be cleaned up after restarts")
+	servers                      = flag.String("servers", "", "comma separated lustre servers (e.g. 172.16.100.189@tcp:/testfs) whose volumes are listed by ListVolumes even if the controller has not mounted them yet")
+	mgsSSHTarget                 = flag.String("mgs-ssh-target", "", "ssh destination (e.g. root@mgs01) of the MGS on which the controller runs lctl snapshot_* for lctl snapshots, which are rejected when unset")
 	defaultOnDeletePolicy        = flag.String("default-ondelete-policy", "delete", "default policy for deleting subdirectory when deleting a volume")
 	volStatsCacheExpireInMinutes = flag.Int("vol-stats-cache-expire-in-minutes", 10, "The cache expire time in minutes for volume stats cache")
+	cloneParallelism             = flag.Int("clone-parallelism", 16, "maximum number of files copied concurrently when cloning a volume")
+	lockWaitTimeout              = flag.Duration("lock-wait-timeout", 0, "how long a volume operation waits for another operation on the same volume to finish before returning Aborted, 0 to fail immediately")
+	lockStuckThreshold           = flag.Duration("lock-stuck-threshold", 10*time.Minute, "volume operations holding a lock longer than this are logged as stuck")
 )
 
 func main() {
@@ -36,9 +46,27 @@ func handle() {
 		Endpoint:                     *endpoint,
 		MountPermissions:             *mountPermissions,
 		WorkingMountDir:              *workingMountDir,
+		NodeMountDir:                 *nodeMountDir,
+		EphemeralBaseDir:             *ephemeralBaseDir,
+		StateDir:                     *stateDir,
+		Servers:                      splitServers(*servers),
+		MGSSSHTarget:                 *mgsSSHTarget,
 		DefaultOnDeletePolicy:        *defaultOnDeletePolicy,
 		VolStatsCacheExpireInMinutes: *volStatsCacheExpireInMinutes,
+		CloneParallelism:             *cloneParallelism,
+		LockWaitTimeout:              *lockWaitTimeout,
+		LockStuckThreshold:           *lockStuckThreshold,
 	}
 	d := lustre.NewDriver(&driverOptions)
 	d.Run(false)
 }
+
+func splitServers(val string) []string {
+	var servers []string
+	for _, server := range strings.Split(val, ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
@@ -0,0 +1,474 @@
+package lustre
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// cloneProgressDir 为文件系统根目录下记录克隆进度的目录，每个目标卷一个 JSON 文件
+	cloneProgressDir        = driverMetadataDir + "/clones"
+	defaultCloneParallelism = 16
+	// 每复制这么多个文件持久化一次进度
+	cloneProgressInterval = 1000
+)
+
+// 需要随文件复制的扩展属性前缀，lustre.* 与 trusted.* 为文件系统内部属性，不复制
+var cloneXattrPrefixes = []string{
+	"user.",
+	"security.",
+	"system.posix_acl_access",
+	"system.posix_acl_default",
+}
+
+// cloneProgress 记录克隆进度，CreateVolume 重试时据此跳过已完成的克隆
+type cloneProgress struct {
+	// Source 为源卷或快照的 ID
+	Source    string    `json:"source"`
+	Completed bool      `json:"completed"`
+	Files     int64     `json:"files"`
+	Bytes     int64     `json:"bytes"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func getCloneProgressPath(fsRoot, name string) string {
+	return filepath.Join(fsRoot, cloneProgressDir, strings.ReplaceAll(name, "/", "_")+".json")
+}
+
+func removeCloneProgress(fsRoot, name string) error {
+	if err := os.Remove(getCloneProgressPath(fsRoot, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// treeCopier 以有限的并发复制目录树，保留属主、权限、扩展属性、时间戳和 Lustre 条带布局。
+// 目标端已存在且大小和修改时间都与源一致的文件视为已复制，重试时直接跳过；
+// 硬链接会被复制为独立的文件。
+type treeCopier struct {
+	runner      CommandRunner
+	parallelism int
+	// onProgress 每复制 cloneProgressInterval 个文件调用一次，可能被并发调用
+	onProgress func(files, bytes int64)
+
+	files   int64
+	bytes   int64
+	skipped int64
+	// noReflink 在文件系统不支持 reflink 后置位，之后不再尝试
+	noReflink int32
+	// keepDstRoot 为 true 时不把源根目录的布局和属性复制到目标根目录，
+	// 克隆卷的根目录保留 CreateVolume 按 StorageClass 设置的布局、权限和属主
+	keepDstRoot bool
+}
+
+type copyJob struct {
+	src, dst string
+	info     os.FileInfo
+}
+
+func (c *treeCopier) copyTree(ctx context.Context, src, dst string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	parallelism := c.parallelism
+	if parallelism <= 0 {
+		parallelism = defaultCloneParallelism
+	}
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	jobs := make(chan copyJob)
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				if err := c.copyFile(ctx, job.src, job.dst, job.info); err != nil {
+					fail(fmt.Errorf("failed to copy %s: %v", job.src, err))
+				}
+			}
+		}()
+	}
+
+	// 目录在遍历时按先父后子的顺序创建，属性则等所有内容复制完后自底向上设置，
+	// 避免子项的写入改变父目录的修改时间，或只读目录阻挡后续的写入
+	var dirs []copyJob
+	walkErr := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir() && rel == "." && c.keepDstRoot:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return fmt.Errorf("failed to create directory %s: %v", target, err)
+			}
+		case info.IsDir():
+			if err := c.makeDir(ctx, path, target); err != nil {
+				return fmt.Errorf("failed to create directory %s: %v", target, err)
+			}
+			dirs = append(dirs, copyJob{src: path, dst: target, info: info})
+		case info.Mode().IsRegular():
+			select {
+			case jobs <- copyJob{src: path, dst: target, info: info}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		default:
+			if err := c.copySpecial(path, target, info); err != nil {
+				return fmt.Errorf("failed to copy %s: %v", path, err)
+			}
+		}
+		return nil
+	})
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if walkErr != nil {
+		return walkErr
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := copyMetadata(dirs[i].src, dirs[i].dst, dirs[i].info); err != nil {
+			return fmt.Errorf("failed to copy attributes of %s: %v", dirs[i].src, err)
+		}
+	}
+	return nil
+}
+
+func (c *treeCopier) makeDir(ctx context.Context, src, dst string) error {
+	if err := os.Mkdir(dst, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	// 对已有目录重复设置默认布局是幂等的
+	return copyLayout(ctx, c.runner, src, dst, true)
+}
+
+func (c *treeCopier) copyFile(ctx context.Context, src, dst string, info os.FileInfo) error {
+	st, err := os.Lstat(dst)
+	switch {
+	case err == nil:
+		if st.Mode().IsRegular() && st.Size() == info.Size() && st.ModTime().Equal(info.ModTime()) {
+			atomic.AddInt64(&c.skipped, 1)
+			c.addProgress(0)
+			return nil
+		}
+	case os.IsNotExist(err):
+		// 条带布局只能在创建文件时指定，先按源文件布局创建空文件再写入数据
+		if err := copyLayout(ctx, c.runner, src, dst, false); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	n, err := c.copyData(ctx, out, in, info.Size())
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	// 修改时间最后设置，作为该文件已完整复制的标记
+	if err := copyMetadata(src, dst, info); err != nil {
+		return err
+	}
+	c.addProgress(n)
+	return nil
+}
+
+// copyData 优先通过 reflink 让目标与源共享数据块、写时再复制，文件系统不支持时回退为逐字节复制。
+// Lustre 不支持 reflink；硬链接会与源共享此后的修改，因此不用于克隆和快照
+func (c *treeCopier) copyData(ctx context.Context, out, in *os.File, size int64) (int64, error) {
+	if atomic.LoadInt32(&c.noReflink) == 0 {
+		err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd()))
+		if err == nil {
+			return size, nil
+		}
+		switch err {
+		case unix.EOPNOTSUPP, unix.ENOTTY, unix.EXDEV, unix.ENOSYS:
+			atomic.StoreInt32(&c.noReflink, 1)
+		default:
+			klog.V(4).InfoS("reflink failed, falling back to copy", "path", in.Name(), "err", err)
+		}
+	}
+	return io.Copy(out, &contextReader{ctx: ctx, r: in})
+}
+
+func (c *treeCopier) copySpecial(src, dst string, info os.FileInfo) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("unsupported file info type %T", info.Sys())
+	}
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	switch info.Mode().Type() {
+	case os.ModeSymlink:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(link, dst); err != nil {
+			return err
+		}
+	case os.ModeSocket:
+		klog.V(4).InfoS("skipping socket while cloning", "path", src)
+		return nil
+	default:
+		if err := unix.Mknod(dst, st.Mode, int(st.Rdev)); err != nil {
+			return err
+		}
+	}
+	if err := copyMetadata(src, dst, info); err != nil {
+		return err
+	}
+	c.addProgress(0)
+	return nil
+}
+
+func (c *treeCopier) addProgress(n int64) {
+	copied := atomic.AddInt64(&c.bytes, n)
+	files := atomic.AddInt64(&c.files, 1)
+	if c.onProgress != nil && files%cloneProgressInterval == 0 {
+		c.onProgress(files, copied)
+	}
+}
+
+// copyLayout 通过 lfs getstripe --yaml 导出源的布局并用 lfs setstripe --yaml 应用到目标，
+// 对文件会按该布局创建空文件，对目录则设置默认布局；源没有布局信息时不做处理
+func copyLayout(ctx context.Context, runner CommandRunner, src, dst string, isDir bool) error {
+	args := []string{"getstripe", "--yaml"}
+	if isDir {
+		args = append(args, "-d")
+	}
+	out, err := runner.Run(ctx, lfsCmd, append(args, src)...)
+	if err != nil {
+		return err
+	}
+	if !bytes.Contains(out, []byte("stripe_count")) && !bytes.Contains(out, []byte("lcm_layout_gen")) {
+		return nil
+	}
+
+	tmp, err := os.CreateTemp("", "lustre-layout-*.yaml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(out)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	_, err = runner.Run(ctx, lfsCmd, "setstripe", "--yaml", tmp.Name(), dst)
+	return err
+}
+
+// copyMetadata 复制扩展属性、属主、权限和时间戳，顺序不能调换：chown 会清除 setuid 位
+func copyMetadata(src, dst string, info os.FileInfo) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("unsupported file info type %T", info.Sys())
+	}
+	isLink := info.Mode()&os.ModeSymlink != 0
+	if !isLink {
+		if err := copyXattrs(src, dst); err != nil {
+			return err
+		}
+	}
+	if err := os.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil {
+		return err
+	}
+	if !isLink {
+		if err := os.Chmod(dst, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+	}
+	times := []unix.Timespec{
+		unix.NsecToTimespec(syscall.TimespecToNsec(st.Atim)),
+		unix.NsecToTimespec(syscall.TimespecToNsec(st.Mtim)),
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, dst, times, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+func copyXattrs(src, dst string) error {
+	size, err := unix.Llistxattr(src, nil)
+	if err != nil {
+		if err == unix.ENOTSUP {
+			return nil
+		}
+		return err
+	}
+	if size == 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(src, buf); err != nil {
+		return err
+	}
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name == "" || !hasXattrPrefix(name) {
+			continue
+		}
+		valSize, err := unix.Lgetxattr(src, name, nil)
+		if err != nil {
+			if err == unix.ENODATA {
+				continue
+			}
+			return err
+		}
+		val := make([]byte, valSize)
+		if valSize, err = unix.Lgetxattr(src, name, val); err != nil {
+			return err
+		}
+		if err := unix.Lsetxattr(dst, name, val[:valSize], 0); err != nil {
+			return fmt.Errorf("failed to set xattr %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func hasXattrPrefix(name string) bool {
+	for _, prefix := range cloneXattrPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// contextReader 在每次读取前检查 ctx，使大文件的复制也能被及时取消
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// validateCloneSource 挂载源卷并检查其子目录存在、容量不超过新卷且两者目录互不嵌套
+func (cs *ControllerServer) validateCloneSource(ctx context.Context, dst, src *Lustre, capacity int64) error {
+	if err := cs.mountLustreVol(ctx, src); err != nil {
+		return status.Errorf(codes.Internal, "failed to mount lustre: %v", err)
+	}
+	srcPath := getInternalMountPath(src)
+	if _, err := os.Stat(srcPath); err != nil {
+		if os.IsNotExist(err) {
+			return status.Errorf(codes.NotFound, "source volume %s not found", src.FSId)
+		}
+		return status.Errorf(codes.Internal, "failed to stat %s: %v", srcPath, err)
+	}
+	dstPath := getInternalMountPath(dst)
+	if dstPath == srcPath || strings.HasPrefix(dstPath, srcPath+"/") || strings.HasPrefix(srcPath, dstPath+"/") {
+		return status.Errorf(codes.InvalidArgument, "volume %s overlaps with source volume %s", dst.UUID, src.FSId)
+	}
+	if src.UUID != "" {
+		meta, err := readVolumeMetadata(src.MountPoint, src.UUID)
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to read metadata of source volume %s: %v", src.FSId, err)
+		}
+		if meta != nil && meta.CapacityBytes > capacity {
+			return status.Errorf(codes.OutOfRange, "requested capacity %d is smaller than source volume capacity %d", capacity, meta.CapacityBytes)
+		}
+	}
+	return nil
+}
+
+// cloneVolume 将源卷的目录树复制到新卷，进度记录在新卷所在的文件系统上：
+// 已完成的克隆在 CreateVolume 重试时直接跳过，未完成的则从已复制的文件之后继续
+func (cs *ControllerServer) cloneVolume(ctx context.Context, dst, src *Lustre) error {
+	progressPath := getCloneProgressPath(dst.MountPoint, dst.UUID)
+	progress := &cloneProgress{}
+	if _, err := readJSONFile(progressPath, progress); err != nil {
+		return err
+	}
+	if progress.Completed && progress.Source == src.FSId {
+		klog.V(2).InfoS("CreateVolume: clone already completed", "volumeName", dst.UUID, "source", src.FSId)
+		return nil
+	}
+	if err := writeJSONFile(progressPath, &cloneProgress{Source: src.FSId, UpdatedAt: time.Now().UTC()}); err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	copier := &treeCopier{
+		runner:      cs.Driver.Runner,
+		parallelism: cs.Driver.CloneParallelism,
+		keepDstRoot: true,
+		onProgress: func(files, bytes int64) {
+			mu.Lock()
+			defer mu.Unlock()
+			klog.V(2).InfoS("CreateVolume: cloning", "volumeName", dst.UUID, "source", src.FSId, "files", files, "bytes", bytes)
+			if err := writeJSONFile(progressPath, &cloneProgress{Source: src.FSId, Files: files, Bytes: bytes, UpdatedAt: time.Now().UTC()}); err != nil {
+				klog.Warningf("failed to record clone progress of volume %s: %v", dst.UUID, err)
+			}
+		},
+	}
+	start := time.Now()
+	if err := copier.copyTree(ctx, getInternalMountPath(src), getInternalMountPath(dst)); err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	klog.V(2).InfoS("CreateVolume: clone completed", "volumeName", dst.UUID, "source", src.FSId,
+		"files", copier.files, "skipped", copier.skipped, "bytes", copier.bytes, "duration", time.Since(start))
+	return writeJSONFile(progressPath, &cloneProgress{
+		Source:    src.FSId,
+		Completed: true,
+		Files:     copier.files,
+		Bytes:     copier.bytes,
+		UpdatedAt: time.Now().UTC(),
+	})
+}
@@ -0,0 +1,323 @@
+package lustre
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func writeTestFile(t *testing.T, path, content string, mode os.FileMode, mtime time.Time) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCopyTree(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	dst := filepath.Join(t.TempDir(), "dst")
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	writeTestFile(t, filepath.Join(src, "a.txt"), "hello", 0640, mtime)
+	writeTestFile(t, filepath.Join(src, "bin", "run.sh"), "#!/bin/sh\n", 0755, mtime)
+	for i := 0; i < 50; i++ {
+		writeTestFile(t, filepath.Join(src, "data", "part", strings.Repeat("x", i%5+1)+string(rune('a'+i%26))+".bin"), strings.Repeat("d", i), 0644, mtime)
+	}
+	if err := os.Symlink("a.txt", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	// 只读目录的权限要在其内容复制完之后才设置
+	if err := os.Chmod(filepath.Join(src, "bin"), 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(filepath.Join(src, "bin"), 0755)
+	defer os.Chmod(filepath.Join(dst, "bin"), 0755)
+	if err := os.Chtimes(filepath.Join(src, "data"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	xattrSupported := unix.Setxattr(filepath.Join(src, "a.txt"), "user.dataset", []byte("golden"), 0) == nil
+
+	runner := newFakeCommandRunner()
+	runner.outputs["lfs getstripe --yaml "+filepath.Join(src, "a.txt")] = "lmm_stripe_count:  4\nlmm_stripe_size:   1048576\nstripe_count: 4\n"
+	copier := &treeCopier{runner: runner, parallelism: 4}
+	if err := copier.copyTree(context.Background(), src, dst); err != nil {
+		t.Fatalf("copyTree: %v", err)
+	}
+
+	if copier.files != 53 || copier.bytes != int64(5+10+1225) {
+		t.Errorf("unexpected progress: files %d, bytes %d", copier.files, copier.bytes)
+	}
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		got, err := os.Lstat(filepath.Join(dst, rel))
+		if err != nil {
+			t.Errorf("%s not copied: %v", rel, err)
+			return nil
+		}
+		if got.Mode() != info.Mode() {
+			t.Errorf("%s: mode %v, expected %v", rel, got.Mode(), info.Mode())
+		}
+		if info.Mode().IsRegular() {
+			if !got.ModTime().Equal(info.ModTime()) {
+				t.Errorf("%s: mtime %v, expected %v", rel, got.ModTime(), info.ModTime())
+			}
+			want, _ := os.ReadFile(path)
+			data, _ := os.ReadFile(filepath.Join(dst, rel))
+			if string(data) != string(want) {
+				t.Errorf("%s: content %q, expected %q", rel, data, want)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := os.Stat(filepath.Join(dst, "data")); !st.ModTime().Equal(mtime) {
+		t.Errorf("directory mtime %v, expected %v", st.ModTime(), mtime)
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "link")); err != nil || link != "a.txt" {
+		t.Errorf("symlink target %q, %v", link, err)
+	}
+	if xattrSupported {
+		buf := make([]byte, 64)
+		n, err := unix.Getxattr(filepath.Join(dst, "a.txt"), "user.dataset", buf)
+		if err != nil || string(buf[:n]) != "golden" {
+			t.Errorf("xattr not copied: %q, %v", buf[:n], err)
+		}
+	}
+
+	var setstripe []string
+	for _, call := range runner.Calls() {
+		if strings.HasPrefix(call, "lfs setstripe --yaml ") {
+			setstripe = append(setstripe, call)
+		}
+	}
+	if len(setstripe) != 1 || !strings.HasSuffix(setstripe[0], " "+filepath.Join(dst, "a.txt")) {
+		t.Errorf("unexpected setstripe calls: %v", setstripe)
+	}
+}
+
+func TestCopyTreeResume(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	writeTestFile(t, filepath.Join(src, "done"), "source", 0644, mtime)
+	writeTestFile(t, filepath.Join(src, "partial"), "source", 0644, mtime)
+	// 上次中断时已完整复制的文件与源大小和修改时间一致，内容用于区分是否被重新复制
+	writeTestFile(t, filepath.Join(dst, "done"), "copied", 0644, mtime)
+	writeTestFile(t, filepath.Join(dst, "partial"), "sou", 0600, time.Now())
+
+	copier := &treeCopier{runner: newFakeCommandRunner(), parallelism: 2}
+	if err := copier.copyTree(context.Background(), src, dst); err != nil {
+		t.Fatalf("copyTree: %v", err)
+	}
+	if copier.skipped != 1 {
+		t.Errorf("skipped %d files, expected 1", copier.skipped)
+	}
+	for name, want := range map[string]string{"done": "copied", "partial": "source"} {
+		data, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil || string(data) != want {
+			t.Errorf("%s: content %q, %v, expected %q", name, data, err, want)
+		}
+	}
+}
+
+func TestCopyTreeCanceled(t *testing.T) {
+	src := t.TempDir()
+	writeTestFile(t, filepath.Join(src, "f"), "data", 0644, time.Now())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	copier := &treeCopier{runner: newFakeCommandRunner(), parallelism: 2}
+	if err := copier.copyTree(ctx, src, t.TempDir()); err == nil {
+		t.Errorf("expected error on canceled context")
+	}
+}
+
+func TestCreateVolumeFromVolume(t *testing.T) {
+	cs := initTestController(t)
+	baseDir := t.TempDir()
+	volumeCaps := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+	}
+	params := map[string]string{paramServer: testServer, paramBaseDir: baseDir}
+	newRequest := func(name string, capacity int64, source *csi.VolumeContentSource) *csi.CreateVolumeRequest {
+		volParams := map[string]string{}
+		for k, v := range params {
+			volParams[k] = v
+		}
+		return &csi.CreateVolumeRequest{
+			Name:                name,
+			VolumeCapabilities:  volumeCaps,
+			CapacityRange:       &csi.CapacityRange{RequiredBytes: capacity},
+			Parameters:          volParams,
+			VolumeContentSource: source,
+		}
+	}
+	volumeSource := func(volID string) *csi.VolumeContentSource {
+		return &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: volID},
+			},
+		}
+	}
+
+	srcResp, err := cs.CreateVolume(context.Background(), newRequest("golden", 1<<30, nil))
+	if err != nil {
+		t.Fatalf("failed to create source volume: %v", err)
+	}
+	srcID := srcResp.GetVolume().GetVolumeId()
+	writeTestFile(t, filepath.Join(baseDir, "golden", "train", "part-0"), "dataset", 0644, time.Now())
+
+	resp, err := cs.CreateVolume(context.Background(), newRequest("experiment-1", 2<<30, volumeSource(srcID)))
+	if err != nil {
+		t.Fatalf("failed to clone volume: %v", err)
+	}
+	if resp.GetVolume().GetContentSource().GetVolume().GetVolumeId() != srcID {
+		t.Errorf("unexpected content source %v", resp.GetVolume().GetContentSource())
+	}
+	data, err := os.ReadFile(filepath.Join(baseDir, "experiment-1", "train", "part-0"))
+	if err != nil || string(data) != "dataset" {
+		t.Errorf("cloned content %q, %v", data, err)
+	}
+	progress := &cloneProgress{}
+	if found, err := readJSONFile(getCloneProgressPath(baseDir, "experiment-1"), progress); !found || err != nil {
+		t.Fatalf("clone progress not recorded: %v", err)
+	}
+	if !progress.Completed || progress.Source != srcID || progress.Files != 1 {
+		t.Errorf("unexpected clone progress %+v", progress)
+	}
+
+	// 已完成的克隆在重试时不会再次复制
+	writeTestFile(t, filepath.Join(baseDir, "golden", "train", "part-1"), "late", 0644, time.Now())
+	if _, err := cs.CreateVolume(context.Background(), newRequest("experiment-1", 2<<30, volumeSource(srcID))); err != nil {
+		t.Fatalf("retry failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(baseDir, "experiment-1", "train", "part-1")); !os.IsNotExist(err) {
+		t.Errorf("completed clone was copied again: %v", err)
+	}
+
+	// 删除卷时清理克隆进度
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: resp.GetVolume().GetVolumeId()}); err != nil {
+		t.Fatalf("DeleteVolume: %v", err)
+	}
+	if _, err := os.Stat(getCloneProgressPath(baseDir, "experiment-1")); !os.IsNotExist(err) {
+		t.Errorf("clone progress not removed: %v", err)
+	}
+
+	errCases := []struct {
+		name string
+		req  *csi.CreateVolumeRequest
+		code codes.Code
+	}{
+		{
+			name: "capacity smaller than source",
+			req:  newRequest("experiment-2", 1<<20, volumeSource(srcID)),
+			code: codes.OutOfRange,
+		},
+		{
+			name: "source not found",
+			req: newRequest("experiment-3", 1<<30, volumeSource(getVolumeIDFromLustreVol(&Lustre{
+				ServerName: testServer, MountPoint: baseDir, SubDir: "missing", UUID: "missing",
+			}))),
+			code: codes.NotFound,
+		},
+		{
+			name: "invalid source id",
+			req:  newRequest("experiment-4", 1<<30, volumeSource("invalid")),
+			code: codes.NotFound,
+		},
+	}
+	for _, tc := range errCases {
+		_, err := cs.CreateVolume(context.Background(), tc.req)
+		if status.Code(err) != tc.code {
+			t.Errorf("%s: expected code %v, got %v", tc.name, tc.code, err)
+		}
+	}
+}
+
+// 克隆卷的根目录保留 StorageClass 设置的布局和权限，不被源卷根目录的属性覆盖
+func TestCreateVolumeFromVolumeKeepsRootSettings(t *testing.T) {
+	cs := initTestController(t)
+	runner := cs.Driver.Runner.(*fakeCommandRunner)
+	baseDir := t.TempDir()
+	volumeCaps := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+	}
+	srcResp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "golden",
+		VolumeCapabilities: volumeCaps,
+		Parameters:         map[string]string{paramServer: testServer, paramBaseDir: baseDir, paramMountPermissions: "0700"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create source volume: %v", err)
+	}
+	srcRoot := filepath.Join(baseDir, "golden")
+	writeTestFile(t, filepath.Join(srcRoot, "train", "part-0"), "dataset", 0644, time.Now())
+	runner.outputs["lfs getstripe --yaml -d "+srcRoot] = "stripe_count: 1\nstripe_size: 1048576\n"
+	runner.outputs["lfs getstripe --yaml -d "+filepath.Join(srcRoot, "train")] = "stripe_count: 1\nstripe_size: 1048576\n"
+
+	_, err = cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "experiment-1",
+		VolumeCapabilities: volumeCaps,
+		Parameters: map[string]string{
+			paramServer:           testServer,
+			paramBaseDir:          baseDir,
+			paramMountPermissions: "2770",
+			paramStripeCount:      "4",
+		},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: srcResp.GetVolume().GetVolumeId()},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to clone volume: %v", err)
+	}
+	dstRoot := filepath.Join(baseDir, "experiment-1")
+	st, err := os.Stat(dstRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode()&(os.ModePerm|os.ModeSetgid) != os.ModeSetgid|0770 {
+		t.Errorf("clone root mode %v, expected the mode of the storage class", st.Mode())
+	}
+	var rootLayout, subdirLayout bool
+	for _, call := range runner.Calls() {
+		if strings.HasPrefix(call, "lfs setstripe --yaml ") {
+			rootLayout = rootLayout || strings.HasSuffix(call, " "+dstRoot)
+			subdirLayout = subdirLayout || strings.HasSuffix(call, " "+filepath.Join(dstRoot, "train"))
+		}
+	}
+	if rootLayout || !subdirLayout {
+		t.Errorf("source layout copied to root %v, to subdirectory %v: %v", rootLayout, subdirLayout, runner.Calls())
+	}
+}
@@ -4,12 +4,18 @@ import (
 	"context"
 	"fmt"
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
 	"k8s.io/mount-utils"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -18,12 +24,9 @@ const (
 	volumeContextServerName       = "servername"
 	volumeContextMountName        = "mountname"
 	volumeContextSubName          = "subname"
-	idServer                      = iota
-	idBaseDir
-	idSubDir
-	idUUID
-	idOnDelete
-	totalIDElements // Always last
+
+	// volumeConditionTimeout 为检查文件系统是否可达时等待 statfs 的时间
+	volumeConditionTimeout = 10 * time.Second
 )
 
 var (
@@ -35,6 +38,12 @@ var (
 		{
 			Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
 		},
+		{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		},
+		{
+			Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		},
 	}
 
 	// controllerCaps represents the capability of controller service
@@ -47,6 +56,9 @@ var (
 type ControllerServer struct {
 	csi.UnimplementedControllerServer
 	Driver *Driver
+	Mount  mount.Interface
+	// snapshotCopies 记录后台运行中的快照复制任务，快照 ID -> *snapshotCopy
+	snapshotCopies sync.Map
 }
 
 func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
@@ -68,14 +80,15 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		reqCapacity = DefaultVolumeSize
 	}
 
-	if ok := cs.Driver.VolumeLocks.Insert(volName); !ok {
-		msg := fmt.Sprintf("Create volume request for %s is already in progress", volName)
-
-		return nil, status.Error(codes.Aborted, msg)
+	release, err := cs.Driver.lockVolume(ctx, volName, "CreateVolume", LockExclusive)
+	if err != nil {
+		return nil, status.Errorf(codes.Aborted, "Create volume request for %s is already in progress: %v", volName, err)
 	}
+	defer release()
 
 	lustre := &Lustre{
-		Mount:       mount.New(""),
+		UUID:        volName,
+		Mount:       cs.Mount,
 		OnDelete:    cs.Driver.DefaultOnDeletePolicy,
 		StorageType: paramFsType,
 	}
@@ -84,12 +97,41 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	if volParam == nil {
 		volParam = make(map[string]string)
 	}
-	if _, ok := volParam[paramBaseDir]; !ok {
-		volParam[paramServer] = cs.Driver.WorkingMountDir
+
+	// 将 base_dir 和 subdir 中的 PVC/PV 元数据占位符替换为 provisioner 传入的取值，元数据参数只用于替换，不写入卷上下文。
+	// 替换后的路径在下面与普通参数一样校验，拒绝包含 '..' 的取值。base_dir 是控制器上的挂载点，每个不同的取值会多出一个文件系统挂载
+	replacements, err := getMetadataReplacements(volParam)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	for _, key := range []string{pvcNameKey, pvcNamespaceKey, pvNameKey} {
+		delete(volParam, key)
+	}
+	for _, param := range []string{paramBaseDir, paramSubDir} {
+		val, ok := volParam[param]
+		if !ok {
+			continue
+		}
+		val = replaceWithMap(val, replacements)
+		if strings.Contains(val, "${") {
+			return nil, status.Errorf(codes.InvalidArgument, "%s %q contains unresolved placeholders, supported placeholders are %s, %s and %s and require --extra-create-metadata of csi-provisioner",
+				param, val, pvcNameMetadata, pvcNamespaceMetadata, pvNameMetadata)
+		}
+		volParam[param] = val
 	}
 
 	// 设置 Lustre 参数
 	cs.setLustreParameters(volParam, lustre)
+	if err := validateSubDir(lustre.SubDir); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if lustre.MountPoint != "" && (!filepath.IsAbs(lustre.MountPoint) || validateSubDir(lustre.MountPoint) != nil) {
+		return nil, status.Errorf(codes.InvalidArgument, "%s %s must be an absolute path without '..'", paramBaseDir, lustre.MountPoint)
+	}
+	if _, ok := volParam[paramBaseDir]; !ok {
+		lustre.MountPoint = cs.getWorkingMountPath(lustre)
+		volParam[paramBaseDir] = lustre.MountPoint
+	}
 	if lustre.SubDir == "" {
 		lustre.SubDir = req.GetName()
 		volParam["subdir"] = lustre.SubDir
@@ -100,6 +142,72 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
+	// 校验挂载选项，StorageClass 的 mountOptions 通过卷能力的 MountFlags 传入
+	mountFlags := []string{volParam[paramMountOptions]}
+	for _, c := range volCaps {
+		mountFlags = append(mountFlags, c.GetMount().GetMountFlags()...)
+	}
+	mountOptions, err := parseMountOptions(mountFlags...)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	lustre.MountOptions = mountOptions
+	if _, ok := volParam[paramMountOptions]; ok {
+		paramOptions, _ := parseMountOptions(volParam[paramMountOptions])
+		volParam[paramMountOptions] = strings.Join(paramOptions, ",")
+	}
+
+	// 校验项目配额参数。显式指定的项目 ID 被 StorageClass 的所有卷共用，配额限制的是这些卷的总用量
+	var inodeLimit uint64
+	if lustre.ProjectId != "" {
+		if lustre.ProjectId != autoProjectId {
+			if _, err := parseProjectId(lustre.ProjectId); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			klog.Warningf("volume %s uses explicit %s %s, its quota is shared with all volumes using the same project ID", volName, paramDIRPid, lustre.ProjectId)
+		}
+		if val, ok := volParam[paramInodeLimit]; ok {
+			var err error
+			if inodeLimit, err = strconv.ParseUint(val, 10, 64); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid %s %q: %v", paramInodeLimit, val, err)
+			}
+		}
+	}
+
+	// 校验子目录的权限和属主，未设置属主时保持为驱动进程的用户
+	dirMode, err := cs.Driver.getMountPermissions(volParam)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	uid, gid := -1, -1
+	if lustre.Uid != "" {
+		if uid, err = parseOwnerId(paramDIRUid, lustre.Uid); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	if lustre.Gid != "" {
+		if gid, err = parseOwnerId(paramDIRGid, lustre.Gid); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	// 校验条带参数或复合布局
+	layout, err := parseDirLayout(volParam)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if layout != nil {
+		layout.params(volParam)
+	}
+
+	var sourceVol *Lustre
+	if sourceVolume := req.GetVolumeContentSource().GetVolume(); sourceVolume != nil {
+		if sourceVol, err = getLustreVolFromID(sourceVolume.GetVolumeId()); err != nil {
+			return nil, status.Errorf(codes.NotFound, "source volume %s not found: %v", sourceVolume.GetVolumeId(), err)
+		}
+		sourceVol.FSId = sourceVolume.GetVolumeId()
+	}
+
 	lustre.FSId = getVolumeIDFromLustreVol(lustre)
 
 	// 挂载操作
@@ -108,9 +216,52 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	}
 
 	internalVolumePath := getInternalMountPath(lustre)
-	if err := os.MkdirAll(internalVolumePath, 0777); err != nil {
+	if sourceSnapshot := req.GetVolumeContentSource().GetSnapshot(); sourceSnapshot != nil {
+		// 从快照恢复即以快照数据目录为源进行克隆
+		if sourceVol, err = cs.getSnapshotCloneSource(ctx, sourceSnapshot.GetSnapshotId(), reqCapacity); err != nil {
+			return nil, err
+		}
+	}
+	if sourceVol != nil {
+		if err := cs.validateCloneSource(ctx, lustre, sourceVol, reqCapacity); err != nil {
+			return nil, err
+		}
+	}
+	if err := makeDir(internalVolumePath, dirMode); err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to make subdirectory: %v", err)
 	}
+	if layout != nil {
+		if err := setDirStripe(ctx, cs.Driver.Runner, internalVolumePath, layout); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to set stripe layout on %s: %v", internalVolumePath, err)
+		}
+	}
+	// 先克隆再设置项目配额，配额的递归设置会覆盖复制过来的全部文件
+	if sourceVol != nil {
+		if err := cs.cloneVolume(ctx, lustre, sourceVol); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to clone volume %s: %v", sourceVol.FSId, err)
+		}
+	}
+	if uid >= 0 || gid >= 0 {
+		if err := os.Chown(internalVolumePath, uid, gid); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to change owner of %s: %v", internalVolumePath, err)
+		}
+	}
+	if lustre.ProjectId != "" {
+		projectId, err := applyProjectQuota(ctx, cs.Driver.Runner, lustre, reqCapacity, inodeLimit)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to set project quota on %s: %v", internalVolumePath, err)
+		}
+		volParam[paramDIRPid] = strconv.FormatUint(uint64(projectId), 10)
+	}
+	if err := writeVolumeMetadata(lustre.MountPoint, &volumeMetadata{
+		VolumeID:      lustre.FSId,
+		Name:          volName,
+		CapacityBytes: reqCapacity,
+		VolumeContext: volParam,
+		CreatedAt:     time.Now().UTC(),
+	}); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to write volume metadata: %v", err)
+	}
 	klog.V(5).InfoS("CreateMount:", "volumeName", lustre.MountPoint, lustre.SubDir)
 
 	return &csi.CreateVolumeResponse{
@@ -143,6 +294,9 @@ func (cs *ControllerServer) setLustreParameters(volParam map[string]string, lust
 	if val, ok := volParam[paramDIRUid]; ok {
 		lustre.Uid = val
 	}
+	if val, ok := volParam[paramDIRGid]; ok {
+		lustre.Gid = val
+	}
 }
 
 func (cs *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
@@ -152,13 +306,108 @@ func (cs *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 	if len(volID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
 	}
+	release, err := cs.Driver.lockVolume(ctx, volID, "DeleteVolume", LockExclusive)
+	if err != nil {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt+": %v", volID, err)
+	}
+	defer release()
+
+	lustre, err := getLustreVolFromID(volID)
+	if err != nil {
+		// An invalid ID should be treated as doesn't exist
+		klog.Warningf("failed to get lustre volume for volume id %v deletion: %v", volID, err)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+	if lustre.OnDelete == "" {
+		lustre.OnDelete = cs.Driver.DefaultOnDeletePolicy
+	}
+
+	if err := cs.mountLustreVol(ctx, lustre); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to mount lustre: %v", err)
+	}
+	// ControllerModifyVolume 修改后的删除策略记录在卷元数据中。元数据和克隆进度在删除策略执行成功后才删除，
+	// 否则失败重试时会回退到卷 ID 中的策略，例如把改为 archive 的卷直接删除
+	if lustre.UUID != "" {
+		meta, err := readVolumeMetadata(lustre.MountPoint, lustre.UUID)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to read volume metadata: %v", err)
+		}
+		if meta != nil && meta.VolumeID == volID && meta.OnDelete != "" {
+			lustre.OnDelete = meta.OnDelete
+		}
+	}
+	if err := cs.deleteSubDir(ctx, lustre); err != nil {
+		return nil, err
+	}
+	if lustre.UUID != "" {
+		if err := removeVolumeMetadata(lustre.MountPoint, lustre.UUID); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to remove volume metadata: %v", err)
+		}
+		if err := removeCloneProgress(lustre.MountPoint, lustre.UUID); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to remove clone progress: %v", err)
+		}
+	}
 
-	// Perform any necessary cleanup here
 	klog.V(5).InfoS("DeleteVolume: volume deleted successfully", "volumeId", volID)
 
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
+// deleteSubDir 按删除策略保留、归档或删除卷的子目录，归档或删除前清除卷的项目配额
+func (cs *ControllerServer) deleteSubDir(ctx context.Context, lustre *Lustre) error {
+	if strings.EqualFold(lustre.OnDelete, retain) {
+		klog.V(2).InfoS("DeleteVolume: retain subdirectory", "subdir", lustre.SubDir)
+		return nil
+	}
+
+	internalVolumePath := getInternalMountPath(lustre)
+	// 先清除配额限制再删除或归档子目录，失败时子目录仍在，重试可以再次找到项目 ID。
+	// 项目 ID 在用量归零后可以被重新分配，归档的目录不再受容量限制
+	if projectId := cs.getAutoProjectId(ctx, internalVolumePath); projectId != 0 {
+		if err := setProjectQuota(ctx, cs.Driver.Runner, lustre.MountPoint, projectId, 0, 0); err != nil {
+			return status.Errorf(codes.Internal, "failed to clear quota of project %d: %v", projectId, err)
+		}
+	}
+	if strings.EqualFold(lustre.OnDelete, archive) {
+		archivedInternalVolumePath := getArchivedMountPath(lustre)
+		if _, err := os.Stat(internalVolumePath); os.IsNotExist(err) {
+			klog.V(2).InfoS("DeleteVolume: subdirectory not found, skip archiving", "path", internalVolumePath)
+			return nil
+		}
+		// remove stale archived subdirectory left by a previous volume with the same name
+		if err := os.RemoveAll(archivedInternalVolumePath); err != nil {
+			return status.Errorf(codes.Internal, "failed to remove archived subdirectory %s: %v", archivedInternalVolumePath, err)
+		}
+		klog.V(2).InfoS("DeleteVolume: archiving subdirectory", "from", internalVolumePath, "to", archivedInternalVolumePath)
+		if err := os.Rename(internalVolumePath, archivedInternalVolumePath); err != nil {
+			return status.Errorf(codes.Internal, "failed to archive subdirectory %s: %v", internalVolumePath, err)
+		}
+	} else {
+		klog.V(2).InfoS("DeleteVolume: removing subdirectory", "path", internalVolumePath)
+		if err := os.RemoveAll(internalVolumePath); err != nil {
+			return status.Errorf(codes.Internal, "failed to delete subdirectory %s: %v", internalVolumePath, err)
+		}
+	}
+	return nil
+}
+
+// getAutoProjectId 返回卷子目录由驱动自动分配的项目 ID，目录不存在、未设置项目 ID 或项目 ID 不在自动分配的区间内时返回 0。
+// 显式指定的项目 ID 可能被多个卷共用，删除卷时不能清除其配额
+func (cs *ControllerServer) getAutoProjectId(ctx context.Context, dir string) uint32 {
+	if _, err := os.Stat(dir); err != nil {
+		return 0
+	}
+	projectId, err := getDirProjectId(ctx, cs.Driver.Runner, dir)
+	if err != nil {
+		klog.Warningf("failed to get project id of %s: %v", dir, err)
+		return 0
+	}
+	if !isAutoProjectId(projectId) {
+		return 0
+	}
+	return projectId
+}
+
 func (cs *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "ControllerPublishVolume is not implemented")
 }
@@ -167,16 +416,186 @@ func (cs *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *
 	return nil, status.Errorf(codes.Unimplemented, "ControllerUnpublishVolume is not implemented")
 }
 
+// ValidateVolumeCapabilities 检查卷的子目录是否存在，只确认支持的访问模式和 mount 访问类型
 func (cs *ControllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
-	return nil, nil
+	volID := req.GetVolumeId()
+	if len(volID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
+	}
+	volCaps := req.GetVolumeCapabilities()
+	if len(volCaps) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume capabilities not provided")
+	}
+
+	// 无法解析的卷 ID 不可能是本驱动的卷，按规范返回 NotFound
+	lustre, err := getLustreVolFromRequest(volID, req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found: %v", volID, err)
+	}
+	if err := cs.mountLustreVol(ctx, lustre); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to mount lustre: %v", err)
+	}
+	internalVolumePath := getInternalMountPath(lustre)
+	if _, err := os.Stat(internalVolumePath); err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "subdirectory %s of volume %s not found", lustre.SubDir, volID)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to stat subdirectory %s: %v", internalVolumePath, err)
+	}
+
+	if err := isValidVolumeCapabilities(volCaps); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+	}
+	for _, c := range volCaps {
+		if _, err := parseMountOptions(c.GetMount().GetMountFlags()...); err != nil {
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+		}
+	}
+
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: volCaps,
+			Parameters:         req.GetParameters(),
+		},
+	}, nil
 }
 
+// ListVolumes 列出 --servers 指定的以及 controller 已挂载的各个 Lustre 文件系统中由本驱动创建的卷，按卷 ID 排序，
+// StartingToken 为下一页第一个卷的 ID。无法访问的文件系统记录日志后跳过，不影响其他文件系统中的卷
 func (cs *ControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	return nil, nil
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid max entries %d", req.GetMaxEntries())
+	}
+	startingToken := req.GetStartingToken()
+	if startingToken != "" {
+		if _, err := getLustreVolFromID(startingToken); err != nil {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token %q", startingToken)
+		}
+	}
+
+	fsRoots, err := cs.getKnownFsRoots(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list mount points: %v", err)
+	}
+	var metas []*volumeMetadata
+	for server, fsRoot := range fsRoots {
+		if err := statfsWithTimeout(ctx, fsRoot, volumeConditionTimeout); err != nil {
+			klog.Warningf("skipping unreachable lustre filesystem %s in ListVolumes: %v", server, err)
+			continue
+		}
+		fsMetas, err := listVolumeMetadata(fsRoot)
+		if err != nil {
+			klog.Warningf("skipping lustre filesystem %s in ListVolumes, failed to list volumes in %s: %v", server, fsRoot, err)
+			continue
+		}
+		metas = append(metas, fsMetas...)
+	}
+	sort.Slice(metas, func(i, j int) bool { return metas[i].VolumeID < metas[j].VolumeID })
+
+	start := sort.Search(len(metas), func(i int) bool { return metas[i].VolumeID >= startingToken })
+	end := len(metas)
+	if maxEntries := int(req.GetMaxEntries()); maxEntries > 0 && start+maxEntries < end {
+		end = start + maxEntries
+	}
+
+	resp := &csi.ListVolumesResponse{}
+	for _, meta := range metas[start:end] {
+		entry := &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				VolumeId:      meta.VolumeID,
+				CapacityBytes: meta.CapacityBytes,
+				VolumeContext: meta.VolumeContext,
+			},
+		}
+		// 只为当前页的卷检查健康状况，external-health-monitor 通过 ListVolumes 批量获取
+		if vol, err := getLustreVolFromID(meta.VolumeID); err == nil {
+			condition, quota := cs.getVolumeCondition(ctx, vol)
+			if quota != nil && quota.BlockHardLimitKB > 0 {
+				entry.Volume.CapacityBytes = int64(quota.BlockHardLimitKB) * 1024
+			}
+			entry.Status = &csi.ListVolumesResponse_VolumeStatus{VolumeCondition: condition}
+		}
+		resp.Entries = append(resp.Entries, entry)
+	}
+	if end < len(metas) {
+		resp.NextToken = metas[end].VolumeID
+	}
+	return resp, nil
+}
+
+// getKnownFsRoots 返回 ListVolumes 需要遍历的文件系统及其在 controller 上的挂载路径。
+// controller 已挂载的文件系统使用现有挂载，--servers 中尚未挂载的文件系统挂载到工作目录，挂载失败时记录日志后跳过
+func (cs *ControllerServer) getKnownFsRoots(ctx context.Context) (map[string]string, error) {
+	mountPoints, err := cs.Mount.List()
+	if err != nil {
+		return nil, err
+	}
+	fsRoots := map[string]string{}
+	for _, mp := range mountPoints {
+		server := strings.TrimRight(mp.Device, "/")
+		if _, ok := fsRoots[server]; mp.Type != paramFsType || ok || cs.isLctlSnapshotMount(mp.Path) {
+			continue
+		}
+		fsRoots[server] = mp.Path
+	}
+	for _, server := range cs.Driver.Servers {
+		server = strings.TrimRight(server, "/")
+		if _, ok := fsRoots[server]; ok {
+			continue
+		}
+		l := &Lustre{FSId: server, ServerName: server, StorageType: paramFsType}
+		if err := cs.mountLustreVol(ctx, l); err != nil {
+			klog.Warningf("skipping lustre filesystem %s in ListVolumes, failed to mount it: %v", server, err)
+			continue
+		}
+		fsRoots[server] = l.MountPoint
+	}
+	return fsRoots, nil
 }
 
+// GetCapacity 返回参数中 server 对应文件系统的可用空间，指定 ostPool 时汇总池内各 OST 的可用空间。
+// Lustre 文件系统对所有拓扑域可见，因此 AccessibleTopology 不影响结果。
 func (cs *ControllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	return nil, nil
+	params := req.GetParameters()
+	lustre := &Lustre{StorageType: paramFsType}
+	cs.setLustreParameters(params, lustre)
+	if lustre.ServerName == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "%s not provided in parameters", paramServer)
+	}
+	pool, hasPool := params[paramOstPool]
+	if hasPool {
+		if err := validateOstPool(pool); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	if caps := req.GetVolumeCapabilities(); len(caps) > 0 {
+		if err := isValidVolumeCapabilities(caps); err != nil {
+			return &csi.GetCapacityResponse{AvailableCapacity: 0}, nil
+		}
+	}
+
+	lustre.FSId = lustre.ServerName
+	if err := cs.mountLustreVol(ctx, lustre); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to mount lustre: %v", err)
+	}
+
+	var available int64
+	if hasPool {
+		var err error
+		if available, err = getPoolAvailableBytes(ctx, cs.Driver.Runner, lustre.MountPoint, getLustreFsName(lustre.ServerName), pool); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to get available capacity of pool %s: %v", pool, err)
+		}
+	} else {
+		var statfs unix.Statfs_t
+		if err := unix.Statfs(lustre.MountPoint, &statfs); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to statfs %s: %v", lustre.MountPoint, err)
+		}
+		available = int64(statfs.Bavail * uint64(statfs.Bsize))
+	}
+	klog.V(5).InfoS("GetCapacity", "server", lustre.ServerName, "pool", pool, "available", available)
+
+	return &csi.GetCapacityResponse{AvailableCapacity: available}, nil
 }
 
 func (cs *ControllerServer) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
@@ -185,28 +604,402 @@ func (cs *ControllerServer) ControllerGetCapabilities(ctx context.Context, req *
 	}, nil
 }
 
+// CreateSnapshot 按 VolumeSnapshotClass 的 snapshotType 参数选择快照方式：
+// copy（缺省）将源卷的子目录复制到 <base_dir>/.snapshots/<快照名>，复制在后台进行，
+// 完成前返回 ReadyToUse=false，external-snapshotter 会重复调用直到快照就绪，
+// controller 重启后再次调用时复制从已完成的文件之后继续；
+// lctl 通过 lctl snapshot_create 为整个文件系统创建快照，返回时即已就绪
 func (cs *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	return nil, nil
+	name := req.GetName()
+	sourceVolumeID := req.GetSourceVolumeId()
+	klog.V(5).InfoS("CreateSnapshot: called", "name", name, "sourceVolumeId", sourceVolumeID)
+
+	if len(name) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot name not provided")
+	}
+	if len(sourceVolumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Source volume ID not provided")
+	}
+	if err := validateSnapshotName(name); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	snapshotType, err := getSnapshotType(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if snapshotType == snapshotTypeLctl {
+		if _, err := cs.lctlRunner(); err != nil {
+			return nil, err
+		}
+	}
+	src, err := getLustreVolFromID(sourceVolumeID)
+	if err != nil {
+		return nil, err
+	}
+	if err := cs.mountLustreVol(ctx, src); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to mount lustre: %v", err)
+	}
+	if _, err := os.Stat(getInternalMountPath(src)); err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "source volume %s not found", sourceVolumeID)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to stat %s: %v", getInternalMountPath(src), err)
+	}
+
+	meta, err := readSnapshotMetadata(src.MountPoint, name)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read snapshot metadata: %v", err)
+	}
+	if meta != nil && (meta.SourceVolumeID != sourceVolumeID || meta.snapshotType() != snapshotType) {
+		return nil, status.Errorf(codes.AlreadyExists, "%s snapshot %s already exists for volume %s", meta.snapshotType(), name, meta.SourceVolumeID)
+	}
+	if meta == nil {
+		meta = &snapshotMetadata{
+			SnapshotID:     getSnapshotIDFromLustreVol(src, name, snapshotType),
+			Name:           name,
+			SourceVolumeID: sourceVolumeID,
+			CreationTime:   time.Now().UTC(),
+			Type:           snapshotType,
+		}
+		if err := writeJSONFile(getSnapshotMetadataPath(src.MountPoint, name), meta); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to write snapshot metadata: %v", err)
+		}
+	}
+	if !meta.ReadyToUse {
+		switch snapshotType {
+		case snapshotTypeLctl:
+			if err := cs.createLctlSnapshot(ctx, src, meta); err != nil {
+				return nil, err
+			}
+		default:
+			if meta.Error != "" {
+				klog.Warningf("retrying snapshot %s after previous failure: %s", meta.SnapshotID, meta.Error)
+			}
+			cs.startSnapshotCopy(src, meta)
+		}
+	}
+
+	return &csi.CreateSnapshotResponse{Snapshot: meta.toCSI()}, nil
 }
 
 func (cs *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	return nil, nil
+	snapshotID := req.GetSnapshotId()
+	klog.V(5).InfoS("DeleteSnapshot: called", "snapshotId", snapshotID)
+
+	if len(snapshotID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot ID not provided")
+	}
+	snap, err := getLustreSnapshotFromID(snapshotID)
+	if err != nil {
+		// An invalid ID should be treated as doesn't exist
+		klog.Warningf("failed to get lustre snapshot for snapshot id %v deletion: %v", snapshotID, err)
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+	if err := cs.mountLustreVol(ctx, snap.Source); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to mount lustre: %v", err)
+	}
+
+	if snap.Type == snapshotTypeLctl {
+		if err := cs.deleteLctlSnapshot(ctx, snap); err != nil {
+			return nil, err
+		}
+	} else {
+		cs.stopSnapshotCopy(snapshotID)
+		snapshotPath := getSnapshotPath(snap.Source.MountPoint, snap.Name)
+		if err := os.RemoveAll(snapshotPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to delete snapshot %s: %v", snapshotPath, err)
+		}
+	}
+	if err := os.Remove(getSnapshotMetadataPath(snap.Source.MountPoint, snap.Name)); err != nil && !os.IsNotExist(err) {
+		return nil, status.Errorf(codes.Internal, "failed to remove snapshot metadata: %v", err)
+	}
+	return &csi.DeleteSnapshotResponse{}, nil
 }
 
+// ListSnapshots 列出快照，按快照 ID 排序，StartingToken 为下一页第一个快照的 ID。
+// 指定 SnapshotId 或 SourceVolumeId 时只查询对应的文件系统，否则查询 controller 已挂载的全部文件系统
 func (cs *ControllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	return nil, nil
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid max entries %d", req.GetMaxEntries())
+	}
+	startingToken := req.GetStartingToken()
+	if startingToken != "" {
+		if _, err := getLustreSnapshotFromID(startingToken); err != nil {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token %q", startingToken)
+		}
+	}
+
+	var metas []*snapshotMetadata
+	switch {
+	case req.GetSnapshotId() != "":
+		snap, err := getLustreSnapshotFromID(req.GetSnapshotId())
+		if err != nil {
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+		if err := cs.mountLustreVol(ctx, snap.Source); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to mount lustre: %v", err)
+		}
+		meta, err := readSnapshotMetadata(snap.Source.MountPoint, snap.Name)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to read snapshot metadata: %v", err)
+		}
+		if meta != nil && (req.GetSourceVolumeId() == "" || meta.SourceVolumeID == req.GetSourceVolumeId()) {
+			metas = append(metas, meta)
+		}
+	case req.GetSourceVolumeId() != "":
+		vol, err := getLustreVolFromID(req.GetSourceVolumeId())
+		if err != nil {
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+		if err := cs.mountLustreVol(ctx, vol); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to mount lustre: %v", err)
+		}
+		fsMetas, err := listSnapshotMetadata(vol.MountPoint)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to list snapshots in %s: %v", vol.MountPoint, err)
+		}
+		for _, meta := range fsMetas {
+			if meta.SourceVolumeID == req.GetSourceVolumeId() {
+				metas = append(metas, meta)
+			}
+		}
+	default:
+		mountPoints, err := cs.Mount.List()
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to list mount points: %v", err)
+		}
+		seen := map[string]bool{}
+		for _, mp := range mountPoints {
+			if mp.Type != paramFsType || seen[mp.Device] || cs.isLctlSnapshotMount(mp.Path) {
+				continue
+			}
+			seen[mp.Device] = true
+			fsMetas, err := listSnapshotMetadata(mp.Path)
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to list snapshots in %s: %v", mp.Path, err)
+			}
+			metas = append(metas, fsMetas...)
+		}
+	}
+	sort.Slice(metas, func(i, j int) bool { return metas[i].SnapshotID < metas[j].SnapshotID })
+
+	start := sort.Search(len(metas), func(i int) bool { return metas[i].SnapshotID >= startingToken })
+	end := len(metas)
+	if maxEntries := int(req.GetMaxEntries()); maxEntries > 0 && start+maxEntries < end {
+		end = start + maxEntries
+	}
+	resp := &csi.ListSnapshotsResponse{}
+	for _, meta := range metas[start:end] {
+		resp.Entries = append(resp.Entries, &csi.ListSnapshotsResponse_Entry{Snapshot: meta.toCSI()})
+	}
+	if end < len(metas) {
+		resp.NextToken = metas[end].SnapshotID
+	}
+	return resp, nil
 }
 
+// ControllerExpandVolume 通过提高子目录所属项目的硬限制实现扩容，不需要节点侧参与
 func (cs *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	return nil, nil
+	volID := req.GetVolumeId()
+	klog.V(5).InfoS("ControllerExpandVolume: called", "volumeId", volID)
+
+	if len(volID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
+	}
+	if req.GetCapacityRange() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Capacity range not provided")
+	}
+	// 只设置 LimitBytes 时以它作为目标容量，否则 RequiredBytes 为 0 会被当作缩容
+	reqCapacity := req.GetCapacityRange().GetRequiredBytes()
+	limit := req.GetCapacityRange().GetLimitBytes()
+	if reqCapacity == 0 {
+		reqCapacity = limit
+	}
+	if reqCapacity <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "Capacity range must set required bytes or limit bytes")
+	}
+	if limit > 0 && reqCapacity > limit {
+		return nil, status.Errorf(codes.OutOfRange, "required bytes %d exceeds limit bytes %d", reqCapacity, limit)
+	}
+	release, err := cs.Driver.lockVolume(ctx, volID, "ControllerExpandVolume", LockExclusive)
+	if err != nil {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt+": %v", volID, err)
+	}
+	defer release()
+
+	lustre, err := getLustreVolFromID(volID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found: %v", volID, err)
+	}
+	if err := cs.mountLustreVol(ctx, lustre); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to mount lustre: %v", err)
+	}
+
+	internalVolumePath := getInternalMountPath(lustre)
+	if _, err := os.Stat(internalVolumePath); err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "subdirectory %s of volume %s not found", internalVolumePath, volID)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to stat subdirectory %s: %v", internalVolumePath, err)
+	}
+
+	projectId, err := getDirProjectId(ctx, cs.Driver.Runner, internalVolumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get project id of %s: %v", internalVolumePath, err)
+	}
+	if projectId == 0 {
+		// 未启用项目配额的卷没有容量限制，直接返回请求的容量
+		klog.V(2).InfoS("ControllerExpandVolume: volume has no project quota", "volumeId", volID)
+		return &csi.ControllerExpandVolumeResponse{CapacityBytes: reqCapacity, NodeExpansionRequired: false}, nil
+	}
+
+	quota, err := getProjectQuota(ctx, cs.Driver.Runner, lustre.MountPoint, projectId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get quota of project %d: %v", projectId, err)
+	}
+	newLimitKB := bytesToKiB(reqCapacity)
+	if quota.BlockHardLimitKB != 0 && newLimitKB < quota.BlockHardLimitKB {
+		return nil, status.Errorf(codes.OutOfRange, "shrinking volume %s from %d KiB to %d KiB is not supported", volID, quota.BlockHardLimitKB, newLimitKB)
+	}
+	if newLimitKB != quota.BlockHardLimitKB {
+		if err := setProjectQuota(ctx, cs.Driver.Runner, lustre.MountPoint, projectId, newLimitKB, quota.InodeHardLimit); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to set quota of project %d: %v", projectId, err)
+		}
+	}
+	klog.V(2).InfoS("ControllerExpandVolume: volume expanded", "volumeId", volID, "projectId", projectId, "capacityBytes", reqCapacity)
+
+	return &csi.ControllerExpandVolumeResponse{CapacityBytes: reqCapacity, NodeExpansionRequired: false}, nil
 }
 
+// ControllerGetVolume 返回卷的容量、参数和健康状况，external-health-monitor 据此对子目录被带外删除、
+// 配额超限或文件系统不可达的 PVC 产生事件
 func (cs *ControllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	return nil, nil
+	volID := req.GetVolumeId()
+	klog.V(5).InfoS("ControllerGetVolume: called", "volumeId", volID)
+
+	if len(volID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
+	}
+	lustre, err := getLustreVolFromID(volID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found: %v", volID, err)
+	}
+
+	// 驱动没有实现 ControllerPublishVolume，无从得知卷被哪些节点使用，因此不返回 PublishedNodeIds
+	volume := &csi.Volume{VolumeId: volID}
+	resp := &csi.ControllerGetVolumeResponse{
+		Volume: volume,
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{},
+	}
+	if err := cs.mountLustreVol(ctx, lustre); err != nil {
+		resp.Status.VolumeCondition = &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("failed to mount lustre filesystem %s: %v", lustre.ServerName, err),
+		}
+		return resp, nil
+	}
+	if err := statfsWithTimeout(ctx, lustre.MountPoint, volumeConditionTimeout); err != nil {
+		resp.Status.VolumeCondition = &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("lustre filesystem %s is unreachable: %v", lustre.ServerName, err),
+		}
+		return resp, nil
+	}
+
+	if lustre.UUID != "" {
+		meta, err := readVolumeMetadata(lustre.MountPoint, lustre.UUID)
+		if err != nil {
+			klog.Warningf("failed to read metadata of volume %s: %v", volID, err)
+		}
+		if meta != nil {
+			volume.CapacityBytes = meta.CapacityBytes
+			volume.VolumeContext = meta.VolumeContext
+		}
+	}
+	condition, quota := cs.getVolumeCondition(ctx, lustre)
+	if quota != nil && quota.BlockHardLimitKB > 0 {
+		// 配额可能在扩容或带外调整后变化，以实际的硬限制为准
+		volume.CapacityBytes = int64(quota.BlockHardLimitKB) * 1024
+	}
+	resp.Status.VolumeCondition = condition
+	return resp, nil
 }
 
+// ControllerModifyVolume 按 VolumeAttributesClass 修改已有卷的配额、新文件的条带布局、子目录属主和权限以及删除策略。
+// 删除策略编码在卷 ID 中无法修改，因此记录在卷元数据中，DeleteVolume 时优先使用
 func (cs *ControllerServer) ControllerModifyVolume(ctx context.Context, req *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
-	return nil, nil
+	volID := req.GetVolumeId()
+	klog.V(5).InfoS("ControllerModifyVolume: called", "volumeId", volID, "mutableParameters", req.GetMutableParameters())
+
+	if len(volID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
+	}
+	params := req.GetMutableParameters()
+	modification, err := parseVolumeModification(params)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	release, err := cs.Driver.lockVolume(ctx, volID, "ControllerModifyVolume", LockExclusive)
+	if err != nil {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt+": %v", volID, err)
+	}
+	defer release()
+
+	lustre, err := getLustreVolFromID(volID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found: %v", volID, err)
+	}
+	if modification.onDelete != nil && lustre.UUID == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "%s can not be modified on volume %s created by an earlier version", paramOnDelete, volID)
+	}
+
+	if err := cs.mountLustreVol(ctx, lustre); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to mount lustre: %v", err)
+	}
+	internalVolumePath := getInternalMountPath(lustre)
+	if _, err := os.Stat(internalVolumePath); err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "subdirectory %s of volume %s not found", lustre.SubDir, volID)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to stat subdirectory %s: %v", internalVolumePath, err)
+	}
+
+	var projectId uint32
+	if modification.inodeLimit != nil {
+		if projectId, err = getDirProjectId(ctx, cs.Driver.Runner, internalVolumePath); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to get project id of %s: %v", internalVolumePath, err)
+		}
+		if projectId == 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "%s can only be modified on volumes with project quota", paramInodeLimit)
+		}
+	}
+	if err := modification.apply(ctx, cs.Driver.Runner, lustre, projectId); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to modify volume %s: %v", volID, err)
+	}
+
+	if lustre.UUID != "" {
+		meta, err := readVolumeMetadata(lustre.MountPoint, lustre.UUID)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to read volume metadata: %v", err)
+		}
+		if meta == nil {
+			// 早于卷元数据的卷，补写一份以便记录修改
+			meta = &volumeMetadata{VolumeID: volID, Name: lustre.UUID, CreatedAt: time.Now().UTC()}
+		}
+		if meta.VolumeContext == nil {
+			meta.VolumeContext = map[string]string{}
+		}
+		modification.updateVolumeContext(meta.VolumeContext, params)
+		if modification.onDelete != nil {
+			meta.OnDelete = *modification.onDelete
+		}
+		if err := writeVolumeMetadata(lustre.MountPoint, meta); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to write volume metadata: %v", err)
+		}
+	}
+	klog.V(2).InfoS("ControllerModifyVolume: volume modified", "volumeId", volID, "mutableParameters", params)
+
+	return &csi.ControllerModifyVolumeResponse{}, nil
 }
 
 func isValidVolumeCapabilities(caps []*csi.VolumeCapability) error {
@@ -232,17 +1025,6 @@ func isValidVolumeCapabilities(caps []*csi.VolumeCapability) error {
 	return nil
 }
 
-func getVolumeIDFromLustreVol(vol *Lustre) string {
-	idElements := make([]string, totalIDElements)
-	idElements[idServer] = strings.Trim(vol.ServerName, "/")
-	idElements[idSubDir] = strings.Trim(vol.SubDir, "/")
-	if strings.EqualFold(vol.OnDelete, retain) || strings.EqualFold(vol.OnDelete, archive) {
-		idElements[idOnDelete] = vol.OnDelete
-	}
-
-	return strings.Join(idElements, separator)
-}
-
 func (cs *ControllerServer) internalMount(ctx context.Context, l *Lustre) error {
 	if l.FSId == "" {
 		return status.Error(codes.InvalidArgument, fmt.Sprintf("fsid: %v is a required parameter", l.FSId))
@@ -253,20 +1035,23 @@ func (cs *ControllerServer) internalMount(ctx context.Context, l *Lustre) error
 	if l.MountPoint == "" {
 		return status.Error(codes.InvalidArgument, fmt.Sprintf("mountpoint: %v is a required parameter", l.MountPoint))
 	}
+	if err := os.MkdirAll(l.MountPoint, 0750); err != nil {
+		return err
+	}
 	// Check if the target is already a mount point
 	isMountPoint, err := l.Mount.IsLikelyNotMountPoint(l.MountPoint)
 	if err != nil {
 		return err
 	}
 	if !isMountPoint {
-		return nil
+		// 删除卷会在挂载点下删除子目录，挂载点上已有的挂载必须是卷所在的文件系统
+		return cs.verifyMountSource(l)
 	}
-	mountOptions := []string{}
-
-	mountOptions = append(mountOptions, "rw")
+	// controller 需要创建和删除子目录，始终以读写方式挂载
+	mountOptions := append([]string{mountOptionReadWrite}, clientMountOptions(l.MountOptions)...)
 
 	// Perform the mount operation
-	klog.V(5).InfoS("Mounting volume", "volumeId", l.FSId, "target", l.MountPoint)
+	klog.V(5).InfoS("Mounting volume", "volumeId", l.FSId, "target", l.MountPoint, "options", mountOptions)
 	err = l.Mount.Mount(l.ServerName, l.MountPoint, "lustre", mountOptions)
 	if err != nil {
 		return status.Error(codes.Internal, fmt.Sprintf(" mount filed"))
@@ -274,6 +1059,118 @@ func (cs *ControllerServer) internalMount(ctx context.Context, l *Lustre) error
 	return nil
 }
 
+// verifyMountSource 检查挂载点上已有挂载的来源是否为卷所在的文件系统（fsname 和 fileset 相同）。
+// 同一个文件系统可以通过不同的 MGS NID 挂载，因此不比较 NID
+func (cs *ControllerServer) verifyMountSource(l *Lustre) error {
+	_, fsName, fileset, err := splitLustreServer(l.ServerName)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	mountPath := filepath.Clean(l.MountPoint)
+	if resolved, err := filepath.EvalSymlinks(mountPath); err == nil {
+		mountPath = resolved
+	}
+	mountPoints, err := l.Mount.List()
+	if err != nil {
+		return fmt.Errorf("failed to list mount points: %v", err)
+	}
+	// 同一路径上有多个挂载时最后一个可见
+	var current *mount.MountPoint
+	for i := range mountPoints {
+		if mountPoints[i].Path == mountPath || mountPoints[i].Path == l.MountPoint {
+			current = &mountPoints[i]
+		}
+	}
+	if current == nil {
+		return status.Errorf(codes.FailedPrecondition, "%s is a mount point but not found in the mount table, can not verify it is %s", l.MountPoint, l.ServerName)
+	}
+	_, mpFsName, mpFileset, err := splitLustreServer(current.Device)
+	if current.Type != paramFsType || err != nil || mpFsName != fsName || mpFileset != fileset {
+		return status.Errorf(codes.FailedPrecondition, "%s is already mounted from %s (%s), not %s", l.MountPoint, current.Device, current.Type, l.ServerName)
+	}
+	return nil
+}
+
+// mountLustreVol 将卷所在的文件系统挂载到 controller 的工作目录，卷 ID 中未记录 base_dir 时使用 working-mount-dir
+func (cs *ControllerServer) mountLustreVol(ctx context.Context, l *Lustre) error {
+	l.Mount = cs.Mount
+	if l.MountPoint == "" {
+		l.MountPoint = cs.getWorkingMountPath(l)
+	}
+	return cs.internalMount(ctx, l)
+}
+
+// getVolumeCondition 检查卷的子目录是否存在以及项目配额是否超限，并返回卷的项目配额（未启用时为 nil）。
+// 调用前文件系统需已挂载且可达；查询项目 ID 或配额失败不视为卷异常
+func (cs *ControllerServer) getVolumeCondition(ctx context.Context, l *Lustre) (*csi.VolumeCondition, *projectQuota) {
+	internalVolumePath := getInternalMountPath(l)
+	if _, err := os.Stat(internalVolumePath); err != nil {
+		if os.IsNotExist(err) {
+			return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("subdirectory %s does not exist", l.SubDir)}, nil
+		}
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("failed to stat subdirectory %s: %v", l.SubDir, err)}, nil
+	}
+
+	projectId, err := getDirProjectId(ctx, cs.Driver.Runner, internalVolumePath)
+	if err != nil {
+		klog.Warningf("failed to get project id of %s: %v", internalVolumePath, err)
+		return &csi.VolumeCondition{Message: "volume is healthy"}, nil
+	}
+	if projectId == 0 {
+		return &csi.VolumeCondition{Message: "volume is healthy"}, nil
+	}
+	quota, err := getProjectQuota(ctx, cs.Driver.Runner, l.MountPoint, projectId)
+	if err != nil {
+		klog.Warningf("failed to get quota of project %d: %v", projectId, err)
+		return &csi.VolumeCondition{Message: "volume is healthy"}, nil
+	}
+	if quota.BlockHardLimitKB > 0 && quota.BlocksUsedKB >= quota.BlockHardLimitKB {
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("block quota exceeded: %d KiB used, limit %d KiB", quota.BlocksUsedKB, quota.BlockHardLimitKB),
+		}, quota
+	}
+	if quota.InodeHardLimit > 0 && quota.InodesUsed >= quota.InodeHardLimit {
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("inode quota exceeded: %d inodes used, limit %d", quota.InodesUsed, quota.InodeHardLimit),
+		}, quota
+	}
+	return &csi.VolumeCondition{Message: "volume is healthy"}, quota
+}
+
+// statfsWithTimeout 在超时时间内对 path 执行 statfs。服务器不可达时 statfs 可能长时间阻塞，
+// 此时不再等待，阻塞的 goroutine 在服务器恢复或客户端被驱逐后自行退出
+func statfsWithTimeout(ctx context.Context, path string, timeout time.Duration) error {
+	errCh := make(chan error, 1)
+	go func() {
+		var st unix.Statfs_t
+		errCh <- unix.Statfs(path, &st)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-errCh:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("statfs %s timed out after %v", path, timeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func getInternalMountPath(l *Lustre) string {
 	return fmt.Sprintf("%s/%s", l.MountPoint, l.SubDir)
 }
+
+// getArchivedMountPath 返回归档后的子目录路径，与原子目录位于同一父目录下
+func getArchivedMountPath(l *Lustre) string {
+	subDir := strings.Trim(l.SubDir, "/")
+	return filepath.Join(l.MountPoint, filepath.Dir(subDir), "archived-"+filepath.Base(subDir))
+}
+
+// getWorkingMountPath 返回 controller 挂载该文件系统时使用的工作目录，
+// 例如 172.16.100.189@tcp:/testfs 对应 <working-mount-dir>/testfs-<server 哈希>
+func (cs *ControllerServer) getWorkingMountPath(l *Lustre) string {
+	return filepath.Join(cs.Driver.WorkingMountDir, getServerMountName(l.ServerName))
+}
@@ -2,24 +2,53 @@ package lustre
 
 import (
 	"context"
+	"fmt"
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/mount-utils"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"syscall"
 	"testing"
 )
 
-func initTestController(_ *testing.T) *ControllerServer {
+const testServer = "172.16.100.189@tcp:/testfs"
+
+func initTestController(t *testing.T) *ControllerServer {
 	controller := &ControllerServer{
-		Driver: new(Driver),
+		Driver: NewDriver(&DriverOptions{
+			DriverName:      DefaultDriverName,
+			WorkingMountDir: t.TempDir(),
+		}),
+		Mount: mount.NewFakeMounter([]mount.MountPoint{}),
 	}
+	controller.Driver.Runner = newFakeCommandRunner()
 	return controller
 }
 
 func TestCreateVolume(t *testing.T) {
+	baseDir := t.TempDir()
+	volumeCaps := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
 
 	testCases := []struct {
-		name string
-		req  *csi.CreateVolumeRequest
-		resp *csi.CreateVolumeResponse
+		name        string
+		req         *csi.CreateVolumeRequest
+		resp        *csi.CreateVolumeResponse
+		expectedErr error
+		// outputs 为假 CommandRunner 按命令返回的输出
+		outputs map[string]string
 	}{
 		{
 			name: "test",
@@ -37,11 +66,149 @@ func TestCreateVolume(t *testing.T) {
 				},
 				Parameters: map[string]string{
 					paramFsType:  "lustre",
-					paramServer:  "172.16.100.189@tcp:/testfs",
-					paramBaseDir: "/mnt/testfs",
+					paramServer:  testServer,
+					paramBaseDir: baseDir,
+				},
+			},
+			resp: &csi.CreateVolumeResponse{
+				Volume: &csi.Volume{
+					VolumeId:      getVolumeIDFromLustreVol(&Lustre{ServerName: testServer, MountPoint: baseDir, SubDir: "a1", UUID: "a1"}),
+					CapacityBytes: DefaultVolumeSize,
+					VolumeContext: map[string]string{
+						paramFsType:  "lustre",
+						paramServer:  testServer,
+						paramBaseDir: baseDir,
+						paramSubDir:  "a1",
+					},
+				},
+			},
+		},
+		{
+			name: "explicit project id",
+			req: &csi.CreateVolumeRequest{
+				Name:               "a2",
+				VolumeCapabilities: volumeCaps,
+				CapacityRange:      &csi.CapacityRange{RequiredBytes: 1 << 30},
+				Parameters: map[string]string{
+					paramServer:  testServer,
+					paramBaseDir: baseDir,
+					paramDIRPid:  "1000",
+				},
+			},
+			outputs: map[string]string{"lfs quota -q -p 1000 " + baseDir: baseDir + " 0 0 0 - 0 0 0 -"},
+			resp: &csi.CreateVolumeResponse{
+				Volume: &csi.Volume{
+					VolumeId:      getVolumeIDFromLustreVol(&Lustre{ServerName: testServer, MountPoint: baseDir, SubDir: "a2", UUID: "a2"}),
+					CapacityBytes: 1 << 30,
+					VolumeContext: map[string]string{
+						paramServer:  testServer,
+						paramBaseDir: baseDir,
+						paramSubDir:  "a2",
+						paramDIRPid:  "1000",
+					},
+				},
+			},
+		},
+		{
+			name: "explicit project id in automatic range",
+			req: &csi.CreateVolumeRequest{
+				Name:               "a2",
+				VolumeCapabilities: volumeCaps,
+				Parameters: map[string]string{
+					paramServer:  testServer,
+					paramBaseDir: baseDir,
+					paramDIRPid:  "123456",
+				},
+			},
+			expectedErr: status.Error(codes.InvalidArgument, `projectId 123456 is reserved for automatically allocated project IDs, must be below 100000 or above 16877215`),
+		},
+		{
+			name: "stripe layout",
+			req: &csi.CreateVolumeRequest{
+				Name:               "a6",
+				VolumeCapabilities: volumeCaps,
+				Parameters: map[string]string{
+					paramServer:      testServer,
+					paramBaseDir:     baseDir,
+					paramStripeCount: "8",
+					paramStripeSize:  "4m",
+				},
+			},
+			resp: &csi.CreateVolumeResponse{
+				Volume: &csi.Volume{
+					VolumeId:      getVolumeIDFromLustreVol(&Lustre{ServerName: testServer, MountPoint: baseDir, SubDir: "a6", UUID: "a6"}),
+					CapacityBytes: DefaultVolumeSize,
+					VolumeContext: map[string]string{
+						paramServer:      testServer,
+						paramBaseDir:     baseDir,
+						paramSubDir:      "a6",
+						paramStripeCount: "8",
+						paramStripeSize:  "4194304",
+					},
 				},
 			},
 		},
+		{
+			name: "invalid stripe count",
+			req: &csi.CreateVolumeRequest{
+				Name:               "a7",
+				VolumeCapabilities: volumeCaps,
+				Parameters: map[string]string{
+					paramServer:      testServer,
+					paramBaseDir:     baseDir,
+					paramStripeCount: "many",
+				},
+			},
+			expectedErr: status.Error(codes.InvalidArgument, `invalid stripeCount "many", must be -1 (all OSTs) or between 0 and 2000`),
+		},
+		{
+			name: "invalid project id",
+			req: &csi.CreateVolumeRequest{
+				Name:               "a3",
+				VolumeCapabilities: volumeCaps,
+				Parameters: map[string]string{
+					paramServer:  testServer,
+					paramBaseDir: baseDir,
+					paramDIRPid:  "-1",
+				},
+			},
+			expectedErr: status.Error(codes.InvalidArgument, `invalid projectId "-1", must be "auto" or a positive 32-bit integer`),
+		},
+		{
+			name: "unsupported mount option",
+			req: &csi.CreateVolumeRequest{
+				Name: "a5",
+				VolumeCapabilities: []*csi.VolumeCapability{
+					{
+						AccessType: &csi.VolumeCapability_Mount{
+							Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"flock", "vers=4"}},
+						},
+						AccessMode: &csi.VolumeCapability_AccessMode{
+							Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+						},
+					},
+				},
+				Parameters: map[string]string{
+					paramServer:  testServer,
+					paramBaseDir: baseDir,
+				},
+			},
+			expectedErr: status.Error(codes.InvalidArgument, `mount option "vers=4" is not supported`),
+		},
+		{
+			name: "invalid inode limit",
+			req: &csi.CreateVolumeRequest{
+				Name:               "a4",
+				VolumeCapabilities: volumeCaps,
+				Parameters: map[string]string{
+					paramServer:     testServer,
+					paramBaseDir:    baseDir,
+					paramDIRPid:     autoProjectId,
+					paramInodeLimit: "many",
+				},
+			},
+			expectedErr: status.Error(codes.InvalidArgument, `invalid inodeLimit "many": strconv.ParseUint: parsing "many": invalid syntax`),
+		},
 	}
 
 	for _, test := range testCases {
@@ -49,10 +216,13 @@ func TestCreateVolume(t *testing.T) {
 		t.Run(test.name, func(t *testing.T) {
 			// Setup
 			cs := initTestController(t)
+			for cmd, out := range test.outputs {
+				cs.Driver.Runner.(*fakeCommandRunner).outputs[cmd] = out
+			}
 			resp, err := cs.CreateVolume(context.Background(), test.req)
 			// Verify
-			if err != nil {
-				t.Errorf("test %q failed: %v", test.name, err)
+			if !reflect.DeepEqual(err, test.expectedErr) {
+				t.Errorf("test %q failed: got err %v, expected %v", test.name, err, test.expectedErr)
 			}
 
 			if !reflect.DeepEqual(resp, test.resp) {
@@ -62,3 +232,953 @@ func TestCreateVolume(t *testing.T) {
 		})
 	}
 }
+
+func TestCreateVolumePermissions(t *testing.T) {
+	baseDir := t.TempDir()
+	volumeCaps := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+	}
+	uid, gid := strconv.Itoa(os.Getuid()), strconv.Itoa(os.Getgid())
+
+	testCases := []struct {
+		name             string
+		mountPermissions uint64
+		params           map[string]string
+		expectedMode     os.FileMode
+		expectedCode     codes.Code
+	}{
+		{name: "legacy default", expectedMode: 0777},
+		{name: "driver default", mountPermissions: 0750, expectedMode: 0750},
+		{name: "storage class overrides driver default", mountPermissions: 0750, params: map[string]string{paramMountPermissions: "2770"}, expectedMode: os.ModeSetgid | 0770},
+		{name: "owner", params: map[string]string{paramDIRUid: uid, paramDIRGid: gid}, expectedMode: 0777},
+		{name: "invalid mountPermissions", params: map[string]string{paramMountPermissions: "0999"}, expectedCode: codes.InvalidArgument},
+		{name: "invalid uid", params: map[string]string{paramDIRUid: "nobody"}, expectedCode: codes.InvalidArgument},
+		{name: "invalid gid", params: map[string]string{paramDIRGid: "-1"}, expectedCode: codes.InvalidArgument},
+	}
+
+	for i, tc := range testCases {
+		cs := initTestController(t)
+		cs.Driver.MountPermissions = tc.mountPermissions
+		name := "pvc-" + strconv.Itoa(i)
+		params := map[string]string{paramServer: testServer, paramBaseDir: baseDir}
+		for k, v := range tc.params {
+			params[k] = v
+		}
+		_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:               name,
+			VolumeCapabilities: volumeCaps,
+			Parameters:         params,
+		})
+		if status.Code(err) != tc.expectedCode {
+			t.Errorf("%s: got err %v, expected code %v", tc.name, err, tc.expectedCode)
+			continue
+		}
+		if tc.expectedCode != codes.OK {
+			continue
+		}
+		st, err := os.Stat(filepath.Join(baseDir, name))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		// MkdirAll 受 umask 影响，显式设置后权限与参数一致
+		if st.Mode().Perm()|st.Mode()&os.ModeSetgid != tc.expectedMode {
+			t.Errorf("%s: got mode %v, expected %v", tc.name, st.Mode(), tc.expectedMode)
+		}
+	}
+}
+
+func TestCreateVolumeMetadataTemplate(t *testing.T) {
+	baseDir := t.TempDir()
+	volumeCaps := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+	}
+	metadata := map[string]string{
+		pvcNameKey:      "data",
+		pvcNamespaceKey: "team-a",
+		pvNameKey:       "pvc-1234",
+	}
+
+	testCases := []struct {
+		name           string
+		params         map[string]string
+		metadata       map[string]string
+		expectedSubDir string
+		// expectedBaseDir 缺省为 baseDir
+		expectedBaseDir string
+		expectedCode    codes.Code
+	}{
+		{
+			name:           "namespace and pvc name",
+			params:         map[string]string{paramSubDir: "${pvc.metadata.namespace}/${pvc.metadata.name}"},
+			metadata:       metadata,
+			expectedSubDir: "team-a/data",
+		},
+		{
+			name:           "pv name",
+			params:         map[string]string{paramSubDir: "volumes/${pv.metadata.name}"},
+			metadata:       metadata,
+			expectedSubDir: "volumes/pvc-1234",
+		},
+		{
+			name:            "placeholder in base dir",
+			params:          map[string]string{paramBaseDir: filepath.Join(baseDir, "${pvc.metadata.namespace}"), paramSubDir: "${pvc.metadata.name}"},
+			metadata:        metadata,
+			expectedSubDir:  "data",
+			expectedBaseDir: filepath.Join(baseDir, "team-a"),
+		},
+		{
+			name:         "crafted namespace in base dir",
+			params:       map[string]string{paramBaseDir: filepath.Join(baseDir, "${pvc.metadata.namespace}")},
+			metadata:     map[string]string{pvcNameKey: "data", pvcNamespaceKey: "../../etc"},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name:         "relative base dir from placeholder",
+			params:       map[string]string{paramBaseDir: "${pvc.metadata.namespace}"},
+			metadata:     metadata,
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name:         "unresolved placeholder in base dir",
+			params:       map[string]string{paramBaseDir: filepath.Join(baseDir, "${pvc.metadata.namespace}")},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name:         "metadata not provided",
+			params:       map[string]string{paramSubDir: "${pvc.metadata.namespace}/${pvc.metadata.name}"},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name:         "crafted pvc name",
+			params:       map[string]string{paramSubDir: "${pvc.metadata.namespace}/${pvc.metadata.name}"},
+			metadata:     map[string]string{pvcNameKey: "..", pvcNamespaceKey: "team-a"},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name:         "crafted namespace",
+			params:       map[string]string{paramSubDir: "${pvc.metadata.namespace}/${pvc.metadata.name}"},
+			metadata:     map[string]string{pvcNameKey: "data", pvcNamespaceKey: "../../etc"},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name:         "reserved subdir",
+			params:       map[string]string{paramSubDir: ".snapshots/${pvc.metadata.name}"},
+			metadata:     metadata,
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name:         "traversal in template",
+			params:       map[string]string{paramSubDir: "${pvc.metadata.namespace}/../../escape"},
+			metadata:     metadata,
+			expectedCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			cs := initTestController(t)
+			params := map[string]string{paramServer: testServer, paramBaseDir: baseDir}
+			for k, v := range test.params {
+				params[k] = v
+			}
+			for k, v := range test.metadata {
+				params[k] = v
+			}
+			resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				VolumeCapabilities: volumeCaps,
+				Parameters:         params,
+			})
+			if status.Code(err) != test.expectedCode {
+				t.Fatalf("got err %v, expected code %v", err, test.expectedCode)
+			}
+			if err != nil {
+				return
+			}
+			expectedBaseDir := test.expectedBaseDir
+			if expectedBaseDir == "" {
+				expectedBaseDir = baseDir
+			}
+			volumeContext := resp.GetVolume().GetVolumeContext()
+			if volumeContext[paramSubDir] != test.expectedSubDir || volumeContext[paramBaseDir] != expectedBaseDir {
+				t.Errorf("unexpected volume context %v", volumeContext)
+			}
+			for _, key := range []string{pvcNameKey, pvcNamespaceKey, pvNameKey} {
+				if _, ok := volumeContext[key]; ok {
+					t.Errorf("metadata %s leaked into volume context", key)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(expectedBaseDir, test.expectedSubDir)); err != nil {
+				t.Errorf("subdirectory not created: %v", err)
+			}
+			vol, err := getLustreVolFromID(resp.GetVolume().GetVolumeId())
+			if err != nil || vol.SubDir != test.expectedSubDir || vol.MountPoint != expectedBaseDir {
+				t.Errorf("unexpected volume %+v, %v", vol, err)
+			}
+		})
+	}
+}
+
+func TestDeleteVolume(t *testing.T) {
+	testCases := []struct {
+		name         string
+		onDelete     string
+		defaultOnDel string
+		volumeID     string
+		expectedErr  error
+		projectId    uint32
+		expectExists bool
+		expectArchiv bool
+		expectClear  bool
+	}{
+		{
+			name:        "volume id missing",
+			volumeID:    "",
+			expectedErr: status.Error(codes.InvalidArgument, "Volume ID not provided"),
+		},
+		{
+			name:     "invalid volume id is treated as deleted",
+			volumeID: "invalid-id",
+		},
+		{
+			name:     "delete subdirectory",
+			onDelete: deletes,
+		},
+		{
+			name:         "delete subdirectory with default policy",
+			defaultOnDel: deletes,
+		},
+		{
+			name:         "retain subdirectory",
+			onDelete:     retain,
+			expectExists: true,
+		},
+		{
+			name:         "retain subdirectory with default policy",
+			defaultOnDel: retain,
+			expectExists: true,
+		},
+		{
+			name:         "archive subdirectory",
+			onDelete:     archive,
+			expectArchiv: true,
+		},
+		{
+			name:        "delete clears project quota",
+			onDelete:    deletes,
+			projectId:   123456,
+			expectClear: true,
+		},
+		{
+			name:         "archive clears project quota",
+			onDelete:     archive,
+			projectId:    123456,
+			expectArchiv: true,
+			expectClear:  true,
+		},
+		{
+			name:         "retain keeps project quota",
+			onDelete:     retain,
+			projectId:    123456,
+			expectExists: true,
+		},
+		{
+			name:      "explicit project id may be shared",
+			onDelete:  deletes,
+			projectId: 1000,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			cs := initTestController(t)
+			cs.Driver.DefaultOnDeletePolicy = test.defaultOnDel
+
+			vol := &Lustre{ServerName: testServer, SubDir: "pvc-1", OnDelete: test.onDelete}
+			vol.MountPoint = cs.getWorkingMountPath(vol)
+			if err := os.MkdirAll(filepath.Join(getInternalMountPath(vol), "data"), 0750); err != nil {
+				t.Fatalf("failed to prepare subdirectory: %v", err)
+			}
+			runner := cs.Driver.Runner.(*fakeCommandRunner)
+			if test.projectId != 0 {
+				runner.outputs["lfs project -d "+getInternalMountPath(vol)] = fmt.Sprintf("  %d P %s", test.projectId, getInternalMountPath(vol))
+			}
+
+			volID := test.volumeID
+			if volID == "" && test.expectedErr == nil {
+				volID = getVolumeIDFromLustreVol(vol)
+			}
+			_, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volID})
+			if !reflect.DeepEqual(err, test.expectedErr) {
+				t.Fatalf("test %q failed: got err %v, expected %v", test.name, err, test.expectedErr)
+			}
+			if test.expectedErr != nil || test.volumeID != "" {
+				return
+			}
+
+			if _, err := os.Stat(getInternalMountPath(vol)); (err == nil) != test.expectExists {
+				t.Errorf("test %q failed: subdirectory exists %v, expected %v", test.name, err == nil, test.expectExists)
+			}
+			if _, err := os.Stat(filepath.Join(getArchivedMountPath(vol), "data")); (err == nil) != test.expectArchiv {
+				t.Errorf("test %q failed: archived subdirectory exists %v, expected %v", test.name, err == nil, test.expectArchiv)
+			}
+			clearCall := fmt.Sprintf("lfs setquota -p %d -B 0 -I 0 %s", test.projectId, vol.MountPoint)
+			if cleared := containsCall(runner.Calls(), clearCall); cleared != test.expectClear {
+				t.Errorf("test %q failed: quota cleared %v, expected %v: %v", test.name, cleared, test.expectClear, runner.Calls())
+			}
+		})
+	}
+}
+
+func TestDeleteVolumeMountSource(t *testing.T) {
+	testCases := []struct {
+		name         string
+		device       string
+		fsType       string
+		expectedCode codes.Code
+	}{
+		{name: "same filesystem", device: testServer, fsType: paramFsType},
+		{name: "same filesystem through another nid", device: "172.16.100.190@tcp:/testfs/", fsType: paramFsType},
+		{name: "other filesystem", device: "172.16.100.189@tcp:/otherfs", fsType: paramFsType, expectedCode: codes.Internal},
+		{name: "fileset of the filesystem", device: testServer + "/fileset", fsType: paramFsType, expectedCode: codes.Internal},
+		{name: "not lustre", device: "/dev/sdb1", fsType: "ext4", expectedCode: codes.Internal},
+	}
+	for _, test := range testCases {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			cs := initTestController(t)
+			vol := &Lustre{ServerName: testServer, SubDir: "pvc-1", OnDelete: deletes}
+			vol.MountPoint = filepath.Join(t.TempDir(), "base")
+			if err := os.MkdirAll(getInternalMountPath(vol), 0750); err != nil {
+				t.Fatalf("failed to prepare subdirectory: %v", err)
+			}
+			mounter := cs.Mount.(*mount.FakeMounter)
+			mounter.MountPoints = []mount.MountPoint{{Device: test.device, Path: vol.MountPoint, Type: test.fsType}}
+
+			_, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: getVolumeIDFromLustreVol(vol)})
+			if status.Code(err) != test.expectedCode {
+				t.Fatalf("got err %v, expected code %v", err, test.expectedCode)
+			}
+			if _, err := os.Stat(getInternalMountPath(vol)); (err == nil) != (test.expectedCode != codes.OK) {
+				t.Errorf("subdirectory exists %v after DeleteVolume with code %v", err == nil, test.expectedCode)
+			}
+		})
+	}
+}
+
+func TestDeleteVolumeRetryKeepsModifiedPolicy(t *testing.T) {
+	cs := initTestController(t)
+	// 卷 ID 中为 delete，ControllerModifyVolume 修改为 archive
+	vol := &Lustre{ServerName: testServer, SubDir: "pvc-1", UUID: "pvc-1", OnDelete: deletes}
+	vol.MountPoint = cs.getWorkingMountPath(vol)
+	volID := getVolumeIDFromLustreVol(vol)
+	if err := os.MkdirAll(filepath.Join(getInternalMountPath(vol), "data"), 0750); err != nil {
+		t.Fatalf("failed to prepare subdirectory: %v", err)
+	}
+	if err := writeVolumeMetadata(vol.MountPoint, &volumeMetadata{VolumeID: volID, Name: vol.UUID, OnDelete: archive}); err != nil {
+		t.Fatalf("failed to write volume metadata: %v", err)
+	}
+	runner := cs.Driver.Runner.(*fakeCommandRunner)
+	runner.outputs["lfs project -d "+getInternalMountPath(vol)] = "  123456 P " + getInternalMountPath(vol)
+	clearCall := "lfs setquota -p 123456 -B 0 -I 0 " + vol.MountPoint
+	runner.errs[clearCall] = fmt.Errorf("setquota failed")
+
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volID}); status.Code(err) != codes.Internal {
+		t.Fatalf("expected Internal error when archiving fails, got %v", err)
+	}
+	if meta, err := readVolumeMetadata(vol.MountPoint, vol.UUID); err != nil || meta == nil {
+		t.Fatalf("volume metadata should be kept after a failed delete, got %v, %v", meta, err)
+	}
+
+	delete(runner.errs, clearCall)
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volID}); err != nil {
+		t.Fatalf("retry of DeleteVolume failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(getArchivedMountPath(vol), "data")); err != nil {
+		t.Errorf("subdirectory should be archived on retry: %v", err)
+	}
+	if meta, err := readVolumeMetadata(vol.MountPoint, vol.UUID); err != nil || meta != nil {
+		t.Errorf("volume metadata should be removed after archiving, got %v, %v", meta, err)
+	}
+}
+
+func TestControllerExpandVolume(t *testing.T) {
+	testCases := []struct {
+		name          string
+		projectOutput string
+		quotaOutput   string
+		skipSubDir    bool
+		volumeID      string
+		capacity      *csi.CapacityRange
+		expectedCode  codes.Code
+		expectedCalls int
+		expectedQuota string
+		// expectedSize 为期望返回的容量，缺省为 RequiredBytes
+		expectedSize int64
+	}{
+		{
+			name:         "volume id missing",
+			volumeID:     "-",
+			capacity:     &csi.CapacityRange{RequiredBytes: 1 << 30},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name:         "capacity range missing",
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name:         "malformed volume id",
+			volumeID:     "v1#bad",
+			capacity:     &csi.CapacityRange{RequiredBytes: 1 << 30},
+			expectedCode: codes.NotFound,
+		},
+		{
+			name:         "garbage volume id",
+			volumeID:     "not-a-volume-id",
+			capacity:     &csi.CapacityRange{RequiredBytes: 1 << 30},
+			expectedCode: codes.NotFound,
+		},
+		{
+			name:         "empty capacity range",
+			capacity:     &csi.CapacityRange{},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name:         "subdirectory missing",
+			skipSubDir:   true,
+			capacity:     &csi.CapacityRange{RequiredBytes: 1 << 30},
+			expectedCode: codes.NotFound,
+		},
+		{
+			name:          "volume without project quota",
+			projectOutput: "       0 - dir",
+			capacity:      &csi.CapacityRange{RequiredBytes: 1 << 30},
+			expectedCalls: 1,
+		},
+		{
+			name:          "expand project quota",
+			projectOutput: "    1000 P dir",
+			quotaOutput:   "/mnt 4 0 1048576 - 1 0 500 -",
+			capacity:      &csi.CapacityRange{RequiredBytes: 2 << 30},
+			expectedCalls: 3,
+			expectedQuota: "-B 2097152 -I 500",
+		},
+		{
+			name:          "same size is a no-op",
+			projectOutput: "    1000 P dir",
+			quotaOutput:   "/mnt 4 0 1048576 - 1 0 500 -",
+			capacity:      &csi.CapacityRange{RequiredBytes: 1 << 30},
+			expectedCalls: 2,
+		},
+		{
+			name:          "limit bytes only",
+			projectOutput: "    1000 P dir",
+			quotaOutput:   "/mnt 4 0 1048576 - 1 0 500 -",
+			capacity:      &csi.CapacityRange{LimitBytes: 2 << 30},
+			expectedCalls: 3,
+			expectedQuota: "-B 2097152 -I 500",
+			expectedSize:  2 << 30,
+		},
+		{
+			name:          "shrink is rejected",
+			projectOutput: "    1000 P dir",
+			quotaOutput:   "/mnt 4 0 1048576 - 1 0 500 -",
+			capacity:      &csi.CapacityRange{RequiredBytes: 1 << 20},
+			expectedCode:  codes.OutOfRange,
+			expectedCalls: 2,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			cs := initTestController(t)
+			runner := cs.Driver.Runner.(*fakeCommandRunner)
+
+			vol := &Lustre{ServerName: testServer, SubDir: "pvc-1"}
+			vol.MountPoint = cs.getWorkingMountPath(vol)
+			if !test.skipSubDir {
+				if err := os.MkdirAll(getInternalMountPath(vol), 0750); err != nil {
+					t.Fatalf("failed to prepare subdirectory: %v", err)
+				}
+			}
+			runner.outputs["lfs project -d "+getInternalMountPath(vol)] = test.projectOutput
+			runner.outputs["lfs quota -q -p 1000 "+vol.MountPoint] = test.quotaOutput
+
+			volID := test.volumeID
+			switch volID {
+			case "":
+				volID = getVolumeIDFromLustreVol(vol)
+			case "-":
+				volID = ""
+			}
+			resp, err := cs.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+				VolumeId:      volID,
+				CapacityRange: test.capacity,
+			})
+			if status.Code(err) != test.expectedCode {
+				t.Fatalf("test %q failed: got err %v, expected code %v", test.name, err, test.expectedCode)
+			}
+			if len(runner.Calls()) != test.expectedCalls {
+				t.Errorf("test %q failed: got calls %v, expected %d calls", test.name, runner.Calls(), test.expectedCalls)
+			}
+			if test.expectedQuota != "" {
+				expected := "lfs setquota -p 1000 " + test.expectedQuota + " " + vol.MountPoint
+				if last := runner.Calls()[len(runner.Calls())-1]; last != expected {
+					t.Errorf("test %q failed: got last call %q, expected %q", test.name, last, expected)
+				}
+			}
+			expectedSize := test.expectedSize
+			if expectedSize == 0 {
+				expectedSize = test.capacity.GetRequiredBytes()
+			}
+			if err == nil && (resp.CapacityBytes != expectedSize || resp.NodeExpansionRequired) {
+				t.Errorf("test %q failed: unexpected response %+v", test.name, resp)
+			}
+		})
+	}
+}
+
+func TestControllerGetVolume(t *testing.T) {
+	testCases := []struct {
+		name             string
+		projectOutput    string
+		quotaOutput      string
+		skipSubDir       bool
+		volumeID         string
+		expectedCode     codes.Code
+		expectedAbnormal bool
+		expectedCapacity int64
+	}{
+		{
+			name:         "volume id missing",
+			volumeID:     "-",
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name:         "malformed volume id",
+			volumeID:     "v1#bad",
+			expectedCode: codes.NotFound,
+		},
+		{
+			name:             "subdirectory removed",
+			skipSubDir:       true,
+			expectedAbnormal: true,
+		},
+		{
+			name:          "volume without project quota",
+			projectOutput: "       0 - dir",
+		},
+		{
+			name:             "healthy volume with project quota",
+			projectOutput:    "    1000 P dir",
+			quotaOutput:      "/mnt 4 0 1048576 - 1 0 500 -",
+			expectedCapacity: 1 << 30,
+		},
+		{
+			name:             "block quota exceeded",
+			projectOutput:    "    1000 P dir",
+			quotaOutput:      "/mnt 1048576* 0 1048576 - 1 0 500 -",
+			expectedAbnormal: true,
+			expectedCapacity: 1 << 30,
+		},
+		{
+			name:             "inode quota exceeded",
+			projectOutput:    "    1000 P dir",
+			quotaOutput:      "/mnt 4 0 1048576 - 500* 0 500 -",
+			expectedAbnormal: true,
+			expectedCapacity: 1 << 30,
+		},
+		{
+			name:          "quota query failure is not abnormal",
+			projectOutput: "    1000 P dir",
+			quotaOutput:   "garbage",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			cs := initTestController(t)
+			runner := cs.Driver.Runner.(*fakeCommandRunner)
+
+			vol := &Lustre{ServerName: testServer, SubDir: "pvc-1"}
+			vol.MountPoint = cs.getWorkingMountPath(vol)
+			if !test.skipSubDir {
+				if err := os.MkdirAll(getInternalMountPath(vol), 0750); err != nil {
+					t.Fatalf("failed to prepare subdirectory: %v", err)
+				}
+			}
+			runner.outputs["lfs project -d "+getInternalMountPath(vol)] = test.projectOutput
+			runner.outputs["lfs quota -q -p 1000 "+vol.MountPoint] = test.quotaOutput
+
+			volID := test.volumeID
+			switch volID {
+			case "":
+				volID = getVolumeIDFromLustreVol(vol)
+			case "-":
+				volID = ""
+			}
+			resp, err := cs.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: volID})
+			if status.Code(err) != test.expectedCode {
+				t.Fatalf("test %q failed: got err %v, expected code %v", test.name, err, test.expectedCode)
+			}
+			if err != nil {
+				return
+			}
+			if resp.GetVolume().GetVolumeId() != volID || resp.GetVolume().GetCapacityBytes() != test.expectedCapacity {
+				t.Errorf("test %q failed: unexpected volume %+v", test.name, resp.GetVolume())
+			}
+			condition := resp.GetStatus().GetVolumeCondition()
+			if condition == nil || condition.Abnormal != test.expectedAbnormal {
+				t.Errorf("test %q failed: got condition %+v, expected abnormal %v", test.name, condition, test.expectedAbnormal)
+			}
+		})
+	}
+}
+
+func TestValidateVolumeCapabilities(t *testing.T) {
+	mountCap := func(mode csi.VolumeCapability_AccessMode_Mode, flags ...string) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: flags}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+		}
+	}
+	blockCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	vol := &Lustre{ServerName: testServer, SubDir: "pvc-1"}
+
+	testCases := []struct {
+		name          string
+		volumeID      string
+		caps          []*csi.VolumeCapability
+		expectedCode  codes.Code
+		expectConfirm bool
+	}{
+		{
+			name:         "volume id missing",
+			volumeID:     "-",
+			caps:         []*csi.VolumeCapability{mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name:         "capabilities missing",
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name:         "unknown volume",
+			volumeID:     getVolumeIDFromLustreVol(&Lustre{ServerName: testServer, SubDir: "missing"}),
+			caps:         []*csi.VolumeCapability{mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+			expectedCode: codes.NotFound,
+		},
+		{
+			name:         "garbage volume id",
+			volumeID:     "not-a-volume-id",
+			caps:         []*csi.VolumeCapability{mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+			expectedCode: codes.NotFound,
+		},
+		{
+			name:         "malformed versioned volume id",
+			volumeID:     "v1#" + testServer + "#only-three",
+			caps:         []*csi.VolumeCapability{mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+			expectedCode: codes.NotFound,
+		},
+		{
+			name:          "supported capabilities",
+			caps:          []*csi.VolumeCapability{mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER), mountCap(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, "flock")},
+			expectConfirm: true,
+		},
+		{
+			name:          "read only access modes",
+			caps:          []*csi.VolumeCapability{mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY), mountCap(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY)},
+			expectConfirm: true,
+		},
+		{
+			name: "block access type",
+			caps: []*csi.VolumeCapability{blockCap},
+		},
+		{
+			name: "unsupported access mode",
+			caps: []*csi.VolumeCapability{mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER)},
+		},
+		{
+			name: "unsupported mount flag",
+			caps: []*csi.VolumeCapability{mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "vers=4")},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			cs := initTestController(t)
+			vol := *vol
+			vol.MountPoint = cs.getWorkingMountPath(&vol)
+			if err := os.MkdirAll(getInternalMountPath(&vol), 0750); err != nil {
+				t.Fatalf("failed to prepare subdirectory: %v", err)
+			}
+
+			volID := test.volumeID
+			switch volID {
+			case "":
+				volID = getVolumeIDFromLustreVol(&vol)
+			case "-":
+				volID = ""
+			}
+			resp, err := cs.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId:           volID,
+				VolumeCapabilities: test.caps,
+			})
+			if status.Code(err) != test.expectedCode {
+				t.Fatalf("test %q failed: got err %v, expected code %v", test.name, err, test.expectedCode)
+			}
+			if err != nil {
+				return
+			}
+			if (resp.GetConfirmed() != nil) != test.expectConfirm {
+				t.Errorf("test %q failed: got confirmed %v, expected %v, message %q", test.name, resp.GetConfirmed(), test.expectConfirm, resp.GetMessage())
+			}
+			if !test.expectConfirm && resp.GetMessage() == "" {
+				t.Errorf("test %q failed: expected a message for unconfirmed capabilities", test.name)
+			}
+		})
+	}
+}
+
+func TestListVolumes(t *testing.T) {
+	cs := initTestController(t)
+	volumeCaps := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+	}
+
+	var volumeIDs []string
+	for _, name := range []string{"pvc-c", "pvc-a", "pvc-b"} {
+		resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:               name,
+			VolumeCapabilities: volumeCaps,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: 1 << 20},
+			Parameters:         map[string]string{paramServer: testServer},
+		})
+		if err != nil {
+			t.Fatalf("failed to create volume %s: %v", name, err)
+		}
+		volumeIDs = append(volumeIDs, resp.Volume.VolumeId)
+	}
+	// lctl 快照的只读挂载包含相同的卷元数据，不能重复列出
+	mounter := cs.Mount.(*mount.FakeMounter)
+	snapshotMount := filepath.Join(cs.Driver.WorkingMountDir, lctlSnapshotMountPrefix+"4a9f1c2e")
+	if err := os.Symlink(cs.getWorkingMountPath(&Lustre{ServerName: testServer}), snapshotMount); err != nil {
+		t.Fatalf("failed to prepare snapshot mount: %v", err)
+	}
+	mounter.MountPoints = append(mounter.MountPoints, mount.MountPoint{Device: "172.16.100.189@tcp:/4a9f1c2e", Path: snapshotMount, Type: paramFsType, Opts: []string{"ro"}})
+
+	var listed []string
+	token := ""
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatalf("too many pages")
+		}
+		resp, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 2, StartingToken: token})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(resp.Entries) > 2 {
+			t.Fatalf("got %d entries, expected at most 2", len(resp.Entries))
+		}
+		for _, entry := range resp.Entries {
+			if entry.Volume.CapacityBytes != 1<<20 || entry.Volume.VolumeContext[paramServer] != testServer {
+				t.Errorf("unexpected volume %+v", entry.Volume)
+			}
+			if condition := entry.GetStatus().GetVolumeCondition(); condition == nil || condition.Abnormal {
+				t.Errorf("unexpected volume condition %+v", condition)
+			}
+			listed = append(listed, entry.Volume.VolumeId)
+		}
+		if token = resp.NextToken; token == "" {
+			break
+		}
+	}
+	expected := []string{volumeIDs[1], volumeIDs[2], volumeIDs[0]}
+	if !reflect.DeepEqual(listed, expected) {
+		t.Errorf("got volumes %v, expected %v", listed, expected)
+	}
+
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volumeIDs[1]}); err != nil {
+		t.Fatalf("failed to delete volume: %v", err)
+	}
+	resp, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(resp.Entries) != 2 || resp.NextToken != "" {
+		t.Errorf("got %v, expected 2 entries without next token", resp)
+	}
+
+	// 无法访问的文件系统被跳过，不影响其他文件系统中的卷
+	unreachable := "10.0.0.2@tcp:/other"
+	mounter.MountPoints = append(mounter.MountPoints, mount.MountPoint{Device: unreachable, Path: filepath.Join(t.TempDir(), "missing"), Type: paramFsType})
+	if resp, err = cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{}); err != nil || len(resp.Entries) != 2 {
+		t.Errorf("got %v, %v, expected 2 entries with an unreachable filesystem", resp, err)
+	}
+
+	// controller 重启后挂载丢失，--servers 中的文件系统重新挂载后列出，挂载失败的文件系统被跳过
+	mounter.MountPoints = nil
+	if resp, err = cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{}); err != nil || len(resp.Entries) != 0 {
+		t.Errorf("got %v, %v, expected no entries without known servers", resp, err)
+	}
+	broken := "10.0.0.3@tcp:/broken"
+	mounter.MountCheckErrors = map[string]error{cs.getWorkingMountPath(&Lustre{ServerName: broken}): syscall.EIO}
+	cs.Driver.Servers = []string{broken, testServer + "/"}
+	if resp, err = cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{}); err != nil || len(resp.Entries) != 2 {
+		t.Errorf("got %v, %v, expected 2 entries after restart", resp, err)
+	}
+
+	if _, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{StartingToken: "bogus"}); status.Code(err) != codes.Aborted {
+		t.Errorf("got err %v, expected Aborted", err)
+	}
+	if _, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: -1}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got err %v, expected InvalidArgument", err)
+	}
+}
+
+func TestGetCapacity(t *testing.T) {
+	cs := initTestController(t)
+	runner := cs.Driver.Runner.(*fakeCommandRunner)
+	mountPath := cs.getWorkingMountPath(&Lustre{ServerName: testServer})
+	runner.outputs["lfs df --pool testfs.flash "+mountPath] = "testfs-OST0000_UUID 100 10 90 10% " + mountPath + "[OST:0]\n"
+
+	testCases := []struct {
+		name         string
+		params       map[string]string
+		caps         []*csi.VolumeCapability
+		expectedCode codes.Code
+		expected     int64
+	}{
+		{
+			name:         "server missing",
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name:         "invalid pool",
+			params:       map[string]string{paramServer: testServer, paramOstPool: "a b"},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name:     "ost pool",
+			params:   map[string]string{paramServer: testServer, paramOstPool: "flash"},
+			expected: 90 * 1024,
+		},
+		{
+			name:     "unsupported capabilities",
+			params:   map[string]string{paramServer: testServer},
+			caps:     []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}},
+			expected: 0,
+		},
+		{
+			name:     "statfs",
+			params:   map[string]string{paramServer: testServer},
+			expected: -1,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{
+				Parameters:         test.params,
+				VolumeCapabilities: test.caps,
+			})
+			if status.Code(err) != test.expectedCode {
+				t.Fatalf("got err %v, expected code %v", err, test.expectedCode)
+			}
+			if err != nil {
+				return
+			}
+			if test.expected >= 0 && resp.AvailableCapacity != test.expected {
+				t.Errorf("got capacity %d, expected %d", resp.AvailableCapacity, test.expected)
+			}
+			if test.expected < 0 && resp.AvailableCapacity <= 0 {
+				t.Errorf("got capacity %d, expected a positive value", resp.AvailableCapacity)
+			}
+		})
+	}
+}
+
+func TestControllerVolumeLocks(t *testing.T) {
+	cs := initTestController(t)
+	baseDir := t.TempDir()
+	newRequest := func(onDelete string) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name: "pvc-1",
+			VolumeCapabilities: []*csi.VolumeCapability{
+				{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+				},
+			},
+			Parameters: map[string]string{paramServer: testServer, paramBaseDir: baseDir, paramOnDelete: onDelete},
+		}
+	}
+
+	// 失败和成功之后锁都会释放，重试不会返回 Aborted
+	if _, err := cs.CreateVolume(context.Background(), newRequest("keep")); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("got err %v, expected InvalidArgument", err)
+	}
+	var volID string
+	for i := 0; i < 2; i++ {
+		resp, err := cs.CreateVolume(context.Background(), newRequest(deletes))
+		if err != nil {
+			t.Fatalf("create attempt %d: %v", i, err)
+		}
+		volID = resp.GetVolume().GetVolumeId()
+	}
+
+	release, _ := cs.Driver.VolumeLocks.TryLock("pvc-1", "test", LockExclusive)
+	if _, err := cs.CreateVolume(context.Background(), newRequest(deletes)); status.Code(err) != codes.Aborted {
+		t.Errorf("got err %v, expected Aborted", err)
+	}
+	release()
+
+	release, _ = cs.Driver.VolumeLocks.TryLock(volID, "test", LockExclusive)
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volID}); status.Code(err) != codes.Aborted {
+		t.Errorf("got err %v, expected Aborted", err)
+	}
+	if _, err := cs.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+		VolumeId:      volID,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 30},
+	}); status.Code(err) != codes.Aborted {
+		t.Errorf("got err %v, expected Aborted", err)
+	}
+	release()
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volID}); err != nil {
+		t.Errorf("DeleteVolume: %v", err)
+	}
+}
+
+func TestGetWorkingMountPath(t *testing.T) {
+	cs := initTestController(t)
+	path := func(server string) string {
+		return cs.getWorkingMountPath(&Lustre{ServerName: server})
+	}
+	if path("10.0.0.1@tcp:/scratch") == path("10.0.0.2@tcp:/scratch") {
+		t.Error("servers with different MGS NIDs share a working mount path")
+	}
+	if path("10.0.0.1@tcp:/testfs/a_b") == path("10.0.0.1@tcp:/testfs_a/b") {
+		t.Error("filesets with the same sanitised name share a working mount path")
+	}
+	if path(testServer) != path(testServer+"/") {
+		t.Error("trailing slash changes the working mount path")
+	}
+}
@@ -0,0 +1,231 @@
+package lustre
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// ephemeralContextKey 为 kubelet 在 CSI 内联卷的 volume context 中设置的标记
+	ephemeralContextKey = "csi.storage.k8s.io/ephemeral"
+	// paramEphemeralSize 为内联卷的容量（Kubernetes 数量格式，例如 10Gi），设置后通过项目配额限制临时目录的大小
+	paramEphemeralSize = "size"
+	// defaultEphemeralBaseDir 为未在内联卷属性中指定 subdir 时，临时目录在文件系统中的父目录
+	defaultEphemeralBaseDir = "csi-ephemeral"
+	// ephemeralStateDir 为节点状态目录下记录内联卷的子目录，每个卷一个 JSON 文件
+	ephemeralStateDir = "ephemeral"
+)
+
+// ephemeralVolume 为节点本地记录的内联卷，NodeUnpublishVolume 依据它删除驱动创建的临时目录，
+// 记录写在节点的状态目录中，插件重启后仍可完成清理
+type ephemeralVolume struct {
+	VolumeID     string   `json:"volumeId"`
+	Server       string   `json:"server"`
+	MountOptions []string `json:"mountOptions,omitempty"`
+	// SubDir 为临时目录相对于文件系统根目录的路径
+	SubDir     string    `json:"subDir"`
+	TargetPath string    `json:"targetPath"`
+	ProjectId  uint32    `json:"projectId,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+func (e *ephemeralVolume) lustre() *Lustre {
+	return &Lustre{
+		FSId:         e.VolumeID,
+		UUID:         e.VolumeID,
+		ServerName:   e.Server,
+		SubDir:       e.SubDir,
+		StorageType:  paramFsType,
+		MountOptions: e.MountOptions,
+	}
+}
+
+func isEphemeralVolume(volumeContext map[string]string) bool {
+	return strings.EqualFold(volumeContext[ephemeralContextKey], "true")
+}
+
+func (ns *NodeServer) getEphemeralStatePath(volumeID string) string {
+	return filepath.Join(ns.Driver.StateDir, ephemeralStateDir, strings.ReplaceAll(volumeID, "/", "_")+".json")
+}
+
+// readEphemeralVolume 读取内联卷的记录，卷不是由本节点创建的内联卷时返回 nil
+func (ns *NodeServer) readEphemeralVolume(volumeID string) (*ephemeralVolume, error) {
+	if ns.Driver.StateDir == "" {
+		return nil, nil
+	}
+	vol := &ephemeralVolume{}
+	found, err := readJSONFile(ns.getEphemeralStatePath(volumeID), vol)
+	if err != nil || !found {
+		return nil, err
+	}
+	return vol, nil
+}
+
+// publishEphemeralVolume 为内联卷在文件系统中创建每个 Pod 独立的临时目录，按需设置项目配额后绑定挂载到目标路径。
+// 先写记录再创建目录，中途失败或插件重启后 NodeUnpublishVolume 仍能清理已创建的目录
+func (ns *NodeServer) publishEphemeralVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	targetPath := req.GetTargetPath()
+	volumeContext := req.GetVolumeContext()
+
+	if ns.Driver.StateDir == "" {
+		return nil, status.Error(codes.FailedPrecondition, "ephemeral volumes require the node state dir to be configured")
+	}
+	server := volumeContext[paramServer]
+	if server == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "%s must be set in the attributes of ephemeral volume", paramServer)
+	}
+	baseDir := strings.Trim(volumeContext[paramSubDir], "/")
+	if baseDir == "" {
+		baseDir = strings.Trim(ns.Driver.EphemeralBaseDir, "/")
+	}
+	if err := validateSubDir(baseDir); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if strings.Contains(volumeID, "/") || volumeID == "." || volumeID == ".." {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid ephemeral volume id %q", volumeID)
+	}
+	var capacityBytes int64
+	if val, ok := volumeContext[paramEphemeralSize]; ok {
+		size, err := resource.ParseQuantity(val)
+		if err != nil || size.Sign() <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s %q, must be a positive quantity such as 10Gi", paramEphemeralSize, val)
+		}
+		capacityBytes = size.Value()
+	}
+	var inodeLimit uint64
+	if val, ok := volumeContext[paramInodeLimit]; ok {
+		var err error
+		if inodeLimit, err = strconv.ParseUint(val, 10, 64); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s %q: %v", paramInodeLimit, val, err)
+		}
+	}
+	mountOptions, err := getVolumeMountOptions(volumeContext, req.GetVolumeCapability().GetMount().GetMountFlags())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	dirMode, err := ns.Driver.getMountPermissions(volumeContext)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	vol, err := ns.readEphemeralVolume(volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read state of ephemeral volume %s: %v", volumeID, err)
+	}
+	if vol == nil {
+		vol = &ephemeralVolume{
+			VolumeID:     volumeID,
+			Server:       server,
+			MountOptions: mountOptions,
+			SubDir:       filepath.Join(baseDir, volumeID),
+			TargetPath:   targetPath,
+			CreatedAt:    time.Now().UTC(),
+		}
+		if err := writeJSONFile(ns.getEphemeralStatePath(volumeID), vol); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to record ephemeral volume %s: %v", volumeID, err)
+		}
+	}
+
+	mounted, err := ns.prepareMountPoint(targetPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "could not prepare target path %s: %v", targetPath, err)
+	}
+	if mounted {
+		klog.V(5).InfoS("Ephemeral volume is already mounted", "targetPath", targetPath)
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	l := vol.lustre()
+	release, err := ns.lockSharedMount(ctx, ns.getSharedMountPath(l), "NodePublishVolume")
+	if err != nil {
+		return nil, status.Error(codes.Aborted, err.Error())
+	}
+	defer release()
+	sharedPath, err := ns.mountSharedFs(l)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to mount %s: %v", l.ServerName, err)
+	}
+	l.MountPoint = sharedPath
+	scratchPath := getInternalMountPath(l)
+	if err := makeDir(scratchPath, dirMode); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to make ephemeral subdirectory %s: %v", scratchPath, err)
+	}
+	if capacityBytes > 0 {
+		l.ProjectId = autoProjectId
+		projectId, err := applyProjectQuota(ctx, ns.Driver.Runner, l, capacityBytes, inodeLimit)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to set project quota on %s: %v", scratchPath, err)
+		}
+		if vol.ProjectId != projectId {
+			vol.ProjectId = projectId
+			if err := writeJSONFile(ns.getEphemeralStatePath(volumeID), vol); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to record ephemeral volume %s: %v", volumeID, err)
+			}
+		}
+	}
+
+	readOnly := req.GetReadonly() || isReadOnlyAccessMode(req.GetVolumeCapability()) || hasMountOption(mountOptions, mountOptionReadOnly)
+	klog.V(2).InfoS("Mounting ephemeral volume", "source", scratchPath, "targetPath", targetPath, "readOnly", readOnly)
+	if err := ns.bindMount(scratchPath, targetPath, readOnly); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to mount %s at %s: %v", scratchPath, targetPath, err)
+	}
+	if err := ns.applyVolumeMountGroup(targetPath, req.GetVolumeCapability(), readOnly); err != nil {
+		return nil, err
+	}
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// deleteEphemeralVolume 删除内联卷的临时目录并释放其项目配额，最后删除节点上的记录。
+// 调用前目标路径应已卸载
+func (ns *NodeServer) deleteEphemeralVolume(ctx context.Context, vol *ephemeralVolume) error {
+	l := vol.lustre()
+	if err := validateSubDir(l.SubDir); err != nil || l.SubDir == "" {
+		return fmt.Errorf("invalid subdir %q in state of ephemeral volume %s", l.SubDir, vol.VolumeID)
+	}
+	release, err := ns.lockSharedMount(ctx, ns.getSharedMountPath(l), "NodeUnpublishVolume")
+	if err != nil {
+		return err
+	}
+	err = ns.removeEphemeralVolume(ctx, vol, l)
+	release()
+	if err != nil {
+		return err
+	}
+	return ns.cleanupSharedMounts()
+}
+
+// removeEphemeralVolume 在共享挂载中删除临时目录、清除项目配额并删除记录，调用方持有共享挂载的锁
+func (ns *NodeServer) removeEphemeralVolume(ctx context.Context, vol *ephemeralVolume, l *Lustre) error {
+	sharedPath, err := ns.mountSharedFs(l)
+	if err != nil {
+		return fmt.Errorf("failed to mount %s: %v", l.ServerName, err)
+	}
+	l.MountPoint = sharedPath
+	scratchPath := getInternalMountPath(l)
+	klog.V(2).InfoS("Removing ephemeral volume", "volumeId", vol.VolumeID, "path", scratchPath)
+	if err := os.RemoveAll(scratchPath); err != nil {
+		return fmt.Errorf("failed to remove %s: %v", scratchPath, err)
+	}
+	if vol.ProjectId != 0 {
+		// 清除配额限制，项目 ID 在用量归零后可以被重新分配。失败时保留记录，NodeUnpublishVolume 重试时再次清除
+		if err := setProjectQuota(ctx, ns.Driver.Runner, sharedPath, vol.ProjectId, 0, 0); err != nil {
+			return fmt.Errorf("failed to clear quota of project %d: %v", vol.ProjectId, err)
+		}
+	}
+	if err := os.Remove(ns.getEphemeralStatePath(vol.VolumeID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package lustre
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/mount-utils"
+)
+
+func TestEphemeralVolume(t *testing.T) {
+	ns := initTestNode(t)
+	ns.Driver.NodeMountDir = t.TempDir()
+	ns.Driver.StateDir = t.TempDir()
+	mounter := ns.Mount.(*mount.FakeMounter)
+	runner := ns.Driver.Runner.(*fakeCommandRunner)
+	volumeCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	sharedPath := ns.getSharedMountPath(&Lustre{ServerName: testServer})
+	targetDir := t.TempDir()
+
+	publish := func(volumeID, target string, volumeContext map[string]string) error {
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:         volumeID,
+			TargetPath:       target,
+			VolumeCapability: volumeCap,
+			VolumeContext:    volumeContext,
+		})
+		return err
+	}
+	unpublish := func(ns *NodeServer, volumeID, target string) error {
+		_, err := ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: volumeID, TargetPath: target})
+		return err
+	}
+	isMounted := func(path string) bool {
+		mountPoints, _ := mounter.List()
+		for _, mp := range mountPoints {
+			if mp.Path == path {
+				return true
+			}
+		}
+		return false
+	}
+
+	// 未指定 subdir 时临时目录位于默认父目录下，重复发布是幂等的
+	target1 := filepath.Join(targetDir, "1")
+	ctx1 := map[string]string{ephemeralContextKey: "true", paramServer: testServer}
+	for i := 0; i < 2; i++ {
+		if err := publish("csi-1", target1, ctx1); err != nil {
+			t.Fatalf("publish csi-1: %v", err)
+		}
+	}
+	scratch1 := filepath.Join(sharedPath, defaultEphemeralBaseDir, "csi-1")
+	if st, err := os.Stat(scratch1); err != nil || !st.IsDir() {
+		t.Fatalf("scratch directory %s not created: %v", scratch1, err)
+	}
+	if !isMounted(target1) || !isMounted(sharedPath) {
+		t.Fatalf("expected %s and %s to be mounted: %v", target1, sharedPath, mounter.MountPoints)
+	}
+	if vol, err := ns.readEphemeralVolume("csi-1"); err != nil || vol == nil || vol.TargetPath != target1 || vol.Server != testServer {
+		t.Fatalf("unexpected state %+v, %v", vol, err)
+	}
+
+	// 设置 size 时为临时目录设置项目配额
+	target2 := filepath.Join(targetDir, "2")
+	scratch2 := filepath.Join(sharedPath, "scratch", "csi-2")
+	runner.outputs["lfs project -d "+scratch2] = "  123456 P " + scratch2
+	ctx2 := map[string]string{ephemeralContextKey: "true", paramServer: testServer, paramSubDir: "scratch", paramEphemeralSize: "1Gi"}
+	if err := publish("csi-2", target2, ctx2); err != nil {
+		t.Fatalf("publish csi-2: %v", err)
+	}
+	if !containsCall(runner.Calls(), "lfs setquota -p 123456 -B 1048576 -I 0 "+sharedPath) {
+		t.Errorf("quota not set: %v", runner.Calls())
+	}
+
+	// 使用新的 NodeServer 模拟插件重启，清理依赖节点上的记录
+	restarted := &NodeServer{Driver: ns.Driver, Mount: ns.Mount}
+	if err := unpublish(restarted, "csi-1", target1); err != nil {
+		t.Fatalf("unpublish csi-1: %v", err)
+	}
+	if _, err := os.Stat(scratch1); !os.IsNotExist(err) {
+		t.Errorf("scratch directory %s not removed: %v", scratch1, err)
+	}
+	if vol, err := ns.readEphemeralVolume("csi-1"); err != nil || vol != nil {
+		t.Errorf("state of csi-1 not removed: %+v, %v", vol, err)
+	}
+	if !isMounted(sharedPath) {
+		t.Fatalf("expected shared mount to be kept while csi-2 is published: %v", mounter.MountPoints)
+	}
+	// 清除配额失败时保留记录，重试时再次清除
+	clearCall := "lfs setquota -p 123456 -B 0 -I 0 " + sharedPath
+	runner.errs[clearCall] = fmt.Errorf("setquota failed")
+	if err := unpublish(restarted, "csi-2", target2); err == nil {
+		t.Fatal("expected unpublish csi-2 to fail when the quota cannot be cleared")
+	}
+	if vol, err := ns.readEphemeralVolume("csi-2"); err != nil || vol == nil {
+		t.Fatalf("state of csi-2 removed before the quota was cleared: %+v, %v", vol, err)
+	}
+	delete(runner.errs, clearCall)
+	if err := unpublish(restarted, "csi-2", target2); err != nil {
+		t.Fatalf("unpublish csi-2: %v", err)
+	}
+	if !containsCall(runner.Calls(), clearCall) {
+		t.Errorf("quota not cleared: %v", runner.Calls())
+	}
+	if isMounted(target2) || isMounted(sharedPath) {
+		t.Errorf("expected all mounts to be released: %v", mounter.MountPoints)
+	}
+	// 重复调用 NodeUnpublishVolume 成功
+	if err := unpublish(restarted, "csi-2", target2); err != nil {
+		t.Errorf("unpublish csi-2 again: %v", err)
+	}
+
+	errCases := []struct {
+		name          string
+		volumeContext map[string]string
+	}{
+		{name: "server missing", volumeContext: map[string]string{ephemeralContextKey: "true"}},
+		{name: "invalid size", volumeContext: map[string]string{ephemeralContextKey: "true", paramServer: testServer, paramEphemeralSize: "big"}},
+		{name: "subdir escapes", volumeContext: map[string]string{ephemeralContextKey: "true", paramServer: testServer, paramSubDir: "../etc"}},
+	}
+	for _, tc := range errCases {
+		if err := publish("csi-3", filepath.Join(targetDir, "3"), tc.volumeContext); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: got err %v, expected InvalidArgument", tc.name, err)
+		}
+	}
+}
+
+func containsCall(calls []string, call string) bool {
+	for _, c := range calls {
+		if c == call {
+			return true
+		}
+	}
+	return false
+}
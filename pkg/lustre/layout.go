@@ -0,0 +1,189 @@
+package lustre
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// stripeSizeUnit 为 Lustre 条带大小的最小粒度
+	stripeSizeUnit int64 = 64 * 1024
+	maxStripeSize  int64 = 4 << 30
+	maxStripeCount       = 2000
+)
+
+var ostPoolNameRe = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,15}$`)
+
+// stripeLayout 为 lfs setstripe 的条带参数，空字符串表示使用文件系统默认值
+type stripeLayout struct {
+	StripeCount  string
+	StripeSize   string
+	StripeOffset string
+	Pool         string
+}
+
+// parseStripeLayout 从 StorageClass 参数中解析并校验条带参数，未设置任何条带参数时返回 nil
+func parseStripeLayout(params map[string]string) (*stripeLayout, error) {
+	layout := &stripeLayout{}
+	if val, ok := params[paramStripeCount]; ok {
+		count, err := parseStripeCount(val)
+		if err != nil {
+			return nil, err
+		}
+		layout.StripeCount = strconv.Itoa(count)
+	}
+	if val, ok := params[paramStripeSize]; ok {
+		size, err := parseStripeSize(val)
+		if err != nil {
+			return nil, err
+		}
+		layout.StripeSize = strconv.FormatInt(size, 10)
+	}
+	if val, ok := params[paramStripeOffset]; ok {
+		offset, err := strconv.Atoi(val)
+		if err != nil || offset < -1 {
+			return nil, fmt.Errorf("invalid %s %q, must be -1 or an OST index", paramStripeOffset, val)
+		}
+		layout.StripeOffset = strconv.Itoa(offset)
+	}
+	if val, ok := params[paramOstPool]; ok {
+		if err := validateOstPool(val); err != nil {
+			return nil, err
+		}
+		layout.Pool = val
+	}
+	if *layout == (stripeLayout{}) {
+		return nil, nil
+	}
+	return layout, nil
+}
+
+func parseStripeCount(val string) (int, error) {
+	count, err := strconv.Atoi(val)
+	if err != nil || count < -1 || count > maxStripeCount {
+		return 0, fmt.Errorf("invalid %s %q, must be -1 (all OSTs) or between 0 and %d", paramStripeCount, val, maxStripeCount)
+	}
+	return count, nil
+}
+
+// parseStripeSize 解析带 k/m/g 后缀的条带大小，必须为 64KiB 的整数倍
+func parseStripeSize(val string) (int64, error) {
+	size, err := parseSize(val)
+	if err != nil || size > maxStripeSize {
+		return 0, fmt.Errorf("invalid %s %q", paramStripeSize, val)
+	}
+	if size%stripeSizeUnit != 0 {
+		return 0, fmt.Errorf("invalid %s %q, must be a multiple of 64KiB", paramStripeSize, val)
+	}
+	return size, nil
+}
+
+// parseSize 解析带 k/m/g/t 后缀（1024 进制）的非负大小
+func parseSize(val string) (int64, error) {
+	s := strings.ToLower(strings.TrimSpace(val))
+	shift := 0
+	switch {
+	case strings.HasSuffix(s, "k"):
+		shift, s = 10, strings.TrimSuffix(s, "k")
+	case strings.HasSuffix(s, "m"):
+		shift, s = 20, strings.TrimSuffix(s, "m")
+	case strings.HasSuffix(s, "g"):
+		shift, s = 30, strings.TrimSuffix(s, "g")
+	case strings.HasSuffix(s, "t"):
+		shift, s = 40, strings.TrimSuffix(s, "t")
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("invalid size %q", val)
+	}
+	return n << shift, nil
+}
+
+// formatSize 以能整除的最大单位格式化大小，例如 4194304 格式化为 4M
+func formatSize(size int64) string {
+	for _, unit := range []struct {
+		suffix string
+		shift  uint
+	}{{"T", 40}, {"G", 30}, {"M", 20}, {"K", 10}} {
+		if size != 0 && size%(1<<unit.shift) == 0 {
+			return strconv.FormatInt(size>>unit.shift, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(size, 10)
+}
+
+func validateOstPool(pool string) error {
+	if !ostPoolNameRe.MatchString(pool) {
+		return fmt.Errorf("invalid %s %q, must be 1-15 characters of letters, digits, '_', '-' or '.'", paramOstPool, pool)
+	}
+	return nil
+}
+
+// params 将条带参数写回卷上下文
+func (l *stripeLayout) params(volParam map[string]string) {
+	for key, val := range map[string]string{
+		paramStripeCount:  l.StripeCount,
+		paramStripeSize:   l.StripeSize,
+		paramStripeOffset: l.StripeOffset,
+		paramOstPool:      l.Pool,
+	} {
+		if val != "" {
+			volParam[key] = val
+		}
+	}
+}
+
+func (l *stripeLayout) args() []string {
+	var args []string
+	if l.StripeCount != "" {
+		args = append(args, "-c", l.StripeCount)
+	}
+	if l.StripeSize != "" {
+		args = append(args, "-S", l.StripeSize)
+	}
+	if l.StripeOffset != "" {
+		args = append(args, "-i", l.StripeOffset)
+	}
+	if l.Pool != "" {
+		args = append(args, "-p", l.Pool)
+	}
+	return args
+}
+
+// dirLayout 为可以通过 lfs setstripe 应用到目录上的布局
+type dirLayout interface {
+	// args 返回 lfs setstripe 的参数（不含目录）
+	args() []string
+	// params 将校验后的布局参数写回卷上下文
+	params(volParam map[string]string)
+}
+
+// parseDirLayout 从 StorageClass 参数中解析目录布局：layout 参数描述复合布局（PFL/DoM），
+// 与 stripeCount 等简单条带参数互斥；均未设置时返回 nil
+func parseDirLayout(params map[string]string) (dirLayout, error) {
+	stripe, err := parseStripeLayout(params)
+	if err != nil {
+		return nil, err
+	}
+	if val, ok := params[paramLayout]; ok {
+		if stripe != nil {
+			return nil, fmt.Errorf("%s can not be used together with %s, %s, %s or %s", paramLayout, paramStripeCount, paramStripeSize, paramStripeOffset, paramOstPool)
+		}
+		return parseCompositeLayout(val)
+	}
+	if stripe == nil {
+		return nil, nil
+	}
+	return stripe, nil
+}
+
+// setDirStripe 设置目录的默认布局，目录下新建的文件会继承该布局
+func setDirStripe(ctx context.Context, runner CommandRunner, dir string, layout dirLayout) error {
+	args := append([]string{"setstripe"}, layout.args()...)
+	_, err := runner.Run(ctx, lfsCmd, append(args, dir)...)
+	return err
+}
@@ -0,0 +1,69 @@
+package lustre
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestParseStripeLayout(t *testing.T) {
+	testCases := []struct {
+		name     string
+		params   map[string]string
+		expected *stripeLayout
+		wantErr  bool
+	}{
+		{
+			name:   "no stripe parameters",
+			params: map[string]string{paramServer: testServer},
+		},
+		{
+			name: "all stripe parameters",
+			params: map[string]string{
+				paramStripeCount:  "-1",
+				paramStripeSize:   "4M",
+				paramStripeOffset: "2",
+				paramOstPool:      "flash",
+			},
+			expected: &stripeLayout{StripeCount: "-1", StripeSize: "4194304", StripeOffset: "2", Pool: "flash"},
+		},
+		{
+			name:     "stripe size in bytes",
+			params:   map[string]string{paramStripeSize: "65536"},
+			expected: &stripeLayout{StripeSize: "65536"},
+		},
+		{name: "invalid stripe count", params: map[string]string{paramStripeCount: "-2"}, wantErr: true},
+		{name: "stripe count too large", params: map[string]string{paramStripeCount: "5000"}, wantErr: true},
+		{name: "stripe size not aligned", params: map[string]string{paramStripeSize: "100k"}, wantErr: true},
+		{name: "stripe size too large", params: map[string]string{paramStripeSize: "8g"}, wantErr: true},
+		{name: "invalid stripe size", params: map[string]string{paramStripeSize: "1T"}, wantErr: true},
+		{name: "invalid stripe offset", params: map[string]string{paramStripeOffset: "x"}, wantErr: true},
+		{name: "invalid pool name", params: map[string]string{paramOstPool: "pool name"}, wantErr: true},
+		{name: "pool name too long", params: map[string]string{paramOstPool: "a-very-long-pool-name"}, wantErr: true},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			layout, err := parseStripeLayout(test.params)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got err %v, wantErr %v", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(layout, test.expected) {
+				t.Errorf("got %+v, expected %+v", layout, test.expected)
+			}
+		})
+	}
+}
+
+func TestSetDirStripe(t *testing.T) {
+	runner := newFakeCommandRunner()
+	layout := &stripeLayout{StripeCount: "1", StripeSize: "1048576", Pool: "flash"}
+	if err := setDirStripe(context.Background(), runner, "/mnt/testfs/pvc-1", layout); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"lfs setstripe -c 1 -S 1048576 -p flash /mnt/testfs/pvc-1"}
+	if !reflect.DeepEqual(runner.Calls(), expected) {
+		t.Errorf("got calls %v, expected %v", runner.Calls(), expected)
+	}
+}
@@ -0,0 +1,146 @@
+package lustre
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+const (
+	lctlCmd = "lctl"
+	sshCmd  = "ssh"
+)
+
+// sshCommandRunner 通过 ssh 在远端主机上执行命令。lctl snapshot_* 只能在 MGS 上执行，
+// controller 通常不运行在 MGS 上，需要借助它把命令转发过去
+type sshCommandRunner struct {
+	runner CommandRunner
+	target string
+}
+
+// NewSSHCommandRunner 返回在 target（例如 root@mgs01）上执行命令的 CommandRunner，
+// 以非交互方式登录，认证依赖 controller 中的 ssh 密钥和 known_hosts 配置
+func NewSSHCommandRunner(runner CommandRunner, target string) CommandRunner {
+	return &sshCommandRunner{runner: runner, target: target}
+}
+
+func (r *sshCommandRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	// 远端由 shell 解析拼接后的命令行，参数需要逐个加引号
+	remote := make([]string, 0, len(args)+1)
+	for _, arg := range append([]string{name}, args...) {
+		remote = append(remote, shellQuote(arg))
+	}
+	return r.runner.Run(ctx, sshCmd, "-o", "BatchMode=yes", r.target, "--", strings.Join(remote, " "))
+}
+
+// shellQuote 用单引号包裹参数，参数中的单引号通过结束引号、转义后重新开始引号的方式保留
+func shellQuote(arg string) string {
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// lctlSnapshot 为 lctl snapshot_list 输出中的一个快照
+type lctlSnapshot struct {
+	Name string
+	// FsName 为快照的文件系统名称，客户端通过 <nids>:/<FsName> 只读挂载快照
+	FsName  string
+	Mounted bool
+}
+
+// listLctlSnapshots 列出文件系统的全部快照。lctl snapshot_* 需要在 MGS 上执行，
+// 依赖 ZFS 后端与 /etc/ldev.conf 中的服务器配置，runner 应为 Driver.MGSRunner
+func listLctlSnapshots(ctx context.Context, runner CommandRunner, fsName string) ([]*lctlSnapshot, error) {
+	out, err := runner.Run(ctx, lctlCmd, "snapshot_list", "-F", fsName)
+	if err != nil {
+		return nil, err
+	}
+	return parseLctlSnapshotList(string(out)), nil
+}
+
+// getLctlSnapshot 返回指定名称的快照，不存在时返回 nil
+func getLctlSnapshot(ctx context.Context, runner CommandRunner, fsName, name string) (*lctlSnapshot, error) {
+	snapshots, err := listLctlSnapshots(ctx, runner, fsName)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range snapshots {
+		if s.Name == name {
+			return s, nil
+		}
+	}
+	return nil, nil
+}
+
+func createLctlSnapshot(ctx context.Context, runner CommandRunner, fsName, name, comment string) error {
+	_, err := runner.Run(ctx, lctlCmd, "snapshot_create", "-F", fsName, "-n", name, "-c", comment)
+	return err
+}
+
+// destroyLctlSnapshot 强制删除快照，已在服务器端挂载的快照会先被卸载
+func destroyLctlSnapshot(ctx context.Context, runner CommandRunner, fsName, name string) error {
+	_, err := runner.Run(ctx, lctlCmd, "snapshot_destroy", "-F", fsName, "-n", name, "-f")
+	return err
+}
+
+// mountLctlSnapshot 在服务器端挂载快照，之后客户端才能挂载其文件系统
+func mountLctlSnapshot(ctx context.Context, runner CommandRunner, fsName, name string) error {
+	_, err := runner.Run(ctx, lctlCmd, "snapshot_mount", "-F", fsName, "-n", name)
+	return err
+}
+
+// parseLctlSnapshotList 解析 lctl snapshot_list 的输出:
+//
+//	filesystem_name: testfs
+//	snapshot_name: snapshot-1
+//
+//	create_time: Thu Apr  6 12:55:27 2017
+//	modify_time: Thu Apr  6 12:55:27 2017
+//	snapshot_fsname: 7c7d9a2b
+//	comment: ...
+//	status: not mount
+//
+// 每个快照以 snapshot_name 开始；带 -d 时每个 MDT/OST 各输出一段，取第一段的信息即可。
+func parseLctlSnapshotList(out string) []*lctlSnapshot {
+	var (
+		snapshots []*lctlSnapshot
+		current   *lctlSnapshot
+		seen      map[string]bool
+	)
+	for _, line := range strings.Split(out, "\n") {
+		key, val, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key, val = strings.TrimSpace(key), strings.TrimSpace(val)
+		if key == "snapshot_name" {
+			current = &lctlSnapshot{Name: val}
+			seen = map[string]bool{}
+			snapshots = append(snapshots, current)
+			continue
+		}
+		if current == nil || seen[key] {
+			continue
+		}
+		seen[key] = true
+		switch key {
+		case "snapshot_fsname":
+			current.FsName = val
+		case "status":
+			current.Mounted = val == "mounted"
+		}
+	}
+	return snapshots
+}
+
+// splitLustreServer 将 server 拆分为 MGS NID、文件系统名称和 fileset，
+// 例如 172.16.100.189@tcp:/testfs/fileset 拆分为 172.16.100.189@tcp、testfs 和 fileset
+func splitLustreServer(server string) (nids, fsName, fileset string, err error) {
+	idx := strings.LastIndex(server, ":/")
+	if idx <= 0 {
+		return "", "", "", fmt.Errorf("invalid lustre server %q, expected <mgsnid>:/<fsname>[/fileset]", server)
+	}
+	fsName, fileset, _ = strings.Cut(strings.Trim(server[idx+2:], "/"), "/")
+	if fsName == "" {
+		return "", "", "", fmt.Errorf("invalid lustre server %q, expected <mgsnid>:/<fsname>[/fileset]", server)
+	}
+	return server[:idx], fsName, fileset, nil
+}
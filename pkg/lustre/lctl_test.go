@@ -0,0 +1,276 @@
+package lustre
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/mount-utils"
+)
+
+// 以下输出为手工构造，不是从真实 MGS 录制的（目前没有可用的录制输出），
+// 格式按 lctl snapshot_list 的输出编写，comment 中为本驱动写入的源卷 ID
+const (
+	lctlSnapshotListOutput = `
+filesystem_name: testfs
+snapshot_name: snapshot-1
+
+create_time: Fri Oct 11 09:12:44 2024
+modify_time: Fri Oct 11 09:12:44 2024
+snapshot_fsname: 4a9f1c2e
+comment: snapshot of volume v1#172.16.100.189@tcp:/testfs#/mnt#pvc-a#pvc-a#
+status: not mount
+
+filesystem_name: testfs
+snapshot_name: snapshot-2
+
+create_time: Fri Oct 11 10:03:17 2024
+modify_time: Fri Oct 11 10:05:02 2024
+snapshot_fsname: 9d0e37b1
+status: mounted
+`
+	lctlSnapshotListDetailOutput = `
+filesystem_name: testfs
+snapshot_name: snapshot-1
+
+snapshot_role: MDT0000
+create_time: Fri Oct 11 09:12:44 2024
+modify_time: Fri Oct 11 09:12:44 2024
+snapshot_fsname: 4a9f1c2e
+status: mounted
+
+snapshot_role: OST0000
+create_time: Fri Oct 11 09:12:44 2024
+modify_time: Fri Oct 11 09:12:44 2024
+snapshot_fsname: 4a9f1c2e
+status: not mount
+`
+)
+
+func TestParseLctlSnapshotList(t *testing.T) {
+	testCases := []struct {
+		name     string
+		out      string
+		expected []*lctlSnapshot
+	}{
+		{
+			name: "summary",
+			out:  lctlSnapshotListOutput,
+			expected: []*lctlSnapshot{
+				{Name: "snapshot-1", FsName: "4a9f1c2e"},
+				{Name: "snapshot-2", FsName: "9d0e37b1", Mounted: true},
+			},
+		},
+		{
+			name: "detail uses the first target",
+			out:  lctlSnapshotListDetailOutput,
+			expected: []*lctlSnapshot{
+				{Name: "snapshot-1", FsName: "4a9f1c2e", Mounted: true},
+			},
+		},
+		{
+			name: "no snapshot",
+			out:  "\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		got := parseLctlSnapshotList(tc.out)
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s: got %+v, expected %+v", tc.name, got, tc.expected)
+		}
+	}
+}
+
+func TestSplitLustreServer(t *testing.T) {
+	testCases := []struct {
+		server                string
+		nids, fsName, fileset string
+		wantErr               bool
+	}{
+		{server: testServer, nids: "172.16.100.189@tcp", fsName: "testfs"},
+		{server: "10.0.0.1@tcp:10.0.0.2@tcp:/testfs/projects/a/", nids: "10.0.0.1@tcp:10.0.0.2@tcp", fsName: "testfs", fileset: "projects/a"},
+		{server: "testfs", wantErr: true},
+		{server: "172.16.100.189@tcp:/", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		nids, fsName, fileset, err := splitLustreServer(tc.server)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: unexpected error %v", tc.server, err)
+			continue
+		}
+		if nids != tc.nids || fsName != tc.fsName || fileset != tc.fileset {
+			t.Errorf("%s: got %q, %q, %q", tc.server, nids, fsName, fileset)
+		}
+	}
+}
+
+func TestSSHCommandRunner(t *testing.T) {
+	runner := newFakeCommandRunner()
+	mgs := NewSSHCommandRunner(runner, "root@mgs01")
+	if _, err := mgs.Run(context.Background(), lctlCmd, "snapshot_create", "-F", "testfs", "-n", "snap", "-c", "it's a snapshot"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	expected := `ssh -o BatchMode=yes root@mgs01 -- 'lctl' 'snapshot_create' '-F' 'testfs' '-n' 'snap' '-c' 'it'\''s a snapshot'`
+	if calls := runner.Calls(); len(calls) != 1 || calls[0] != expected {
+		t.Errorf("got calls %q, expected %q", calls, expected)
+	}
+}
+
+func TestLctlSnapshotsRequireMGS(t *testing.T) {
+	cs := initTestController(t)
+	baseDir := t.TempDir()
+	volResp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name: "pvc-a",
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		}},
+		Parameters: map[string]string{paramServer: testServer, paramBaseDir: baseDir},
+	})
+	if err != nil {
+		t.Fatalf("failed to create volume: %v", err)
+	}
+	_, err = cs.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{
+		Name:           "snapshot-1",
+		SourceVolumeId: volResp.GetVolume().GetVolumeId(),
+		Parameters:     map[string]string{paramSnapshotType: snapshotTypeLctl},
+	})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("got err %v, expected FailedPrecondition", err)
+	}
+	for _, call := range cs.Driver.Runner.(*fakeCommandRunner).Calls() {
+		if strings.HasPrefix(call, lctlCmd) {
+			t.Errorf("lctl run on the controller: %s", call)
+		}
+	}
+	if _, err := os.Stat(getSnapshotMetadataPath(baseDir, "snapshot-1")); !os.IsNotExist(err) {
+		t.Errorf("snapshot metadata written: %v", err)
+	}
+}
+
+func TestLctlSnapshots(t *testing.T) {
+	cs := initTestController(t)
+	runner := cs.Driver.Runner.(*fakeCommandRunner)
+	// 测试中 MGS 上的命令与本地命令记录在同一个假实现中
+	cs.Driver.MGSRunner = runner
+	baseDir := t.TempDir()
+	volumeCaps := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+	}
+	createVolume := func(name string, source *csi.VolumeContentSource) (*csi.CreateVolumeResponse, error) {
+		return cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:                name,
+			VolumeCapabilities:  volumeCaps,
+			CapacityRange:       &csi.CapacityRange{RequiredBytes: 1 << 30},
+			Parameters:          map[string]string{paramServer: testServer, paramBaseDir: baseDir},
+			VolumeContentSource: source,
+		})
+	}
+	hasCall := func(prefix string) int {
+		n := 0
+		for _, call := range runner.Calls() {
+			if strings.HasPrefix(call, prefix) {
+				n++
+			}
+		}
+		return n
+	}
+
+	volResp, err := createVolume("pvc-a", nil)
+	if err != nil {
+		t.Fatalf("failed to create volume: %v", err)
+	}
+	volumeID := volResp.GetVolume().GetVolumeId()
+
+	req := &csi.CreateSnapshotRequest{
+		Name:           "snapshot-1",
+		SourceVolumeId: volumeID,
+		Parameters:     map[string]string{paramSnapshotType: "lctl"},
+	}
+	resp, err := cs.CreateSnapshot(context.Background(), req)
+	if err != nil {
+		t.Fatalf("CreateSnapshot: %v", err)
+	}
+	snapshot := resp.GetSnapshot()
+	if !snapshot.GetReadyToUse() || snapshot.GetSizeBytes() != 1<<30 {
+		t.Errorf("unexpected snapshot %+v", snapshot)
+	}
+	if n := hasCall("lctl snapshot_create -F testfs -n snapshot-1 -c "); n != 1 {
+		t.Errorf("snapshot_create called %d times, expected 1", n)
+	}
+
+	// 重试时快照已存在，不会重复创建；换用其他类型则冲突
+	runner.outputs["lctl snapshot_list -F testfs"] = lctlSnapshotListOutput
+	if err := os.Remove(getSnapshotMetadataPath(baseDir, "snapshot-1")); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err = cs.CreateSnapshot(context.Background(), req); err != nil || resp.GetSnapshot().GetSnapshotId() != snapshot.GetSnapshotId() {
+		t.Fatalf("CreateSnapshot retry: %v, %v", resp, err)
+	}
+	if n := hasCall("lctl snapshot_create"); n != 1 {
+		t.Errorf("snapshot_create called %d times, expected 1", n)
+	}
+	if _, err := cs.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "snapshot-1", SourceVolumeId: volumeID}); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("got err %v, expected AlreadyExists", err)
+	}
+
+	// 从快照恢复：服务器端挂载快照后，controller 只读挂载快照文件系统并复制卷的子目录
+	snapshotMount := filepath.Join(cs.Driver.WorkingMountDir, lctlSnapshotMountPrefix+"4a9f1c2e")
+	writeTestFile(t, filepath.Join(snapshotMount, "pvc-a", "data"), "from snapshot", 0644, time.Now())
+	source := &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshot.GetSnapshotId()},
+		},
+	}
+	if _, err := createVolume("pvc-restore", source); err != nil {
+		t.Fatalf("failed to restore snapshot: %v", err)
+	}
+	if n := hasCall("lctl snapshot_mount -F testfs -n snapshot-1"); n != 1 {
+		t.Errorf("snapshot_mount called %d times, expected 1", n)
+	}
+	data, err := os.ReadFile(filepath.Join(baseDir, "pvc-restore", "data"))
+	if err != nil || string(data) != "from snapshot" {
+		t.Errorf("restored content %q, %v", data, err)
+	}
+	mountPoints, _ := cs.Mount.List()
+	var snapshotMp *mount.MountPoint
+	for i := range mountPoints {
+		if mountPoints[i].Path == snapshotMount {
+			snapshotMp = &mountPoints[i]
+		}
+	}
+	if snapshotMp == nil || snapshotMp.Device != "172.16.100.189@tcp:/4a9f1c2e" || !reflect.DeepEqual(snapshotMp.Opts, []string{"ro"}) {
+		t.Errorf("unexpected snapshot mount %+v", snapshotMp)
+	}
+
+	// 删除快照时先卸载 controller 上的挂载
+	if _, err := cs.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: snapshot.GetSnapshotId()}); err != nil {
+		t.Fatalf("DeleteSnapshot: %v", err)
+	}
+	if n := hasCall("lctl snapshot_destroy -F testfs -n snapshot-1 -f"); n != 1 {
+		t.Errorf("snapshot_destroy called %d times, expected 1", n)
+	}
+	if mountPoints, _ := cs.Mount.List(); len(mountPoints) != 1 {
+		t.Errorf("snapshot still mounted: %+v", mountPoints)
+	}
+	if meta, err := readSnapshotMetadata(baseDir, "snapshot-1"); meta != nil || err != nil {
+		t.Errorf("snapshot metadata not removed: %+v, %v", meta, err)
+	}
+
+	req.Parameters[paramSnapshotType] = "zfs"
+	if _, err := cs.CreateSnapshot(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got err %v, expected InvalidArgument", err)
+	}
+}
@@ -0,0 +1,256 @@
+package lustre
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	lfsCmd = "lfs"
+
+	// autoProjectId 表示由驱动自动分配项目 ID
+	autoProjectId = "auto"
+	// 自动分配的项目 ID 所在区间，避开管理员通常手工使用的较小 ID
+	autoProjectIdMin      uint32 = 100000
+	autoProjectIdRange    uint32 = 1 << 24
+	autoProjectIdAttempts        = 32
+)
+
+// CommandRunner 执行外部命令并返回合并后的输出，测试中可替换为假实现以脱离真实的 Lustre 环境
+type CommandRunner interface {
+	Run(ctx context.Context, name string, args ...string) ([]byte, error)
+}
+
+type execCommandRunner struct{}
+
+// NewCommandRunner 返回通过 os/exec 执行命令的 CommandRunner
+func NewCommandRunner() CommandRunner {
+	return &execCommandRunner{}
+}
+
+func (r *execCommandRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	klog.V(5).InfoS("Running command", "cmd", name, "args", args)
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf("%s %s failed: %v, output: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+// projectQuota 为 lfs quota -p 的结果，容量单位为 KiB
+type projectQuota struct {
+	BlocksUsedKB     uint64
+	BlockHardLimitKB uint64
+	InodesUsed       uint64
+	InodeHardLimit   uint64
+}
+
+func parseProjectId(val string) (uint32, error) {
+	id, err := strconv.ParseUint(val, 10, 32)
+	if err != nil || id == 0 {
+		return 0, fmt.Errorf("invalid %s %q, must be %q or a positive 32-bit integer", paramDIRPid, val, autoProjectId)
+	}
+	// 删除卷时只清除自动分配区间内的项目配额，显式指定的 ID 不能落在该区间内
+	if isAutoProjectId(uint32(id)) {
+		return 0, fmt.Errorf("%s %d is reserved for automatically allocated project IDs, must be below %d or above %d",
+			paramDIRPid, id, autoProjectIdMin, autoProjectIdMin+autoProjectIdRange-1)
+	}
+	return uint32(id), nil
+}
+
+// getDirProjectId 通过 lfs project -d 获取目录的项目 ID，未设置时返回 0
+func getDirProjectId(ctx context.Context, runner CommandRunner, dir string) (uint32, error) {
+	out, err := runner.Run(ctx, lfsCmd, "project", "-d", dir)
+	if err != nil {
+		return 0, err
+	}
+	// 输出格式: "    1000 P /mnt/testfs/pvc-1"
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unexpected output of lfs project -d %s: %q", dir, string(out))
+	}
+	id, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected output of lfs project -d %s: %q", dir, string(out))
+	}
+	return uint32(id), nil
+}
+
+// setDirProjectId 递归设置目录的项目 ID，并打开继承标志使新建文件自动继承
+func setDirProjectId(ctx context.Context, runner CommandRunner, dir string, id uint32) error {
+	_, err := runner.Run(ctx, lfsCmd, "project", "-p", strconv.FormatUint(uint64(id), 10), "-s", "-r", dir)
+	return err
+}
+
+// setProjectQuota 设置项目的块（KiB）和 inode 硬限制，0 表示不限制
+func setProjectQuota(ctx context.Context, runner CommandRunner, mountPath string, id uint32, blockHardLimitKB, inodeHardLimit uint64) error {
+	_, err := runner.Run(ctx, lfsCmd, "setquota", "-p", strconv.FormatUint(uint64(id), 10),
+		"-B", strconv.FormatUint(blockHardLimitKB, 10), "-I", strconv.FormatUint(inodeHardLimit, 10), mountPath)
+	return err
+}
+
+// getProjectQuota 通过 lfs quota -q -p 查询项目的用量和硬限制
+func getProjectQuota(ctx context.Context, runner CommandRunner, mountPath string, id uint32) (*projectQuota, error) {
+	out, err := runner.Run(ctx, lfsCmd, "quota", "-q", "-p", strconv.FormatUint(uint64(id), 10), mountPath)
+	if err != nil {
+		return nil, err
+	}
+	return parseProjectQuota(string(out))
+}
+
+// parseProjectQuota 解析 lfs quota -q 的输出:
+//
+//	/mnt/testfs  4  0  1048576  -  1  0  0  -
+//
+// 文件系统名称较长时 lfs 会将其单独输出一行，超限的数值会带有 "*" 后缀。
+func parseProjectQuota(out string) (*projectQuota, error) {
+	fields := strings.Fields(out)
+	if len(fields) < 9 {
+		return nil, fmt.Errorf("unexpected output of lfs quota: %q", out)
+	}
+	values := make([]uint64, 0, 4)
+	// kbytes, limit, files, limit
+	for _, idx := range []int{1, 3, 5, 7} {
+		v, err := strconv.ParseUint(strings.TrimSuffix(fields[idx], "*"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected output of lfs quota: %q", out)
+		}
+		values = append(values, v)
+	}
+	return &projectQuota{
+		BlocksUsedKB:     values[0],
+		BlockHardLimitKB: values[1],
+		InodesUsed:       values[2],
+		InodeHardLimit:   values[3],
+	}, nil
+}
+
+// allocateProjectId 为卷分配项目 ID：显式指定时直接使用；自动分配时以卷名哈希为起点在区间内探测未被使用的 ID，
+// 目录已有项目 ID（例如 CreateVolume 重试）时复用该 ID。
+func allocateProjectId(ctx context.Context, runner CommandRunner, l *Lustre, dir string) (uint32, error) {
+	if l.ProjectId != autoProjectId {
+		return parseProjectId(l.ProjectId)
+	}
+
+	existing, err := getDirProjectId(ctx, runner, dir)
+	if err != nil {
+		return 0, err
+	}
+	if existing != 0 {
+		return existing, nil
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(l.UUID))
+	start := h.Sum32() % autoProjectIdRange
+	for i := uint32(0); i < autoProjectIdAttempts; i++ {
+		id := autoProjectIdMin + (start+i)%autoProjectIdRange
+		quota, err := getProjectQuota(ctx, runner, l.MountPoint, id)
+		if err != nil {
+			return 0, err
+		}
+		if quota.BlocksUsedKB == 0 && quota.InodesUsed == 0 && quota.BlockHardLimitKB == 0 && quota.InodeHardLimit == 0 {
+			return id, nil
+		}
+		klog.V(4).InfoS("Project ID already in use, trying next", "projectId", id)
+	}
+	return 0, fmt.Errorf("failed to find an unused project ID for volume %s after %d attempts", l.UUID, autoProjectIdAttempts)
+}
+
+// isAutoProjectId 判断项目 ID 是否位于自动分配的区间内
+func isAutoProjectId(id uint32) bool {
+	return id >= autoProjectIdMin && id-autoProjectIdMin < autoProjectIdRange
+}
+
+// applyProjectQuota 为卷子目录分配项目 ID，递归设置继承标志并将硬限制设为请求的容量。
+// 显式指定的项目 ID 可能被多个卷共用，配额限制的是它们的总用量：项目已有硬限制时保持不变，只在首次使用时按卷的容量设置
+func applyProjectQuota(ctx context.Context, runner CommandRunner, l *Lustre, capacityBytes int64, inodeHardLimit uint64) (uint32, error) {
+	dir := getInternalMountPath(l)
+	id, err := allocateProjectId(ctx, runner, l, dir)
+	if err != nil {
+		return 0, err
+	}
+	if err := setDirProjectId(ctx, runner, dir, id); err != nil {
+		return 0, err
+	}
+	if !isAutoProjectId(id) {
+		quota, err := getProjectQuota(ctx, runner, l.MountPoint, id)
+		if err != nil {
+			return 0, err
+		}
+		if quota.BlockHardLimitKB != 0 || quota.InodeHardLimit != 0 {
+			klog.Warningf("project %d is shared with other directories, keeping its hard limits of %d KiB and %d inodes instead of the capacity of volume %s",
+				id, quota.BlockHardLimitKB, quota.InodeHardLimit, l.UUID)
+			return id, nil
+		}
+	}
+	if err := setProjectQuota(ctx, runner, l.MountPoint, id, bytesToKiB(capacityBytes), inodeHardLimit); err != nil {
+		return 0, err
+	}
+	klog.V(2).InfoS("Applied project quota", "dir", dir, "projectId", id, "capacityBytes", capacityBytes, "inodeLimit", inodeHardLimit)
+	return id, nil
+}
+
+func bytesToKiB(b int64) uint64 {
+	if b <= 0 {
+		return 0
+	}
+	return uint64((b + 1023) / 1024)
+}
+
+// getPoolAvailableBytes 汇总 lfs df 输出中 OST 池内各 OST 的可用空间
+func getPoolAvailableBytes(ctx context.Context, runner CommandRunner, mountPath, fsName, pool string) (int64, error) {
+	out, err := runner.Run(ctx, lfsCmd, "df", "--pool", fsName+"."+pool, mountPath)
+	if err != nil {
+		return 0, err
+	}
+	return parseOstAvailableBytes(string(out))
+}
+
+// parseOstAvailableBytes 解析 lfs df 的输出:
+//
+//	UUID                   1K-blocks        Used   Available Use% Mounted on
+//	testfs-MDT0000_UUID      2210560       27008     1985536   2% /mnt/testfs[MDT:0]
+//	testfs-OST0000_UUID      7666232     1178740     6062040  17% /mnt/testfs[OST:0]
+//	testfs-OST0001_UUID            : inactive device
+//
+//	filesystem_summary:      7666232     1178740     6062040  17% /mnt/testfs
+//
+// 只统计处于活动状态的 OST，MDT 和汇总行会被忽略。
+func parseOstAvailableBytes(out string) (int64, error) {
+	var availableKB int64
+	osts := 0
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 || !strings.Contains(fields[len(fields)-1], "[OST:") {
+			continue
+		}
+		kb, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("unexpected output of lfs df: %q", line)
+		}
+		availableKB += kb
+		osts++
+	}
+	if osts == 0 {
+		return 0, fmt.Errorf("no active OST found in output of lfs df: %q", out)
+	}
+	return availableKB * 1024, nil
+}
+
+// getLustreFsName 返回 server 中的 Lustre 文件系统名称（不含 fileset），
+// 例如 172.16.100.189@tcp:/testfs/fileset 对应 testfs
+func getLustreFsName(server string) string {
+	fsName := server
+	if idx := strings.LastIndex(fsName, ":/"); idx >= 0 {
+		fsName = fsName[idx+2:]
+	}
+	fsName, _, _ = strings.Cut(strings.Trim(fsName, "/"), "/")
+	return fsName
+}
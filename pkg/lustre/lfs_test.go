@@ -0,0 +1,204 @@
+package lustre
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeCommandRunner 记录执行过的命令，并按完整命令行返回预设的输出
+type fakeCommandRunner struct {
+	mu      sync.Mutex
+	calls   []string
+	outputs map[string]string
+	errs    map[string]error
+}
+
+func newFakeCommandRunner() *fakeCommandRunner {
+	return &fakeCommandRunner{
+		outputs: map[string]string{},
+		errs:    map[string]error{},
+	}
+}
+
+func (f *fakeCommandRunner) Run(_ context.Context, name string, args ...string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cmd := strings.Join(append([]string{name}, args...), " ")
+	f.calls = append(f.calls, cmd)
+	return []byte(f.outputs[cmd]), f.errs[cmd]
+}
+
+func (f *fakeCommandRunner) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string{}, f.calls...)
+}
+
+func TestParseProjectQuota(t *testing.T) {
+	testCases := []struct {
+		name     string
+		out      string
+		expected *projectQuota
+		wantErr  bool
+	}{
+		{
+			name:     "single line",
+			out:      "    /mnt/testfs       4       0 1048576       -       1       0       0       -\n",
+			expected: &projectQuota{BlocksUsedKB: 4, BlockHardLimitKB: 1048576, InodesUsed: 1},
+		},
+		{
+			name:     "long filesystem name and over quota",
+			out:      "/mnt/a/very/long/lustre/mount\n 1048580*      0 1048576    6d23h     10       0     100       -\n",
+			expected: &projectQuota{BlocksUsedKB: 1048580, BlockHardLimitKB: 1048576, InodesUsed: 10, InodeHardLimit: 100},
+		},
+		{
+			name:    "garbage",
+			out:     "lfs: quotactl failed",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			quota, err := parseProjectQuota(test.out)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got err %v, wantErr %v", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(quota, test.expected) {
+				t.Errorf("got %+v, expected %+v", quota, test.expected)
+			}
+		})
+	}
+}
+
+func TestApplyProjectQuota(t *testing.T) {
+	vol := &Lustre{MountPoint: "/mnt/testfs", SubDir: "pvc-1", UUID: "pvc-1"}
+	dir := getInternalMountPath(vol)
+
+	t.Run("explicit project id", func(t *testing.T) {
+		runner := newFakeCommandRunner()
+		vol := *vol
+		vol.ProjectId = "1000"
+		runner.outputs["lfs quota -q -p 1000 /mnt/testfs"] = "/mnt/testfs 0 0 0 - 0 0 0 -"
+		id, err := applyProjectQuota(context.Background(), runner, &vol, 1<<30, 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if id != 1000 {
+			t.Errorf("got project id %d, expected 1000", id)
+		}
+		expected := []string{
+			"lfs project -p 1000 -s -r " + dir,
+			"lfs quota -q -p 1000 /mnt/testfs",
+			"lfs setquota -p 1000 -B 1048576 -I 0 /mnt/testfs",
+		}
+		if !reflect.DeepEqual(runner.Calls(), expected) {
+			t.Errorf("got calls %v, expected %v", runner.Calls(), expected)
+		}
+	})
+
+	t.Run("explicit project id keeps shared limits", func(t *testing.T) {
+		runner := newFakeCommandRunner()
+		vol := *vol
+		vol.ProjectId = "1000"
+		runner.outputs["lfs quota -q -p 1000 /mnt/testfs"] = "/mnt/testfs 4096 0 2097152 - 10 0 0 -"
+		if _, err := applyProjectQuota(context.Background(), runner, &vol, 1<<30, 0); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expected := []string{
+			"lfs project -p 1000 -s -r " + dir,
+			"lfs quota -q -p 1000 /mnt/testfs",
+		}
+		if !reflect.DeepEqual(runner.Calls(), expected) {
+			t.Errorf("got calls %v, expected %v", runner.Calls(), expected)
+		}
+	})
+
+	t.Run("explicit project id in automatic range", func(t *testing.T) {
+		vol := *vol
+		vol.ProjectId = "123456"
+		if _, err := applyProjectQuota(context.Background(), newFakeCommandRunner(), &vol, 1<<30, 0); err == nil {
+			t.Error("expected error for explicit project id in the automatic range")
+		}
+	})
+
+	t.Run("automatic project id skips used ids", func(t *testing.T) {
+		runner := newFakeCommandRunner()
+		vol := *vol
+		vol.ProjectId = autoProjectId
+		runner.outputs["lfs project -d "+dir] = "       0 - " + dir
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(vol.UUID))
+		first := autoProjectIdMin + h.Sum32()%autoProjectIdRange
+		runner.outputs[fmt.Sprintf("lfs quota -q -p %d /mnt/testfs", first)] = "/mnt/testfs 8 0 0 - 2 0 0 -"
+		runner.outputs[fmt.Sprintf("lfs quota -q -p %d /mnt/testfs", first+1)] = "/mnt/testfs 0 0 0 - 0 0 0 -"
+
+		id, err := applyProjectQuota(context.Background(), runner, &vol, 2048, 100)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if id != first+1 {
+			t.Errorf("got project id %d, expected %d", id, first+1)
+		}
+		last := runner.Calls()[len(runner.Calls())-1]
+		if expected := fmt.Sprintf("lfs setquota -p %d -B 2 -I 100 /mnt/testfs", first+1); last != expected {
+			t.Errorf("got last call %q, expected %q", last, expected)
+		}
+	})
+
+	t.Run("automatic project id reuses existing id", func(t *testing.T) {
+		runner := newFakeCommandRunner()
+		vol := *vol
+		vol.ProjectId = autoProjectId
+		runner.outputs["lfs project -d "+dir] = "  123456 P " + dir
+		id, err := applyProjectQuota(context.Background(), runner, &vol, 1024, 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if id != 123456 {
+			t.Errorf("got project id %d, expected 123456", id)
+		}
+	})
+}
+
+func TestParseOstAvailableBytes(t *testing.T) {
+	out := `UUID                   1K-blocks        Used   Available Use% Mounted on
+testfs-MDT0000_UUID      2210560       27008     1985536   2% /mnt/testfs[MDT:0]
+testfs-OST0000_UUID      7666232     1178740     6062040  17% /mnt/testfs[OST:0]
+testfs-OST0001_UUID            : inactive device
+testfs-OST0002_UUID      7666232     1178740     1000000  17% /mnt/testfs[OST:2]
+
+filesystem_summary:     15332464     2357480     7062040  17% /mnt/testfs
+`
+	available, err := parseOstAvailableBytes(out)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := int64(7062040 * 1024); available != expected {
+		t.Errorf("got %d, expected %d", available, expected)
+	}
+
+	if _, err := parseOstAvailableBytes("UUID 1K-blocks Used Available Use% Mounted on\n"); err == nil {
+		t.Errorf("expected error when no OST is listed")
+	}
+}
+
+func TestGetLustreFsName(t *testing.T) {
+	for server, expected := range map[string]string{
+		testServer:                             "testfs",
+		"10.0.0.1@o2ib:10.0.0.2@o2ib:/scratch": "scratch",
+		"10.0.0.1@tcp:/testfs/fileset/a":       "testfs",
+	} {
+		if fsName := getLustreFsName(server); fsName != expected {
+			t.Errorf("got %q for %q, expected %q", fsName, server, expected)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package lustre
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// LockMode 为锁的模式：同一个键可以同时被多个共享锁持有，独占锁与其他任何锁互斥
+type LockMode int
+
+const (
+	LockExclusive LockMode = iota
+	LockShared
+)
+
+func (m LockMode) String() string {
+	if m == LockShared {
+		return "shared"
+	}
+	return "exclusive"
+}
+
+const (
+	// defaultLockStuckThreshold 为默认的操作卡住阈值，持锁超过该时间的操作会被记录到日志
+	defaultLockStuckThreshold = 10 * time.Minute
+	lockStuckCheckInterval    = time.Minute
+)
+
+// LockHolder 描述一个持有锁的操作
+type LockHolder struct {
+	Key      string
+	Owner    string
+	Mode     LockMode
+	Acquired time.Time
+}
+
+// HeldFor 返回操作已持锁的时间
+func (h LockHolder) HeldFor() time.Duration {
+	return time.Since(h.Acquired)
+}
+
+func (h LockHolder) String() string {
+	return fmt.Sprintf("%s (%s, held for %v)", h.Owner, h.Mode, h.HeldFor().Round(time.Millisecond))
+}
+
+type lockHolder struct {
+	LockHolder
+	// id 按获取顺序递增，用于稳定排序
+	id            uint64
+	stuckReported bool
+}
+
+func sortHolders(holders []*lockHolder) []LockHolder {
+	sort.Slice(holders, func(i, j int) bool { return holders[i].id < holders[j].id })
+	result := make([]LockHolder, 0, len(holders))
+	for _, h := range holders {
+		result = append(result, h.LockHolder)
+	}
+	return result
+}
+
+// keyLock 为单个键的锁状态，没有持有者和等待者时从 LockManager 中删除
+type keyLock struct {
+	holders   map[uint64]*lockHolder
+	exclusive bool
+	// waiters 为等待该键的操作数，exclusiveWaiters 为其中等待独占锁的数量。
+	// 有独占锁在等待时新的共享锁也需要等待，避免独占锁被持续到来的共享锁饿死
+	waiters          int
+	exclusiveWaiters int
+	// released 在每次释放锁时关闭并替换，用于唤醒等待者
+	released chan struct{}
+}
+
+func (k *keyLock) available(mode LockMode) bool {
+	if mode == LockExclusive {
+		return len(k.holders) == 0
+	}
+	return !k.exclusive && k.exclusiveWaiters == 0
+}
+
+// LockManager 为按键加锁的锁管理器，取代只能立即失败的 InFlight：
+// 既可以立即失败，也可以在 RPC 的 context 截止前等待锁；记录每个键的持有者和持锁时间，
+// 并周期性地将持锁超过阈值的操作记录到日志。
+type LockManager struct {
+	mu             sync.Mutex
+	locks          map[string]*keyLock
+	nextID         uint64
+	stuckThreshold time.Duration
+}
+
+// NewLockManager 创建锁管理器，stuckThreshold 不大于 0 时使用默认阈值
+func NewLockManager(stuckThreshold time.Duration) *LockManager {
+	if stuckThreshold <= 0 {
+		stuckThreshold = defaultLockStuckThreshold
+	}
+	return &LockManager{
+		locks:          make(map[string]*keyLock),
+		stuckThreshold: stuckThreshold,
+	}
+}
+
+// TryLock 尝试立即获取锁，成功时返回释放函数，锁已被占用时返回 false
+func (m *LockManager) TryLock(key, owner string, mode LockMode) (func(), bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k := m.getKeyLock(key)
+	if !k.available(mode) {
+		m.removeIfIdle(key, k)
+		return nil, false
+	}
+	return m.grant(key, k, owner, mode), true
+}
+
+// Lock 获取锁，锁被占用时一直等待到 ctx 结束，此时返回 ctx 的错误
+func (m *LockManager) Lock(ctx context.Context, key, owner string, mode LockMode) (func(), error) {
+	m.mu.Lock()
+	k := m.getKeyLock(key)
+	k.waiters++
+	if mode == LockExclusive {
+		k.exclusiveWaiters++
+	}
+	for {
+		if k.available(mode) {
+			break
+		}
+		released := k.released
+		m.mu.Unlock()
+		select {
+		case <-released:
+			m.mu.Lock()
+		case <-ctx.Done():
+			m.mu.Lock()
+			k.waiters--
+			if mode == LockExclusive {
+				k.exclusiveWaiters--
+				// 放弃等待的独占锁可能正阻塞着共享锁
+				m.wake(k)
+			}
+			m.removeIfIdle(key, k)
+			m.mu.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+	k.waiters--
+	if mode == LockExclusive {
+		k.exclusiveWaiters--
+	}
+	release := m.grant(key, k, owner, mode)
+	m.mu.Unlock()
+	return release, nil
+}
+
+// Holders 返回当前持有 key 的操作，按获取时间排序
+func (m *LockManager) Holders(key string) []LockHolder {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k, ok := m.locks[key]
+	if !ok {
+		return nil
+	}
+	holders := make([]*lockHolder, 0, len(k.holders))
+	for _, h := range k.holders {
+		holders = append(holders, h)
+	}
+	return sortHolders(holders)
+}
+
+// describeHolders 返回 key 的持有者描述，用于锁被占用时的错误信息
+func (m *LockManager) describeHolders(key string) string {
+	holders := m.Holders(key)
+	if len(holders) == 0 {
+		return "waiting operations"
+	}
+	descs := make([]string, 0, len(holders))
+	for _, h := range holders {
+		descs = append(descs, h.String())
+	}
+	return strings.Join(descs, ", ")
+}
+
+// StuckHolders 返回持锁超过阈值的操作，每个操作只在第一次超过阈值时记录日志
+func (m *LockManager) StuckHolders() []LockHolder {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var stuck []*lockHolder
+	for _, k := range m.locks {
+		for _, h := range k.holders {
+			if h.HeldFor() < m.stuckThreshold {
+				continue
+			}
+			stuck = append(stuck, h)
+			if !h.stuckReported {
+				h.stuckReported = true
+				klog.Warningf("operation %s on %q has held the lock for %v, it may be stuck", h.Owner, h.Key, h.HeldFor().Round(time.Second))
+			}
+		}
+	}
+	return sortHolders(stuck)
+}
+
+// Run 每隔 interval 检查一次卡住的操作，直到 stopCh 关闭
+func (m *LockManager) Run(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.StuckHolders()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (m *LockManager) getKeyLock(key string) *keyLock {
+	k, ok := m.locks[key]
+	if !ok {
+		k = &keyLock{holders: make(map[uint64]*lockHolder), released: make(chan struct{})}
+		m.locks[key] = k
+	}
+	return k
+}
+
+// grant 在持有 m.mu 时记录持有者，返回的释放函数可以重复调用
+func (m *LockManager) grant(key string, k *keyLock, owner string, mode LockMode) func() {
+	m.nextID++
+	id := m.nextID
+	k.holders[id] = &lockHolder{LockHolder: LockHolder{Key: key, Owner: owner, Mode: mode, Acquired: time.Now()}, id: id}
+	if mode == LockExclusive {
+		k.exclusive = true
+	}
+	klog.V(4).InfoS("Volume operation started", "key", key, "owner", owner, "mode", mode)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			h := k.holders[id]
+			delete(k.holders, id)
+			if mode == LockExclusive {
+				k.exclusive = false
+			}
+			m.wake(k)
+			m.removeIfIdle(key, k)
+			klog.V(4).InfoS("Volume operation finished", "key", key, "owner", owner, "duration", h.HeldFor())
+		})
+	}
+}
+
+func (m *LockManager) wake(k *keyLock) {
+	close(k.released)
+	k.released = make(chan struct{})
+}
+
+func (m *LockManager) removeIfIdle(key string, k *keyLock) {
+	if len(k.holders) == 0 && k.waiters == 0 {
+		delete(m.locks, key)
+	}
+}
+
+// lockVolume 获取卷操作锁。LockWaitTimeout 大于 0 时在 RPC 的截止时间之前最多等待 LockWaitTimeout，
+// 否则锁被占用时立即失败；返回的错误描述了当前的持有者
+func (d *Driver) lockVolume(ctx context.Context, key, owner string, mode LockMode) (func(), error) {
+	if d.LockWaitTimeout <= 0 {
+		if release, ok := d.VolumeLocks.TryLock(key, owner, mode); ok {
+			return release, nil
+		}
+		return nil, fmt.Errorf("held by %s", d.VolumeLocks.describeHolders(key))
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, d.LockWaitTimeout)
+	defer cancel()
+	release, err := d.VolumeLocks.Lock(waitCtx, key, owner, mode)
+	if err != nil {
+		return nil, fmt.Errorf("held by %s: %v", d.VolumeLocks.describeHolders(key), err)
+	}
+	return release, nil
+}
+
+// lockVolumePath 获取节点上针对某个路径的卷操作锁：卷本身加共享锁，路径加独占锁，
+// 同一个卷发布到不同路径的操作可以并发执行，但与 stage/unstage 互斥
+func (d *Driver) lockVolumePath(ctx context.Context, volumeID, path, owner string) (func(), error) {
+	releaseVolume, err := d.lockVolume(ctx, volumeID, owner, LockShared)
+	if err != nil {
+		return nil, err
+	}
+	releasePath, err := d.lockVolume(ctx, volumeOperationKey(volumeID, path), owner, LockExclusive)
+	if err != nil {
+		releaseVolume()
+		return nil, err
+	}
+	return func() {
+		releasePath()
+		releaseVolume()
+	}, nil
+}
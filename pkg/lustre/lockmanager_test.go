@@ -0,0 +1,295 @@
+package lustre
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLockManagerTryLock(t *testing.T) {
+	m := NewLockManager(0)
+
+	release, ok := m.TryLock("vol-1", "op-1", LockExclusive)
+	if !ok {
+		t.Fatal("failed to lock a free key")
+	}
+	if _, ok := m.TryLock("vol-1", "op-2", LockExclusive); ok {
+		t.Error("exclusive lock acquired twice")
+	}
+	if _, ok := m.TryLock("vol-1", "op-2", LockShared); ok {
+		t.Error("shared lock acquired while exclusive lock is held")
+	}
+	if releaseOther, ok := m.TryLock("vol-2", "op-2", LockExclusive); !ok {
+		t.Error("failed to lock another key")
+	} else {
+		releaseOther()
+	}
+	release()
+	// 重复释放不影响其他持有者
+	release()
+
+	releaseShared1, ok1 := m.TryLock("vol-1", "op-1", LockShared)
+	releaseShared2, ok2 := m.TryLock("vol-1", "op-2", LockShared)
+	if !ok1 || !ok2 {
+		t.Fatal("failed to acquire two shared locks")
+	}
+	if _, ok := m.TryLock("vol-1", "op-3", LockExclusive); ok {
+		t.Error("exclusive lock acquired while shared locks are held")
+	}
+	releaseShared1()
+	if _, ok := m.TryLock("vol-1", "op-3", LockExclusive); ok {
+		t.Error("exclusive lock acquired while a shared lock is held")
+	}
+	releaseShared2()
+
+	if len(m.locks) != 0 {
+		t.Errorf("idle keys not removed: %v", m.locks)
+	}
+}
+
+func TestLockManagerHolders(t *testing.T) {
+	m := NewLockManager(time.Millisecond)
+
+	release1, _ := m.TryLock("vol-1", "NodePublishVolume", LockShared)
+	release2, _ := m.TryLock("vol-1", "NodeUnpublishVolume", LockShared)
+	holders := m.Holders("vol-1")
+	if len(holders) != 2 || holders[0].Owner != "NodePublishVolume" || holders[1].Owner != "NodeUnpublishVolume" || holders[0].Mode != LockShared {
+		t.Errorf("unexpected holders %+v", holders)
+	}
+	if holders[0].HeldFor() < 0 {
+		t.Errorf("unexpected held time %v", holders[0].HeldFor())
+	}
+	if holders := m.Holders("vol-2"); holders != nil {
+		t.Errorf("unexpected holders of a free key %+v", holders)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	release2()
+	stuck := m.StuckHolders()
+	if len(stuck) != 1 || stuck[0].Owner != "NodePublishVolume" || stuck[0].Key != "vol-1" {
+		t.Errorf("unexpected stuck holders %+v", stuck)
+	}
+	release1()
+	if stuck := m.StuckHolders(); len(stuck) != 0 {
+		t.Errorf("released holder reported as stuck: %+v", stuck)
+	}
+}
+
+func TestLockManagerWait(t *testing.T) {
+	m := NewLockManager(0)
+	release, _ := m.TryLock("vol-1", "op-1", LockExclusive)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := m.Lock(ctx, "vol-1", "op-2", LockExclusive); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got err %v, expected DeadlineExceeded", err)
+	}
+
+	acquired := make(chan func())
+	go func() {
+		r, err := m.Lock(context.Background(), "vol-1", "op-3", LockShared)
+		if err != nil {
+			t.Errorf("Lock: %v", err)
+		}
+		acquired <- r
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("lock acquired while held exclusively")
+	case <-time.After(20 * time.Millisecond):
+	}
+	release()
+	select {
+	case r := <-acquired:
+		r()
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter not woken after release")
+	}
+	if len(m.locks) != 0 {
+		t.Errorf("idle keys not removed: %v", m.locks)
+	}
+}
+
+// 有独占锁在等待时新的共享锁不能插队，等待者放弃后共享锁恢复可用
+func TestLockManagerExclusiveWaiterPriority(t *testing.T) {
+	m := NewLockManager(0)
+	releaseShared, _ := m.TryLock("vol-1", "publish-1", LockShared)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := m.Lock(ctx, "vol-1", "unstage", LockExclusive)
+		done <- err
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m.mu.Lock()
+		waiting := m.locks["vol-1"].exclusiveWaiters
+		m.mu.Unlock()
+		if waiting == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("exclusive waiter not registered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, ok := m.TryLock("vol-1", "publish-2", LockShared); ok {
+		t.Error("shared lock acquired ahead of a waiting exclusive lock")
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("got err %v, expected Canceled", err)
+	}
+	release, ok := m.TryLock("vol-1", "publish-2", LockShared)
+	if !ok {
+		t.Fatal("shared lock not available after the exclusive waiter gave up")
+	}
+	release()
+	releaseShared()
+}
+
+func TestLockManagerConcurrentExclusive(t *testing.T) {
+	m := NewLockManager(0)
+	var (
+		wg      sync.WaitGroup
+		holders int32
+		counter int
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				release, err := m.Lock(context.Background(), "vol-1", "op", LockExclusive)
+				if err != nil {
+					t.Errorf("Lock: %v", err)
+					return
+				}
+				if n := atomic.AddInt32(&holders, 1); n != 1 {
+					t.Errorf("%d concurrent exclusive holders", n)
+				}
+				counter++
+				atomic.AddInt32(&holders, -1)
+				release()
+			}
+		}()
+	}
+	wg.Wait()
+	if counter != 1000 {
+		t.Errorf("counter %d, expected 1000", counter)
+	}
+	if len(m.locks) != 0 {
+		t.Errorf("idle keys not removed: %v", m.locks)
+	}
+}
+
+// 共享锁之间不会串行化：所有共享锁的持有者可以同时持锁，独占锁在它们全部释放后才能获得
+func TestLockManagerConcurrentShared(t *testing.T) {
+	m := NewLockManager(0)
+	const n = 20
+	var (
+		wg       sync.WaitGroup
+		all      sync.WaitGroup
+		releases = make(chan func(), n)
+	)
+	all.Add(n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := m.Lock(context.Background(), "vol-1", "publish", LockShared)
+			if err != nil {
+				t.Errorf("Lock: %v", err)
+				all.Done()
+				return
+			}
+			all.Done()
+			// 等待所有共享锁都获得后再释放，共享锁互斥时这里会死锁
+			all.Wait()
+			releases <- release
+		}()
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shared locks were serialized")
+	}
+	if holders := m.Holders("vol-1"); len(holders) != n {
+		t.Errorf("got %d holders, expected %d", len(holders), n)
+	}
+
+	exclusive := make(chan func())
+	go func() {
+		release, err := m.Lock(context.Background(), "vol-1", "unstage", LockExclusive)
+		if err != nil {
+			t.Errorf("Lock: %v", err)
+		}
+		exclusive <- release
+	}()
+	for i := 0; i < n; i++ {
+		select {
+		case <-exclusive:
+			t.Fatalf("exclusive lock acquired with %d shared holders left", n-i)
+		default:
+		}
+		(<-releases)()
+	}
+	select {
+	case release := <-exclusive:
+		release()
+	case <-time.After(5 * time.Second):
+		t.Fatal("exclusive lock not acquired after shared locks were released")
+	}
+}
+
+func TestDriverLockVolume(t *testing.T) {
+	d := NewDriver(&DriverOptions{DriverName: DefaultDriverName})
+	release, err := d.lockVolume(context.Background(), "vol-1", "DeleteVolume", LockExclusive)
+	if err != nil {
+		t.Fatalf("lockVolume: %v", err)
+	}
+
+	// 默认立即失败，错误信息中带有持有者
+	if _, err := d.lockVolume(context.Background(), "vol-1", "ControllerExpandVolume", LockExclusive); err == nil {
+		t.Error("expected error when the lock is held")
+	} else if !containsAll(err.Error(), "DeleteVolume", "exclusive") {
+		t.Errorf("error %q does not describe the holder", err)
+	}
+
+	// 设置等待时间后等待持有者释放
+	d.LockWaitTimeout = 5 * time.Second
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		release()
+	}()
+	releaseExpand, err := d.lockVolume(context.Background(), "vol-1", "ControllerExpandVolume", LockExclusive)
+	if err != nil {
+		t.Fatalf("lockVolume with wait: %v", err)
+	}
+	d.LockWaitTimeout = 10 * time.Millisecond
+	if _, err := d.lockVolume(context.Background(), "vol-1", "ControllerModifyVolume", LockExclusive); err == nil {
+		t.Error("expected error after waiting for the lock")
+	}
+	releaseExpand()
+}
+
+func containsAll(s string, subs ...string) bool {
+	for _, sub := range subs {
+		if !strings.Contains(s, sub) {
+			return false
+		}
+	}
+	return true
+}
@@ -17,19 +17,30 @@ const (
 	// The root directory is omitted from the string, for example:
 	//     "base" instead of "/base"
 
-	paramFsType          = "lustre"
-	paramServer          = "server"
-	paramBaseDir         = "base_dir"
-	paramSubDir          = "subdir"
-	paramOnDelete        = "ondelete"
-	paramDIRPid          = "projectId"
-	paramDIRUid          = "Uid"
-	pvcNameKey           = "csi.storage.k8s.io/pvc.yaml/Name"
-	pvcNamespaceKey      = "csi.storage.k8s.io/pvc.yaml/namespace"
-	pvNameKey            = "csi.storage.k8s.io/pv/Name"
-	pvcNameMetadata      = "${pvc.yaml.metadata.Name}"
-	pvcNamespaceMetadata = "${pvc.yaml.metadata.namespace}"
-	pvNameMetadata       = "${pv.metadata.Name}"
+	paramFsType           = "lustre"
+	paramServer           = "server"
+	paramBaseDir          = "base_dir"
+	paramSubDir           = "subdir"
+	paramOnDelete         = "ondelete"
+	paramDIRPid           = "projectId"
+	paramDIRUid           = "Uid"
+	paramDIRGid           = "Gid"
+	paramInodeLimit       = "inodeLimit"
+	paramMountOptions     = "mountOptions"
+	paramStripeCount      = "stripeCount"
+	paramStripeSize       = "stripeSize"
+	paramStripeOffset     = "stripeOffset"
+	paramOstPool          = "ostPool"
+	paramLayout           = "layout"
+	paramSnapshotType     = "snapshotType"
+	paramMountPermissions = "mountPermissions"
+	// 以下为 csi-provisioner 开启 --extra-create-metadata 后传入的参数，以及 subdir 和 base_dir 中对应的占位符
+	pvcNameKey           = "csi.storage.k8s.io/pvc/name"
+	pvcNamespaceKey      = "csi.storage.k8s.io/pvc/namespace"
+	pvNameKey            = "csi.storage.k8s.io/pv/name"
+	pvcNameMetadata      = "${pvc.metadata.name}"
+	pvcNamespaceMetadata = "${pvc.metadata.namespace}"
+	pvNameMetadata       = "${pv.metadata.name}"
 )
 
 type DriverOptions struct {
@@ -38,8 +49,22 @@ type DriverOptions struct {
 	Endpoint                     string
 	MountPermissions             uint64
 	WorkingMountDir              string
+	NodeMountDir                 string
 	DefaultOnDeletePolicy        string
 	VolStatsCacheExpireInMinutes int
+	CloneParallelism             int
+	// EphemeralBaseDir 为内联卷临时目录在文件系统中的默认父目录
+	EphemeralBaseDir string
+	// StateDir 为节点插件保存本地状态（如内联卷记录）的目录，插件重启后保留
+	StateDir string
+	// Servers 为 ListVolumes 固定遍历的 Lustre server，controller 重启后尚未挂载的文件系统中的卷同样会被列出
+	Servers []string
+	// MGSSSHTarget 为执行 lctl snapshot_* 的 MGS 的 ssh 登录目标（例如 root@mgs01），未设置时不支持 lctl 类型的快照
+	MGSSSHTarget string
+	// LockWaitTimeout 为卷操作等待锁的最长时间，0 表示锁被占用时立即返回 Aborted
+	LockWaitTimeout time.Duration
+	// LockStuckThreshold 为卷操作持锁超过多久被视为卡住并记录日志
+	LockStuckThreshold time.Duration
 }
 
 type Driver struct {
@@ -49,8 +74,13 @@ type Driver struct {
 	Endpoint                     string
 	MountPermissions             uint64
 	WorkingMountDir              string
+	NodeMountDir                 string
+	EphemeralBaseDir             string
+	StateDir                     string
+	Servers                      []string
 	DefaultOnDeletePolicy        string
-	VolumeLocks                  *InFlight
+	VolumeLocks                  *LockManager
+	LockWaitTimeout              time.Duration
 	Is                           *IdentityServer
 	Ns                           *NodeServer
 	Cs                           *ControllerServer
@@ -59,10 +89,15 @@ type Driver struct {
 	Vc                           []*csi.VolumeCapability_AccessMode
 	VolStatsCache                azcache.Resource
 	VolStatsCacheExpireInMinutes int
+	CloneParallelism             int
+	Runner                       CommandRunner
+	// MGSRunner 在 MGS 上执行 lctl snapshot_*，未配置 MGS 时为 nil
+	MGSRunner CommandRunner
 }
 
 type Lustre struct {
 	FSId        string
+	UUID        string
 	CapacityGiB int64
 	SubDir      string
 	MountPoint  string
@@ -72,12 +107,24 @@ type Lustre struct {
 	Uid         string
 	Gid         string
 	OnDelete    string
-	Mount       mount.Interface
+	// MountOptions 为校验后的挂载选项，不会编码进卷 ID
+	MountOptions []string
+	Mount        mount.Interface
 }
 
 func NewDriver(options *DriverOptions) *Driver {
 	klog.V(2).Infof("Driver: %v version: %v", options.DriverName, driverVersion)
 
+	if options.VolStatsCacheExpireInMinutes <= 0 {
+		options.VolStatsCacheExpireInMinutes = 10 // default expire in 10 minutes
+	}
+	if options.CloneParallelism <= 0 {
+		options.CloneParallelism = defaultCloneParallelism
+	}
+	if options.EphemeralBaseDir == "" {
+		options.EphemeralBaseDir = defaultEphemeralBaseDir
+	}
+
 	n := &Driver{
 		Name:                         options.DriverName,
 		NodeId:                       options.NodeID,
@@ -85,26 +132,39 @@ func NewDriver(options *DriverOptions) *Driver {
 		Endpoint:                     options.Endpoint,
 		MountPermissions:             options.MountPermissions,
 		WorkingMountDir:              options.WorkingMountDir,
+		NodeMountDir:                 options.NodeMountDir,
+		EphemeralBaseDir:             options.EphemeralBaseDir,
+		StateDir:                     options.StateDir,
+		Servers:                      options.Servers,
 		DefaultOnDeletePolicy:        options.DefaultOnDeletePolicy,
 		VolStatsCacheExpireInMinutes: options.VolStatsCacheExpireInMinutes,
+		CloneParallelism:             options.CloneParallelism,
+		LockWaitTimeout:              options.LockWaitTimeout,
+		Runner:                       NewCommandRunner(),
+	}
+	if options.MGSSSHTarget != "" {
+		n.MGSRunner = NewSSHCommandRunner(n.Runner, options.MGSSSHTarget)
 	}
 	n.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
 		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+		csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
 	})
 
 	n.AddNodeServiceCapabilities([]csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
 		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
 		csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
-		csi.NodeServiceCapability_RPC_UNKNOWN,
+		csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
 	})
-	n.VolumeLocks = NewInFlight()
-
-	if options.VolStatsCacheExpireInMinutes <= 0 {
-		options.VolStatsCacheExpireInMinutes = 10 // default expire in 10 minutes
-	}
+	n.VolumeLocks = NewLockManager(options.LockStuckThreshold)
 
 	var err error
 	getter := func(key string) (interface{}, error) { return nil, nil }
@@ -114,9 +174,10 @@ func NewDriver(options *DriverOptions) *Driver {
 	return n
 }
 
-func NewControllerServer(n *Driver) *ControllerServer {
+func NewControllerServer(n *Driver, mounter mount.Interface) *ControllerServer {
 	return &ControllerServer{
 		Driver: n,
+		Mount:  mounter,
 	}
 }
 
@@ -145,12 +206,14 @@ func (n *Driver) Run(testMode bool) {
 		// MounterForceUnmounter is only implemented on Linux now
 		mounter = mounter.(mount.MounterForceUnmounter)
 	}
+	go n.VolumeLocks.Run(lockStuckCheckInterval, nil)
+
 	s := NewNonBlockingGRPCServer()
 	s.Start(n.Endpoint,
 		NewDefaultIdentityServer(n),
 		// NFS plugin has not implemented ControllerServer
 		// using default controllerserver.
-		NewControllerServer(n),
+		NewControllerServer(n, mounter),
 		NewNodeServer(n, mounter),
 		testMode)
 	s.Wait()
@@ -0,0 +1,159 @@
+package lustre
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// mutableParameters 为 ControllerModifyVolume 允许修改的参数（VolumeAttributesClass 中的参数），
+// 其他参数（server、base_dir、subdir 等）编码在卷 ID 中或只在创建时生效，不允许修改
+var mutableParameters = map[string]bool{
+	paramInodeLimit:       true,
+	paramStripeCount:      true,
+	paramStripeSize:       true,
+	paramStripeOffset:     true,
+	paramOstPool:          true,
+	paramLayout:           true,
+	paramDIRUid:           true,
+	paramDIRGid:           true,
+	paramMountPermissions: true,
+	paramOnDelete:         true,
+}
+
+// layoutParameters 为描述目录布局的参数，修改其中任意一个都会整体替换目录的默认布局
+var layoutParameters = []string{paramStripeCount, paramStripeSize, paramStripeOffset, paramOstPool, paramLayout}
+
+// volumeModification 为校验后的卷修改内容，未设置的字段保持不变
+type volumeModification struct {
+	inodeLimit *uint64
+	layout     dirLayout
+	uid        int
+	gid        int
+	mode       *os.FileMode
+	onDelete   *string
+}
+
+// parseVolumeModification 按允许列表校验并解析 mutable_parameters
+func parseVolumeModification(params map[string]string) (*volumeModification, error) {
+	var unsupported []string
+	for key := range params {
+		if !mutableParameters[key] {
+			unsupported = append(unsupported, key)
+		}
+	}
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		allowed := make([]string, 0, len(mutableParameters))
+		for key := range mutableParameters {
+			allowed = append(allowed, key)
+		}
+		sort.Strings(allowed)
+		return nil, fmt.Errorf("parameters %v can not be modified, supported parameters are %v", unsupported, allowed)
+	}
+
+	m := &volumeModification{uid: -1, gid: -1}
+	if val, ok := params[paramInodeLimit]; ok {
+		limit, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", paramInodeLimit, val, err)
+		}
+		m.inodeLimit = &limit
+	}
+	layout, err := parseDirLayout(params)
+	if err != nil {
+		return nil, err
+	}
+	m.layout = layout
+	if val, ok := params[paramDIRUid]; ok {
+		if m.uid, err = parseOwnerId(paramDIRUid, val); err != nil {
+			return nil, err
+		}
+	}
+	if val, ok := params[paramDIRGid]; ok {
+		if m.gid, err = parseOwnerId(paramDIRGid, val); err != nil {
+			return nil, err
+		}
+	}
+	if val, ok := params[paramMountPermissions]; ok {
+		mode, err := parseDirMode(paramMountPermissions, val)
+		if err != nil {
+			return nil, err
+		}
+		m.mode = &mode
+	}
+	if val, ok := params[paramOnDelete]; ok {
+		if err := validateOnDeleteValue(val); err != nil {
+			return nil, err
+		}
+		m.onDelete = &val
+	}
+	return m, nil
+}
+
+func parseOwnerId(key, val string) (int, error) {
+	id, err := strconv.ParseUint(val, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q, must be a non-negative integer", key, val)
+	}
+	return int(id), nil
+}
+
+// apply 将修改应用到卷的子目录：目录布局只影响之后新建的文件，属主和权限只修改子目录本身。
+// 修改 inodeLimit 时 projectId 为子目录的项目 ID
+func (m *volumeModification) apply(ctx context.Context, runner CommandRunner, l *Lustre, projectId uint32) error {
+	dir := getInternalMountPath(l)
+	if m.layout != nil {
+		if err := setDirStripe(ctx, runner, dir, m.layout); err != nil {
+			return fmt.Errorf("failed to set stripe layout on %s: %v", dir, err)
+		}
+	}
+	if m.inodeLimit != nil {
+		quota, err := getProjectQuota(ctx, runner, l.MountPoint, projectId)
+		if err != nil {
+			return err
+		}
+		if quota.InodeHardLimit != *m.inodeLimit {
+			if err := setProjectQuota(ctx, runner, l.MountPoint, projectId, quota.BlockHardLimitKB, *m.inodeLimit); err != nil {
+				return err
+			}
+		}
+	}
+	if m.uid >= 0 || m.gid >= 0 {
+		if err := os.Chown(dir, m.uid, m.gid); err != nil {
+			return err
+		}
+	}
+	if m.mode != nil {
+		if err := os.Chmod(dir, *m.mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateVolumeContext 将修改后的参数写回卷上下文，修改布局时移除原有的全部布局参数
+func (m *volumeModification) updateVolumeContext(volumeContext, params map[string]string) {
+	if m.layout != nil {
+		for _, key := range layoutParameters {
+			delete(volumeContext, key)
+		}
+		m.layout.params(volumeContext)
+	}
+	for key, val := range params {
+		if !isLayoutParameter(key) {
+			volumeContext[key] = val
+		}
+	}
+}
+
+func isLayoutParameter(key string) bool {
+	for _, k := range layoutParameters {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
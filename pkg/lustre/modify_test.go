@@ -0,0 +1,150 @@
+package lustre
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseVolumeModification(t *testing.T) {
+	testCases := []struct {
+		name    string
+		params  map[string]string
+		wantErr bool
+	}{
+		{name: "empty"},
+		{name: "all mutable parameters", params: map[string]string{
+			paramInodeLimit: "1000", paramStripeCount: "4", paramStripeSize: "4m", paramOstPool: "flash",
+			paramDIRUid: "1000", paramDIRGid: "1000", paramMountPermissions: "2775", paramOnDelete: retain,
+		}},
+		{name: "composite layout", params: map[string]string{paramLayout: "dom:64k;eof"}},
+		{name: "immutable parameter", params: map[string]string{paramServer: testServer}, wantErr: true},
+		{name: "project id is immutable", params: map[string]string{paramDIRPid: "1000"}, wantErr: true},
+		{name: "invalid inode limit", params: map[string]string{paramInodeLimit: "-1"}, wantErr: true},
+		{name: "invalid stripe count", params: map[string]string{paramStripeCount: "abc"}, wantErr: true},
+		{name: "layout and stripe count", params: map[string]string{paramLayout: "dom:64k;eof", paramStripeCount: "4"}, wantErr: true},
+		{name: "invalid uid", params: map[string]string{paramDIRUid: "root"}, wantErr: true},
+		{name: "invalid mode", params: map[string]string{paramMountPermissions: "0999"}, wantErr: true},
+		{name: "mode out of range", params: map[string]string{paramMountPermissions: "17777"}, wantErr: true},
+		{name: "invalid ondelete", params: map[string]string{paramOnDelete: "keep"}, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		_, err := parseVolumeModification(tc.params)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got err %v, expected error %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestControllerModifyVolume(t *testing.T) {
+	cs := initTestController(t)
+	runner := cs.Driver.Runner.(*fakeCommandRunner)
+	baseDir := t.TempDir()
+	createResp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name: "pvc-1",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+			},
+		},
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 30},
+		Parameters:    map[string]string{paramServer: testServer, paramBaseDir: baseDir, paramStripeCount: "2", paramStripeSize: "1m"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create volume: %v", err)
+	}
+	volID := createResp.GetVolume().GetVolumeId()
+	dir := filepath.Join(baseDir, "pvc-1")
+	modify := func(params map[string]string) error {
+		_, err := cs.ControllerModifyVolume(context.Background(), &csi.ControllerModifyVolumeRequest{VolumeId: volID, MutableParameters: params})
+		return err
+	}
+	lastCall := func() string {
+		calls := runner.Calls()
+		return calls[len(calls)-1]
+	}
+
+	// 修改条带布局会整体替换目录的默认布局
+	if err := modify(map[string]string{paramStripeCount: "4", paramOstPool: "flash"}); err != nil {
+		t.Fatalf("failed to modify stripe layout: %v", err)
+	}
+	if call := lastCall(); call != "lfs setstripe -c 4 -p flash "+dir {
+		t.Errorf("unexpected call %q", call)
+	}
+	meta, err := readVolumeMetadata(baseDir, "pvc-1")
+	if err != nil || meta == nil {
+		t.Fatalf("failed to read volume metadata: %v", err)
+	}
+	if _, ok := meta.VolumeContext[paramStripeSize]; ok || meta.VolumeContext[paramStripeCount] != "4" || meta.VolumeContext[paramOstPool] != "flash" {
+		t.Errorf("unexpected volume context %v", meta.VolumeContext)
+	}
+
+	// 修改 inode 限制时保留块限制
+	runner.outputs["lfs project -d "+dir] = "       0 - " + dir
+	if err := modify(map[string]string{paramInodeLimit: "1000"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("volume without project quota: got err %v, expected InvalidArgument", err)
+	}
+	runner.outputs["lfs project -d "+dir] = "    1000 P " + dir
+	runner.outputs["lfs quota -q -p 1000 "+baseDir] = "/mnt 4 0 1048576 - 1 0 500 -"
+	if err := modify(map[string]string{paramInodeLimit: "1000"}); err != nil {
+		t.Fatalf("failed to modify inode limit: %v", err)
+	}
+	if call := lastCall(); call != "lfs setquota -p 1000 -B 1048576 -I 1000 "+baseDir {
+		t.Errorf("unexpected call %q", call)
+	}
+
+	uid := strconv.Itoa(os.Getuid())
+	if err := modify(map[string]string{paramDIRUid: uid, paramMountPermissions: "0750"}); err != nil {
+		t.Fatalf("failed to modify ownership: %v", err)
+	}
+	if st, err := os.Stat(dir); err != nil || st.Mode().Perm() != 0750 {
+		t.Errorf("unexpected subdirectory mode %v, %v", st.Mode(), err)
+	}
+
+	// 删除策略记录在卷元数据中，DeleteVolume 时优先于卷 ID 中的策略
+	if err := modify(map[string]string{paramOnDelete: retain}); err != nil {
+		t.Fatalf("failed to modify ondelete: %v", err)
+	}
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volID}); err != nil {
+		t.Fatalf("DeleteVolume: %v", err)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Errorf("subdirectory should be retained: %v", err)
+	}
+
+	errCases := []struct {
+		name   string
+		volID  string
+		params map[string]string
+		code   codes.Code
+	}{
+		{name: "volume id missing", code: codes.InvalidArgument},
+		{name: "immutable parameter", volID: volID, params: map[string]string{paramSubDir: "other"}, code: codes.InvalidArgument},
+		{name: "malformed volume id", volID: "v1#bad", code: codes.NotFound},
+		{
+			name:  "subdirectory missing",
+			volID: getVolumeIDFromLustreVol(&Lustre{ServerName: testServer, MountPoint: baseDir, SubDir: "missing", UUID: "missing"}),
+			code:  codes.NotFound,
+		},
+		{
+			name:   "ondelete of legacy volume",
+			volID:  getVolumeIDFromLustreVol(&Lustre{ServerName: testServer, MountPoint: baseDir, SubDir: "pvc-1"}),
+			params: map[string]string{paramOnDelete: deletes},
+			code:   codes.InvalidArgument,
+		},
+	}
+	for _, tc := range errCases {
+		_, err := cs.ControllerModifyVolume(context.Background(), &csi.ControllerModifyVolumeRequest{VolumeId: tc.volID, MutableParameters: tc.params})
+		if status.Code(err) != tc.code {
+			t.Errorf("%s: got err %v, expected code %v", tc.name, err, tc.code)
+		}
+	}
+}
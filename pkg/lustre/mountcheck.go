@@ -0,0 +1,137 @@
+package lustre
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"k8s.io/klog/v2"
+	"k8s.io/mount-utils"
+)
+
+// mountCheckTimeout 为检查挂载点的最长时间，Lustre 客户端被驱逐或 MGS 不可用时 stat 可能一直阻塞
+var mountCheckTimeout = 30 * time.Second
+
+// mountTimeout 为挂载文件系统的最长时间，MGS 不可达时 mount.lustre 可能长时间阻塞
+var mountTimeout = 2 * time.Minute
+
+// unmountTimeout 为普通卸载的最长时间，超时后使用 umount -f 强制卸载
+const unmountTimeout = 30 * time.Second
+
+// errMountCheckTimeout 表示检查挂载点超时，按损坏的挂载点处理
+var errMountCheckTimeout = errors.New("timed out checking mount point")
+
+// isLikelyNotMountPointWithTimeout 在 timeout 内检查 path 是否为挂载点，超时返回 errMountCheckTimeout。
+// 超时后阻塞在 stat 中的 goroutine 无法取消，只能在挂载恢复或被卸载后退出
+func isLikelyNotMountPointWithTimeout(mounter mount.Interface, path string, timeout time.Duration) (bool, error) {
+	type result struct {
+		notMnt bool
+		err    error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		notMnt, err := mounter.IsLikelyNotMountPoint(path)
+		ch <- result{notMnt, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.notMnt, r.err
+	case <-time.After(timeout):
+		return false, fmt.Errorf("%s: %w after %v", path, errMountCheckTimeout, timeout)
+	}
+}
+
+// mountWithTimeout 在 timeout 内完成挂载，超时返回错误。超时后 mount 仍在后台执行，
+// 调用方重试时按挂载点的实际状态处理
+func mountWithTimeout(mounter mount.Interface, source, target, fstype string, options []string, timeout time.Duration) error {
+	ch := make(chan error, 1)
+	go func() {
+		ch <- mounter.Mount(source, target, fstype, options)
+	}()
+	select {
+	case err := <-ch:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out mounting %s at %s after %v", source, target, timeout)
+	}
+}
+
+// isCorruptedMount 判断挂载点检查的错误是否说明挂载已损坏（ENOTCONN、ESTALE、EIO 等或检查超时）
+func isCorruptedMount(err error) bool {
+	return mount.IsCorruptedMnt(err) || errors.Is(err, errMountCheckTimeout)
+}
+
+// checkMountPoint 检查 path 是否已挂载。挂载已损坏时先卸载，返回 false 以便调用方重新挂载
+func (ns *NodeServer) checkMountPoint(path string) (bool, error) {
+	notMnt, err := isLikelyNotMountPointWithTimeout(ns.Mount, path, mountCheckTimeout)
+	if err == nil {
+		return !notMnt, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if !isCorruptedMount(err) {
+		return false, err
+	}
+	klog.Warningf("mount point %s is corrupted, unmounting it: %v", path, err)
+	if err := ns.unmountCorrupted(path); err != nil {
+		return false, fmt.Errorf("failed to unmount corrupted mount point %s: %v", path, err)
+	}
+	return false, nil
+}
+
+// unmount 卸载 path，挂载器支持时普通卸载超时后强制卸载
+func (ns *NodeServer) unmount(path string) error {
+	if m, ok := ns.Mount.(mount.MounterForceUnmounter); ok {
+		return m.UnmountWithForce(path, unmountTimeout)
+	}
+	return ns.Mount.Unmount(path)
+}
+
+// unmountCorrupted 卸载损坏的挂载点，强制卸载失败（例如挂载点仍被进程占用）时改为 lazy 卸载，
+// 挂载点立即从目录树中分离，内核在最后一个引用释放后完成清理
+func (ns *NodeServer) unmountCorrupted(path string) error {
+	err := ns.unmount(path)
+	if err == nil {
+		return nil
+	}
+	klog.Warningf("failed to unmount %s, trying lazy unmount: %v", path, err)
+	ctx, cancel := context.WithTimeout(context.Background(), unmountTimeout)
+	defer cancel()
+	if _, lazyErr := ns.Driver.Runner.Run(ctx, "umount", "-l", path); lazyErr != nil {
+		return fmt.Errorf("%v, lazy unmount: %v", err, lazyErr)
+	}
+	return nil
+}
+
+// cleanupMountPoint 卸载 path 并删除挂载点目录，path 不存在或未挂载时同样成功。
+// 挂载点检查带超时，损坏或检查超时的挂载直接强制或 lazy 卸载。这里不使用 mount-utils 的 CleanupMountPoint，
+// 它在卸载前后都会不带超时地 stat 挂载点，挂起的 Lustre 客户端会让调用一直阻塞
+func (ns *NodeServer) cleanupMountPoint(path string) error {
+	notMnt, err := isLikelyNotMountPointWithTimeout(ns.Mount, path, mountCheckTimeout)
+	switch {
+	case err == nil:
+		if !notMnt {
+			if err := ns.unmount(path); err != nil {
+				return err
+			}
+		}
+	case os.IsNotExist(err):
+		klog.V(4).InfoS("Mount point does not exist, skipping cleanup", "path", path)
+		return nil
+	case isCorruptedMount(err):
+		klog.Warningf("mount point %s is corrupted, unmounting it: %v", path, err)
+		if err := ns.unmountCorrupted(path); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+	// 卸载后 path 为普通目录，仍处于挂载状态时 Remove 返回 EBUSY
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package lustre
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/mount-utils"
+)
+
+// hangingMounter 模拟 Lustre 客户端挂起时阻塞在 stat 中的挂载点检查
+type hangingMounter struct {
+	*mount.FakeMounter
+	unblock chan struct{}
+}
+
+func (m *hangingMounter) IsLikelyNotMountPoint(file string) (bool, error) {
+	<-m.unblock
+	return m.FakeMounter.IsLikelyNotMountPoint(file)
+}
+
+// blockingMounter 模拟 MGS 不可达时阻塞的文件系统挂载
+type blockingMounter struct {
+	*mount.FakeMounter
+	unblock chan struct{}
+}
+
+func (m *blockingMounter) Mount(source, target, fstype string, options []string) error {
+	<-m.unblock
+	return m.FakeMounter.Mount(source, target, fstype, options)
+}
+
+// forceMounter 记录强制卸载的调用
+type forceMounter struct {
+	*mount.FakeMounter
+	forced []string
+}
+
+func (m *forceMounter) UnmountWithForce(target string, _ time.Duration) error {
+	m.forced = append(m.forced, target)
+	return m.FakeMounter.Unmount(target)
+}
+
+func TestIsLikelyNotMountPointWithTimeout(t *testing.T) {
+	m := &hangingMounter{FakeMounter: mount.NewFakeMounter(nil), unblock: make(chan struct{})}
+	defer close(m.unblock)
+
+	_, err := isLikelyNotMountPointWithTimeout(m, t.TempDir(), 10*time.Millisecond)
+	if !errors.Is(err, errMountCheckTimeout) || !isCorruptedMount(err) {
+		t.Errorf("got err %v, expected timeout treated as corrupted mount", err)
+	}
+	if isCorruptedMount(os.ErrNotExist) {
+		t.Error("missing path treated as corrupted mount")
+	}
+	if !isCorruptedMount(&os.PathError{Op: "stat", Path: "/mnt", Err: syscall.ESTALE}) {
+		t.Error("ESTALE not treated as corrupted mount")
+	}
+}
+
+func TestCorruptedMountRecovery(t *testing.T) {
+	ns := initTestNode(t)
+	mounter := ns.Mount.(*mount.FakeMounter)
+	mounter.MountCheckErrors = map[string]error{}
+	runner := ns.Driver.Runner.(*fakeCommandRunner)
+	stagingPath := t.TempDir()
+	targetPath := filepath.Join(t.TempDir(), "target")
+	vol := &Lustre{ServerName: testServer, SubDir: "a1"}
+	volumeCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+	}
+	publish := func() error {
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:          getVolumeIDFromLustreVol(vol),
+			StagingTargetPath: stagingPath,
+			TargetPath:        targetPath,
+			VolumeCapability:  volumeCap,
+		})
+		return err
+	}
+	unpublish := func() error {
+		_, err := ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   getVolumeIDFromLustreVol(vol),
+			TargetPath: targetPath,
+		})
+		return err
+	}
+	corrupt := func() {
+		mounter.MountCheckErrors[targetPath] = &os.PathError{Op: "stat", Path: targetPath, Err: syscall.ENOTCONN}
+	}
+	lastActions := func(n int) []string {
+		log := mounter.GetLog()
+		var actions []string
+		for _, a := range log[len(log)-n:] {
+			actions = append(actions, a.Action)
+		}
+		return actions
+	}
+
+	if err := publish(); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	// 损坏的目标路径先被卸载再重新挂载
+	corrupt()
+	if err := publish(); err != nil {
+		t.Fatalf("publish on corrupted target: %v", err)
+	}
+	if actions := lastActions(2); actions[0] != mount.FakeActionUnmount || actions[1] != mount.FakeActionMount {
+		t.Errorf("expected unmount and mount, got %v", actions)
+	}
+
+	// 普通卸载失败时使用 lazy 卸载。FakeMounter 不会执行 lazy 卸载，这里让第一次卸载失败并恢复挂载点检查
+	corrupt()
+	failed := false
+	mounter.UnmountFunc = func(path string) error {
+		if failed {
+			return nil
+		}
+		failed = true
+		delete(mounter.MountCheckErrors, path)
+		return syscall.EBUSY
+	}
+	if err := unpublish(); err != nil {
+		t.Fatalf("unpublish on corrupted target: %v", err)
+	}
+	if !containsCall(runner.Calls(), "umount -l "+targetPath) {
+		t.Errorf("lazy unmount not attempted: %v", runner.Calls())
+	}
+	mounter.UnmountFunc = nil
+
+	// 挂载器支持强制卸载时使用 UnmountWithForce
+	force := &forceMounter{FakeMounter: mounter}
+	ns.Mount = force
+	if err := ns.unmount(targetPath); err != nil {
+		t.Fatalf("unmount: %v", err)
+	}
+	if len(force.forced) != 1 || force.forced[0] != targetPath {
+		t.Errorf("unexpected force unmounts %v", force.forced)
+	}
+}
+
+// 发布时 staging 路径或文件系统挂载损坏，重新 stage 后再 bind 到目标路径
+func TestCorruptedStagingRecovery(t *testing.T) {
+	ns := initTestNode(t)
+	ns.Driver.NodeMountDir = t.TempDir()
+	mounter := ns.Mount.(*mount.FakeMounter)
+	mounter.MountCheckErrors = map[string]error{}
+	vol := &Lustre{ServerName: testServer, SubDir: "a1"}
+	sharedPath := ns.getSharedMountPath(vol)
+	if err := os.MkdirAll(filepath.Join(sharedPath, vol.SubDir), 0750); err != nil {
+		t.Fatalf("failed to prepare subdirectory: %v", err)
+	}
+	stagingPath := filepath.Join(t.TempDir(), "staging")
+	volumeCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+	}
+	if _, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          getVolumeIDFromLustreVol(vol),
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  volumeCap,
+	}); err != nil {
+		t.Fatalf("stage: %v", err)
+	}
+	publish := func(targetPath string) error {
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:          getVolumeIDFromLustreVol(vol),
+			StagingTargetPath: stagingPath,
+			TargetPath:        targetPath,
+			VolumeCapability:  volumeCap,
+		})
+		return err
+	}
+	actionsSince := func(n int) []string {
+		var actions []string
+		for _, a := range mounter.GetLog()[n:] {
+			actions = append(actions, a.Action+" "+a.Target)
+		}
+		return actions
+	}
+	enotconn := func(path string) error {
+		return &os.PathError{Op: "stat", Path: path, Err: syscall.ENOTCONN}
+	}
+
+	// 损坏的 staging 路径被卸载后重新 bind
+	targetPath := filepath.Join(t.TempDir(), "target")
+	mounter.MountCheckErrors[stagingPath] = enotconn(stagingPath)
+	n := len(mounter.GetLog())
+	if err := publish(targetPath); err != nil {
+		t.Fatalf("publish on corrupted staging path: %v", err)
+	}
+	expected := []string{
+		mount.FakeActionUnmount + " " + stagingPath,
+		mount.FakeActionMount + " " + stagingPath,
+		mount.FakeActionMount + " " + targetPath,
+	}
+	if actions := actionsSince(n); !reflect.DeepEqual(actions, expected) {
+		t.Errorf("got actions %v, expected %v", actions, expected)
+	}
+
+	// 文件系统挂载也损坏时先重新挂载文件系统
+	targetPath = filepath.Join(t.TempDir(), "target")
+	mounter.MountCheckErrors[stagingPath] = enotconn(stagingPath)
+	mounter.MountCheckErrors[sharedPath] = enotconn(sharedPath)
+	n = len(mounter.GetLog())
+	if err := publish(targetPath); err != nil {
+		t.Fatalf("publish on corrupted filesystem mount: %v", err)
+	}
+	expected = []string{
+		mount.FakeActionUnmount + " " + stagingPath,
+		mount.FakeActionUnmount + " " + sharedPath,
+		mount.FakeActionMount + " " + sharedPath,
+		mount.FakeActionMount + " " + stagingPath,
+		mount.FakeActionMount + " " + targetPath,
+	}
+	if actions := actionsSince(n); !reflect.DeepEqual(actions, expected) {
+		t.Errorf("got actions %v, expected %v", actions, expected)
+	}
+}
+
+// 文件系统挂载超时后 NodeStageVolume 返回错误，不会一直占用共享挂载的锁
+func TestSharedMountTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { mountTimeout = timeout }(mountTimeout)
+	mountTimeout = 10 * time.Millisecond
+
+	ns := initTestNode(t)
+	ns.Driver.NodeMountDir = t.TempDir()
+	m := &blockingMounter{FakeMounter: ns.Mount.(*mount.FakeMounter), unblock: make(chan struct{})}
+	defer close(m.unblock)
+	ns.Mount = m
+	vol := &Lustre{ServerName: testServer, SubDir: "a1"}
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          getVolumeIDFromLustreVol(vol),
+		StagingTargetPath: filepath.Join(t.TempDir(), "staging"),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := ns.NodeStageVolume(context.Background(), req)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected NodeStageVolume to fail when mounting times out")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("NodeStageVolume blocked on a hung mount")
+	}
+	if holders := ns.Driver.VolumeLocks.Holders(sharedMountLockKey(ns.getSharedMountPath(vol))); len(holders) != 0 {
+		t.Errorf("shared mount still locked by %v", holders)
+	}
+}
+
+// 检查超时的挂载直接卸载，清理过程不再访问挂起的挂载点
+func TestCleanupMountPointTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { mountCheckTimeout = timeout }(mountCheckTimeout)
+	mountCheckTimeout = 10 * time.Millisecond
+
+	ns := initTestNode(t)
+	m := &hangingMounter{FakeMounter: ns.Mount.(*mount.FakeMounter), unblock: make(chan struct{})}
+	defer close(m.unblock)
+	ns.Mount = m
+	targetPath := filepath.Join(t.TempDir(), "target")
+	if err := os.Mkdir(targetPath, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.FakeMounter.Mount("/mnt/testfs/a1", targetPath, "", []string{"bind"}); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- ns.cleanupMountPoint(targetPath) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("cleanupMountPoint: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cleanupMountPoint blocked on a hung mount")
+	}
+	if len(m.MountPoints) != 0 {
+		t.Errorf("hung mount not unmounted: %v", m.MountPoints)
+	}
+	if _, err := os.Stat(targetPath); !os.IsNotExist(err) {
+		t.Errorf("mount point not removed: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package lustre
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+const (
+	mountOptionReadOnly  = "ro"
+	mountOptionReadWrite = "rw"
+)
+
+// supportedMountOptions 为允许传给 Lustre 客户端挂载的选项
+var supportedMountOptions = map[string]bool{
+	mountOptionReadOnly:  true,
+	mountOptionReadWrite: true,
+	"flock":              true,
+	"localflock":         true,
+	"noflock":            true,
+	"user_xattr":         true,
+	"nouser_xattr":       true,
+	"user_fid2path":      true,
+	"nouser_fid2path":    true,
+	"acl":                true,
+	"noacl":              true,
+	"noatime":            true,
+	"relatime":           true,
+	"nodiratime":         true,
+	"lazystatfs":         true,
+	"nolazystatfs":       true,
+	"lruresize":          true,
+	"nolruresize":        true,
+	"checksum":           true,
+	"nochecksum":         true,
+	"always_ping":        true,
+	"noexec":             true,
+	"nosuid":             true,
+	"nodev":              true,
+}
+
+// parseMountOptions 合并 StorageClass mountOptions（MountFlags）和 mountOptions 参数，
+// 每一项都可以是逗号分隔的多个选项；返回去重排序后的选项，包含不支持的选项时返回错误
+func parseMountOptions(flags ...string) ([]string, error) {
+	seen := map[string]bool{}
+	var options []string
+	for _, flag := range flags {
+		for _, opt := range strings.Split(flag, ",") {
+			opt = strings.TrimSpace(opt)
+			if opt == "" || seen[opt] {
+				continue
+			}
+			if !supportedMountOptions[opt] {
+				return nil, fmt.Errorf("mount option %q is not supported", opt)
+			}
+			seen[opt] = true
+			options = append(options, opt)
+		}
+	}
+	if seen[mountOptionReadOnly] && seen[mountOptionReadWrite] {
+		return nil, fmt.Errorf("mount options %q and %q are mutually exclusive", mountOptionReadOnly, mountOptionReadWrite)
+	}
+	sort.Strings(options)
+	return options, nil
+}
+
+// getVolumeMountOptions 返回卷上下文中的 mountOptions 参数与卷能力中的 MountFlags 合并后的选项
+func getVolumeMountOptions(volumeContext map[string]string, mountFlags []string) ([]string, error) {
+	return parseMountOptions(append([]string{volumeContext[paramMountOptions]}, mountFlags...)...)
+}
+
+// clientMountOptions 去掉 ro/rw 后返回传给 Lustre 客户端的选项；只读通过 bind mount 实现，
+// 以便只读和读写的使用者共享同一个客户端挂载
+func clientMountOptions(options []string) []string {
+	var out []string
+	for _, opt := range options {
+		if opt != mountOptionReadOnly && opt != mountOptionReadWrite {
+			out = append(out, opt)
+		}
+	}
+	return out
+}
+
+// isReadOnlyAccessMode 判断卷能力的访问模式是否只读
+func isReadOnlyAccessMode(volCap *csi.VolumeCapability) bool {
+	switch volCap.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	}
+	return false
+}
+
+func hasMountOption(options []string, opt string) bool {
+	for _, o := range options {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
+
+// mountOptionsHash 返回客户端挂载选项的短哈希，用于区分同一文件系统不同选项的共享挂载
+func mountOptionsHash(options []string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(strings.Join(options, ",")))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
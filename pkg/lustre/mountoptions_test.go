@@ -0,0 +1,57 @@
+package lustre
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMountOptions(t *testing.T) {
+	testCases := []struct {
+		name     string
+		flags    []string
+		expected []string
+		wantErr  bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:     "comma separated and duplicated options",
+			flags:    []string{"flock, noatime", "", "flock", "user_xattr"},
+			expected: []string{"flock", "noatime", "user_xattr"},
+		},
+		{
+			name:    "unsupported option",
+			flags:   []string{"flock", "nfsvers=4"},
+			wantErr: true,
+		},
+		{
+			name:    "ro and rw",
+			flags:   []string{"ro", "rw"},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			options, err := parseMountOptions(test.flags...)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got err %v, wantErr %v", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(options, test.expected) {
+				t.Errorf("got %v, expected %v", options, test.expected)
+			}
+		})
+	}
+}
+
+func TestClientMountOptions(t *testing.T) {
+	options := clientMountOptions([]string{"flock", "ro", "rw", "user_xattr"})
+	if expected := []string{"flock", "user_xattr"}; !reflect.DeepEqual(options, expected) {
+		t.Errorf("got %v, expected %v", options, expected)
+	}
+	if mountOptionsHash([]string{"flock"}) == mountOptionsHash([]string{"localflock"}) {
+		t.Errorf("expected different hashes for different options")
+	}
+}
@@ -4,12 +4,16 @@ import (
 	"context"
 	"fmt"
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
 	"k8s.io/mount-utils"
 	"log"
 	"os"
+	"path/filepath"
+	azcache "sigs.k8s.io/cloud-provider-azure/pkg/cache"
+	"strings"
 )
 
 const VolumeOperationAlreadyExists = "An operation with the given volume=%q and target=%q is already in progress"
@@ -20,20 +24,140 @@ type NodeServer struct {
 	Mount  mount.Interface
 }
 
-// NodeStageVolume prepares the volume to be published. For Lustre, this might not require any special staging.
+// NodeStageVolume mounts the Lustre filesystem once per node under the node mount dir and bind mounts the
+// volume subdirectory to the staging path, so that all volumes of the same filesystem share one client mount.
 func (ns *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	klog.V(4).InfoS("NodeStageVolume called", "volumeId", req.GetVolumeId())
-	// No special staging needed for Lustre, just return success
+	klog.V(4).InfoS("NodeStageVolume called", "volumeId", req.GetVolumeId(), "stagingTargetPath", req.GetStagingTargetPath())
+
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
+	}
+	stagingPath := req.GetStagingTargetPath()
+	if len(stagingPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path not provided")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability not provided")
+	}
+	release, err := ns.Driver.lockVolume(ctx, volumeID, "NodeStageVolume", LockExclusive)
+	if err != nil {
+		return nil, status.Errorf(codes.Aborted, VolumeOperationAlreadyExists+": %v", volumeID, stagingPath, err)
+	}
+	defer release()
+
+	lustre, err := getLustreVolFromRequest(volumeID, req.GetVolumeContext())
+	if err != nil {
+		return nil, err
+	}
+	if lustre.MountOptions, err = getVolumeMountOptions(req.GetVolumeContext(), req.GetVolumeCapability().GetMount().GetMountFlags()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err := ns.stageVolume(ctx, volumeID, lustre, stagingPath, isReadOnlyAccessMode(req.GetVolumeCapability())); err != nil {
+		return nil, err
+	}
+
+	klog.V(5).InfoS("NodeStageVolume successful", "volumeId", volumeID, "stagingTargetPath", stagingPath)
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
-// NodeUnstageVolume removes the staged volume. This can be used to clean up staged resources.
+// stageVolume bind mounts the subdirectory of the volume from the shared filesystem mount to the staging path,
+// mounting the filesystem first if needed. It does nothing when the staging path is already mounted.
+func (ns *NodeServer) stageVolume(ctx context.Context, volumeID string, lustre *Lustre, stagingPath string, readOnly bool) error {
+	mounted, err := ns.prepareMountPoint(stagingPath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "could not prepare staging path %s: %v", stagingPath, err)
+	}
+	if mounted {
+		klog.V(5).InfoS("Volume is already staged", "stagingTargetPath", stagingPath)
+		return nil
+	}
+
+	release, err := ns.lockSharedMount(ctx, ns.getSharedMountPath(lustre), "NodeStageVolume")
+	if err != nil {
+		return status.Error(codes.Aborted, err.Error())
+	}
+	err = ns.bindSharedSubDir(volumeID, lustre, stagingPath, readOnly)
+	release()
+	if err != nil {
+		// the shared mount is only released after its lock is dropped
+		ns.cleanupSharedMounts()
+		return err
+	}
+	return nil
+}
+
+// bindSharedSubDir mounts the shared filesystem and bind mounts the volume subdirectory to the staging path.
+// The caller holds the lock of the shared mount, so it is not released between the two mounts.
+func (ns *NodeServer) bindSharedSubDir(volumeID string, lustre *Lustre, stagingPath string, readOnly bool) error {
+	sharedPath, err := ns.mountSharedFs(lustre)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to mount %s: %v", lustre.ServerName, err)
+	}
+
+	source := filepath.Join(sharedPath, lustre.SubDir)
+	if _, err := os.Stat(source); err != nil {
+		if os.IsNotExist(err) {
+			return status.Errorf(codes.NotFound, "subdirectory %s of volume %s not found", lustre.SubDir, volumeID)
+		}
+		return status.Errorf(codes.Internal, "failed to stat %s: %v", source, err)
+	}
+
+	klog.V(5).InfoS("Bind mounting volume subdirectory", "source", source, "stagingTargetPath", stagingPath)
+	if err := ns.bindMount(source, stagingPath, readOnly); err != nil {
+		return status.Errorf(codes.Internal, "failed to bind mount %s at %s: %v", source, stagingPath, err)
+	}
+	return nil
+}
+
+// restageCorruptedVolume stages the volume again when the staging path is a corrupted mount. Publishing the volume
+// only holds a shared lock of it, so concurrent publishes of the same volume are serialized on the staging path.
+func (ns *NodeServer) restageCorruptedVolume(ctx context.Context, volumeID string, lustre *Lustre, stagingPath string, readOnly bool) error {
+	_, err := isLikelyNotMountPointWithTimeout(ns.Mount, stagingPath, mountCheckTimeout)
+	if !isCorruptedMount(err) {
+		return nil
+	}
+	release, err := ns.Driver.lockVolume(ctx, volumeOperationKey(volumeID, stagingPath), "NodePublishVolume", LockExclusive)
+	if err != nil {
+		return status.Errorf(codes.Aborted, VolumeOperationAlreadyExists+": %v", volumeID, stagingPath, err)
+	}
+	defer release()
+
+	klog.Warningf("staging path %s of volume %s is corrupted, staging it again", stagingPath, volumeID)
+	return ns.stageVolume(ctx, volumeID, lustre, stagingPath, readOnly)
+}
+
+// NodeUnstageVolume unmounts the staging path and releases the shared filesystem mount once no volume uses it.
 func (ns *NodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	klog.V(5).InfoS("NodeUnstageVolume called", "volumeId", req.GetVolumeId())
+	klog.V(5).InfoS("NodeUnstageVolume called", "volumeId", req.GetVolumeId(), "stagingTargetPath", req.GetStagingTargetPath())
+
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
+	}
+	stagingPath := req.GetStagingTargetPath()
+	if len(stagingPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path not provided")
+	}
+	release, err := ns.Driver.lockVolume(ctx, volumeID, "NodeUnstageVolume", LockExclusive)
+	if err != nil {
+		return nil, status.Errorf(codes.Aborted, VolumeOperationAlreadyExists+": %v", volumeID, stagingPath, err)
+	}
+	defer release()
+
+	if err := ns.cleanupMountPoint(stagingPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unmount staging path %s: %v", stagingPath, err)
+	}
+	if err := ns.cleanupSharedMounts(); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to release shared mounts: %v", err)
+	}
+
+	klog.V(5).InfoS("NodeUnstageVolume successful", "volumeId", volumeID, "stagingTargetPath", stagingPath)
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
-// NodePublishVolume mounts the Lustre volume to the target path on the node.
+// NodePublishVolume bind mounts the staged volume to the target path of the pod.
 func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	klog.V(5).InfoS("NodePublishVolume called", "volumeId", req.GetVolumeId(), "targetPath", req.GetTargetPath())
 
@@ -44,90 +168,227 @@ func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	if len(req.GetTargetPath()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Target path not provided")
 	}
+	ephemeral := isEphemeralVolume(req.GetVolumeContext())
+	stagingPath := req.GetStagingTargetPath()
+	if len(stagingPath) == 0 && !ephemeral {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path not provided")
+	}
 	if req.GetVolumeCapability() == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume capability not provided")
 	}
+	if group := req.GetVolumeCapability().GetMount().GetVolumeMountGroup(); group != "" {
+		if _, err := parseOwnerId("volume mount group", group); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
 	log.Println("targetPath:", req.GetTargetPath())
 	log.Println("volumeId:", req.VolumeId)
-	// 处理 ReadOnly 的情况
-	readOnly := req.GetReadonly()
-
-	// 获取卷的上下文，比如 Lustre 文件系统需要的 servername 和 mountname
-	volumeContext := req.GetVolumeContext()
-	serverName, ok := volumeContext["server"]
-	if !ok || len(serverName) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "servername not provided in volume context")
+	release, err := ns.Driver.lockVolumePath(ctx, req.GetVolumeId(), req.GetTargetPath(), "NodePublishVolume")
+	if err != nil {
+		return nil, status.Errorf(codes.Aborted, VolumeOperationAlreadyExists+": %v", req.GetVolumeId(), req.GetTargetPath(), err)
+	}
+	defer release()
+	// 内联卷没有 stage 阶段，直接在文件系统中创建临时目录并发布
+	if ephemeral {
+		return ns.publishEphemeralVolume(ctx, req)
+	}
+	// 校验卷 ID（或静态 PV 的卷上下文）
+	lustre, err := getLustreVolFromRequest(req.GetVolumeId(), req.GetVolumeContext())
+	if err != nil {
+		return nil, err
 	}
-	subName, ok := volumeContext["subdir"]
-	if !ok || len(subName) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "subName not provided in volume context")
+	mountOptions, err := getVolumeMountOptions(req.GetVolumeContext(), req.GetVolumeCapability().GetMount().GetMountFlags())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
-	source := ""
-	if subName != "" {
-		source = fmt.Sprintf("%s/%s", serverName, subName)
+	lustre.MountOptions = mountOptions
+	// 处理 ReadOnly 的情况：请求的 readonly、只读访问模式或 ro 挂载选项都只影响该 Pod 的 bind mount
+	readOnly := req.GetReadonly() || isReadOnlyAccessMode(req.GetVolumeCapability()) || hasMountOption(mountOptions, mountOptionReadOnly)
+	dirMode, err := ns.Driver.getMountPermissions(req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
 	targetPath := req.GetTargetPath()
 
-	// 创建目标路径，如果它不存在
-	if err := os.MkdirAll(targetPath, 0755); err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to create target path %s: %v", targetPath, err)
+	// staging 路径的 bind mount 或其来源的文件系统挂载损坏时（例如客户端被驱逐）重新 stage，
+	// 否则会把损坏的挂载 bind 到 Pod。kubelet 认为卷已经 stage 过，不会再调用 NodeStageVolume
+	if err := ns.restageCorruptedVolume(ctx, req.GetVolumeId(), lustre, stagingPath, isReadOnlyAccessMode(req.GetVolumeCapability())); err != nil {
+		return nil, err
 	}
-	// 检查目标路径是否已经挂载
-	notMnt, err := ns.Mount.IsLikelyNotMountPoint(targetPath)
-	if err != nil && !os.IsNotExist(err) {
+
+	// 检查目标路径是否已经挂载，损坏的挂载（例如客户端被驱逐）会先被卸载再重新挂载
+	mounted, err := ns.checkMountPoint(targetPath)
+	if err != nil {
 		return nil, status.Errorf(codes.Internal, "could not determine if %s is a mount point: %v", targetPath, err)
 	}
-	if !notMnt {
+	if mounted {
 		klog.V(5).InfoS("Volume is already mounted", "targetPath", targetPath)
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
-
-	// 挂载选项
-	mountOptions := []string{}
-	if readOnly {
-		mountOptions = append(mountOptions, "ro")
+	// 创建目标路径，如果它不存在
+	if err := os.MkdirAll(targetPath, dirMode); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create target path %s: %v", targetPath, err)
 	}
 
 	// 执行挂载操作
-	klog.V(5).InfoS("Mounting volume", "source", source, "targetPath", targetPath, "options", mountOptions)
-	err = ns.Mount.Mount(source, targetPath, "lustre", mountOptions)
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to mount %s at %s: %v", serverName, targetPath, err)
+	klog.V(5).InfoS("Mounting volume", "source", stagingPath, "targetPath", targetPath, "readOnly", readOnly)
+	if err := ns.bindMount(stagingPath, targetPath, readOnly); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to mount %s at %s: %v", stagingPath, targetPath, err)
+	}
+	if err := ns.applyVolumeMountGroup(targetPath, req.GetVolumeCapability(), readOnly); err != nil {
+		return nil, err
 	}
 
 	klog.V(5).InfoS("NodePublishVolume successful", "volumeId", req.GetVolumeId(), "targetPath", targetPath)
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
-// NodeUnpublishVolume unmounts the Lustre volume from the target path.
+// NodeUnpublishVolume unmounts the Lustre volume from the target path and removes the mount point. It succeeds
+// when the target path is already unmounted or removed, so that kubelet can retry it safely.
 func (ns *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
 	klog.V(5).InfoS("NodeUnpublishVolume called", "volumeId", req.GetVolumeId(), "targetPath", req.GetTargetPath())
 
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
+	}
 	targetPath := req.GetTargetPath()
-
-	// 检查目标路径是否已经挂载
-	notMnt, err := ns.Mount.IsLikelyNotMountPoint(targetPath)
+	if len(targetPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Target path not provided")
+	}
+	release, err := ns.Driver.lockVolumePath(ctx, volumeID, targetPath, "NodeUnpublishVolume")
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to check if targetPath %s is a mount point: %v", targetPath, err)
+		return nil, status.Errorf(codes.Aborted, VolumeOperationAlreadyExists+": %v", volumeID, targetPath, err)
 	}
-	if notMnt {
-		klog.V(5).InfoS("Volume is not mounted", "targetPath", targetPath)
-		return &csi.NodeUnpublishVolumeResponse{}, nil
+	defer release()
+
+	// 本节点创建的内联卷在卸载后删除临时目录，记录不存在时按普通卷处理
+	ephemeralVol, err := ns.readEphemeralVolume(volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read state of ephemeral volume %s: %v", volumeID, err)
 	}
 
-	// 卸载卷
-	if err := ns.Mount.Unmount(targetPath); err != nil {
+	// 卸载卷并删除挂载点目录，目标路径不存在或未挂载时同样成功；损坏或检查超时的挂载直接强制或 lazy 卸载，
+	// 避免阻塞在挂起的 Lustre 客户端上
+	if err := ns.cleanupMountPoint(targetPath); err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to unmount targetPath %s: %v", targetPath, err)
 	}
+	if ephemeralVol != nil {
+		if err := ns.deleteEphemeralVolume(ctx, ephemeralVol); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to delete ephemeral volume %s: %v", volumeID, err)
+		}
+	}
 
-	klog.V(5).InfoS("NodeUnpublishVolume successful", "volumeId", req.GetVolumeId(), "targetPath", targetPath)
+	klog.V(5).InfoS("NodeUnpublishVolume successful", "volumeId", volumeID, "targetPath", targetPath)
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
-// NodeGetVolumeStats returns volume usage statistics (not typically applicable for Lustre).
+// NodeGetVolumeStats returns bytes and inodes usage of the published path. Volumes backed by a project quota
+// report the quota limits and usage, other volumes report the statfs result of the whole filesystem.
 func (ns *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "NodeGetVolumeStats is not implemented")
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
+	}
+	volumePath := req.GetVolumePath()
+	if len(volumePath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume path not provided")
+	}
+
+	// 使用缓存避免 kubelet 周期性查询时频繁访问 MDS
+	cacheKey := volumeID + "/" + volumePath
+	if ns.Driver.VolStatsCache != nil {
+		if cache, err := ns.Driver.VolStatsCache.Get(cacheKey, azcache.CacheReadTypeDefault); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to get volume stats cache: %v", err)
+		} else if cache != nil {
+			klog.V(6).InfoS("NodeGetVolumeStats: return stats from cache", "volumeId", volumeID, "volumePath", volumePath)
+			return cache.(*csi.NodeGetVolumeStatsResponse), nil
+		}
+	}
+
+	if _, err := os.Stat(volumePath); err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "path %s does not exist", volumePath)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to stat file %s: %v", volumePath, err)
+	}
+
+	resp, err := ns.getVolumeStats(ctx, volumePath)
+	if err != nil {
+		return nil, err
+	}
+	if ns.Driver.VolStatsCache != nil {
+		ns.Driver.VolStatsCache.Set(cacheKey, resp)
+	}
+	return resp, nil
+}
+
+func (ns *NodeServer) getVolumeStats(ctx context.Context, volumePath string) (*csi.NodeGetVolumeStatsResponse, error) {
+	var statfs unix.Statfs_t
+	if err := unix.Statfs(volumePath, &statfs); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to statfs %s: %v", volumePath, err)
+	}
+	bsize := uint64(statfs.Bsize)
+	bytes := &csi.VolumeUsage{
+		Unit:      csi.VolumeUsage_BYTES,
+		Total:     int64(statfs.Blocks * bsize),
+		Used:      int64((statfs.Blocks - statfs.Bfree) * bsize),
+		Available: int64(statfs.Bavail * bsize),
+	}
+	inodes := &csi.VolumeUsage{
+		Unit:      csi.VolumeUsage_INODES,
+		Total:     int64(statfs.Files),
+		Used:      int64(statfs.Files - statfs.Ffree),
+		Available: int64(statfs.Ffree),
+	}
+
+	if quota := ns.getVolumeProjectQuota(ctx, volumePath); quota != nil {
+		if quota.BlockHardLimitKB > 0 {
+			bytes = newQuotaUsage(csi.VolumeUsage_BYTES, quota.BlockHardLimitKB*1024, quota.BlocksUsedKB*1024)
+		}
+		if quota.InodeHardLimit > 0 {
+			inodes = newQuotaUsage(csi.VolumeUsage_INODES, quota.InodeHardLimit, quota.InodesUsed)
+		}
+	}
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{bytes, inodes},
+	}, nil
+}
+
+// getVolumeProjectQuota 返回卷目录所属项目的配额，未设置项目 ID 或 lfs 不可用时返回 nil
+func (ns *NodeServer) getVolumeProjectQuota(ctx context.Context, volumePath string) *projectQuota {
+	if ns.Driver.Runner == nil {
+		return nil
+	}
+	projectId, err := getDirProjectId(ctx, ns.Driver.Runner, volumePath)
+	if err != nil {
+		klog.Warningf("failed to get project id of %s, fall back to statfs: %v", volumePath, err)
+		return nil
+	}
+	if projectId == 0 {
+		return nil
+	}
+	quota, err := getProjectQuota(ctx, ns.Driver.Runner, volumePath, projectId)
+	if err != nil {
+		klog.Warningf("failed to get quota of project %d, fall back to statfs: %v", projectId, err)
+		return nil
+	}
+	return quota
+}
+
+func newQuotaUsage(unit csi.VolumeUsage_Unit, limit, used uint64) *csi.VolumeUsage {
+	available := int64(0)
+	if limit > used {
+		available = int64(limit - used)
+	}
+	return &csi.VolumeUsage{
+		Unit:      unit,
+		Total:     int64(limit),
+		Used:      int64(used),
+		Available: available,
+	}
 }
 
 // NodeExpandVolume expands the volume if possible (Lustre doesn't typically support expansion at the node level).
@@ -137,17 +398,8 @@ func (ns *NodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandV
 
 // NodeGetCapabilities returns the supported capabilities of the node.
 func (ns *NodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
-	capabilities := []*csi.NodeServiceCapability{
-		{
-			Type: &csi.NodeServiceCapability_Rpc{
-				Rpc: &csi.NodeServiceCapability_RPC{
-					Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
-				},
-			},
-		},
-	}
 	return &csi.NodeGetCapabilitiesResponse{
-		Capabilities: capabilities,
+		Capabilities: ns.Driver.Nscap,
 	}, nil
 }
 
@@ -157,3 +409,154 @@ func (ns *NodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoReque
 		NodeId: ns.Driver.NodeId,
 	}, nil
 }
+
+// bindMount bind mounts source to target. A read only bind is made by mount-utils as a bind mount followed by a
+// MS_BIND|MS_REMOUNT|MS_RDONLY remount, which only affects the new mount, so read only and read write consumers
+// of a volume keep sharing the same Lustre client mount.
+func (ns *NodeServer) bindMount(source, target string, readOnly bool) error {
+	options := []string{"bind"}
+	if readOnly {
+		options = append(options, mountOptionReadOnly)
+	}
+	return ns.Mount.Mount(source, target, "", options)
+}
+
+// applyVolumeMountGroup sets the group of the published volume to the VolumeMountGroup (the fsGroup of the pod)
+// requested by kubelet. Read only volumes are left untouched. The target is unmounted on failure so that the
+// retried NodePublishVolume applies the group again.
+func (ns *NodeServer) applyVolumeMountGroup(targetPath string, volCap *csi.VolumeCapability, readOnly bool) error {
+	group := volCap.GetMount().GetVolumeMountGroup()
+	if group == "" || readOnly {
+		return nil
+	}
+	klog.V(5).InfoS("Setting volume mount group", "targetPath", targetPath, "group", group)
+	if err := setVolumeMountGroup(targetPath, group); err != nil {
+		if unmountErr := ns.Mount.Unmount(targetPath); unmountErr != nil {
+			klog.Warningf("failed to unmount %s: %v", targetPath, unmountErr)
+		}
+		return status.Errorf(codes.Internal, "failed to set volume mount group %s on %s: %v", group, targetPath, err)
+	}
+	return nil
+}
+
+// prepareMountPoint creates the mount point if needed and reports whether it is already mounted. A corrupted
+// mount point is unmounted first so that the caller mounts it again.
+func (ns *NodeServer) prepareMountPoint(path string) (bool, error) {
+	mounted, err := ns.checkMountPoint(path)
+	if err != nil || mounted {
+		return mounted, err
+	}
+	return false, os.MkdirAll(path, 0750)
+}
+
+// getSharedMountPath returns where the filesystem of the volume is mounted on this node. Volumes with
+// different client mount options get separate mounts of the same filesystem. The name includes a hash of the
+// full server string, so filesystems with the same name behind different MGS NIDs are never shared.
+func (ns *NodeServer) getSharedMountPath(l *Lustre) string {
+	name := getServerMountName(l.ServerName)
+	if options := clientMountOptions(l.MountOptions); len(options) > 0 {
+		name += "-" + mountOptionsHash(options)
+	}
+	return filepath.Join(ns.Driver.NodeMountDir, name)
+}
+
+// lockSharedMount locks a shared filesystem mount until it is used by a bind mount or released. Operations on
+// different filesystems, or on the same filesystem with other client options, do not wait for each other.
+func (ns *NodeServer) lockSharedMount(ctx context.Context, sharedPath, owner string) (func(), error) {
+	key := sharedMountLockKey(sharedPath)
+	release, err := ns.Driver.VolumeLocks.Lock(ctx, key, owner, LockExclusive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock shared mount %s held by %s: %v", sharedPath, ns.Driver.VolumeLocks.describeHolders(key), err)
+	}
+	return release, nil
+}
+
+// mountSharedFs mounts the filesystem of the volume under the node mount dir unless it is already mounted.
+// The caller must hold the lock of the shared mount.
+func (ns *NodeServer) mountSharedFs(l *Lustre) (string, error) {
+	sharedPath := ns.getSharedMountPath(l)
+	mounted, err := ns.prepareMountPoint(sharedPath)
+	if err != nil {
+		return "", err
+	}
+	if mounted {
+		return sharedPath, nil
+	}
+	options := clientMountOptions(l.MountOptions)
+	klog.V(2).InfoS("Mounting lustre filesystem", "server", l.ServerName, "path", sharedPath, "options", options)
+	if err := mountWithTimeout(ns.Mount, l.ServerName, sharedPath, "lustre", options, mountTimeout); err != nil {
+		return "", err
+	}
+	return sharedPath, nil
+}
+
+// cleanupSharedMounts unmounts the shared filesystem mounts that are no longer referenced by any bind mount.
+// References are counted from the mount table, so the result survives plugin restarts. Shared mounts locked by
+// another operation are in use and skipped.
+func (ns *NodeServer) cleanupSharedMounts() error {
+	entries, err := os.ReadDir(ns.Driver.NodeMountDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	nodeMountDir := filepath.Clean(ns.Driver.NodeMountDir)
+	for _, entry := range entries {
+		if err := ns.releaseSharedMount(filepath.Join(nodeMountDir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseSharedMount unmounts the shared mount unless it is locked or still referenced by a bind mount.
+func (ns *NodeServer) releaseSharedMount(sharedPath string) error {
+	release, ok := ns.Driver.VolumeLocks.TryLock(sharedMountLockKey(sharedPath), "cleanupSharedMounts", LockExclusive)
+	if !ok {
+		klog.V(5).InfoS("Shared mount is locked by another operation", "path", sharedPath)
+		return nil
+	}
+	defer release()
+
+	// the mount table is read under the lock, so a bind mount made by a concurrent stage is always counted
+	mountPoints, err := ns.Mount.List()
+	if err != nil {
+		return err
+	}
+	device := ""
+	for _, mp := range mountPoints {
+		if mp.Path == sharedPath {
+			device = mp.Device
+		}
+	}
+	if device == "" {
+		return nil
+	}
+	nodeMountDir := filepath.Dir(sharedPath)
+	refs := 0
+	for _, mp := range mountPoints {
+		// Shared mounts of the same filesystem with other client options show the same device, they are
+		// not users of each other. Only bind mounts outside the node mount dir count as references.
+		if strings.HasPrefix(mp.Path, nodeMountDir+"/") {
+			continue
+		}
+		// bind mounts of a lustre subdirectory show the filesystem as device
+		if mp.Device == device || strings.HasPrefix(mp.Device, sharedPath+"/") {
+			refs++
+		}
+	}
+	if refs > 0 {
+		klog.V(5).InfoS("Shared mount still in use", "path", sharedPath, "refs", refs)
+		return nil
+	}
+	klog.V(2).InfoS("Unmounting unused lustre filesystem", "path", sharedPath)
+	if err := ns.unmount(sharedPath); err != nil {
+		return err
+	}
+	if err := os.Remove(sharedPath); err != nil {
+		klog.Warningf("failed to remove shared mount point %s: %v", sharedPath, err)
+	}
+	return nil
+}
@@ -5,13 +5,22 @@ import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/mount-utils"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func initTestNode(_ *testing.T) *NodeServer {
 	nodeserver := &NodeServer{
-		Driver: new(Driver),
+		Driver: NewDriver(&DriverOptions{DriverName: DefaultDriverName}),
+		Mount:  mount.NewFakeMounter([]mount.MountPoint{}),
 	}
+	nodeserver.Driver.Runner = newFakeCommandRunner()
 	return nodeserver
 }
 
@@ -22,32 +31,687 @@ func TestNodeServer_NodePublishVolume(t *testing.T) {
 		paramBaseDir: "/mnt/testfs",
 		paramSubDir:  "a1",
 	}
+	withParam := func(key, val string) map[string]string {
+		m := map[string]string{key: val}
+		for k, v := range params {
+			m[k] = v
+		}
+		return m
+	}
 
-	volumeCap := csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}
+	stagingPath := t.TempDir()
+	accessMode := &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}
+	mountCap := func(group string) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{VolumeMountGroup: group}},
+			AccessMode: accessMode,
+		}
+	}
+	gid := strconv.Itoa(os.Getgid())
 
 	tests := []struct {
 		desc          string
-		setup         func()
-		req           csi.NodePublishVolumeRequest
-		skipOnWindows bool
-		expectedErr   error
-		cleanup       func()
+		volumeContext map[string]string
+		volumeCap     *csi.VolumeCapability
+		readOnly      bool
+		expectedCode  codes.Code
+		// expectedMode 为发布成功后目标路径的权限，为 0 时不检查
+		expectedMode os.FileMode
 	}{
 		{
-			desc: "[Error] invalid mountPermissions",
-			req: csi.NodePublishVolumeRequest{
-				VolumeContext:    params,
-				VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap},
-				VolumeId:         "vol_1",
-				TargetPath:       "/var/lib/test",
-				Readonly:         true},
-			expectedErr: status.Error(codes.InvalidArgument, "invalid mountPermissions 07ab"),
+			desc:          "[Error] invalid mountPermissions",
+			volumeContext: withParam(paramMountPermissions, "07ab"),
+			volumeCap:     mountCap(""),
+			readOnly:      true,
+			expectedCode:  codes.InvalidArgument,
+		},
+		{
+			desc:          "[Error] invalid volume mount group",
+			volumeContext: params,
+			volumeCap:     mountCap("staff"),
+			expectedCode:  codes.InvalidArgument,
+		},
+		{
+			desc:          "[Success] mountPermissions applied to the created target path",
+			volumeContext: withParam(paramMountPermissions, "0750"),
+			volumeCap:     mountCap(""),
+			expectedMode:  os.ModeDir | 0750,
+		},
+		{
+			desc:          "[Success] volume mount group grants group access",
+			volumeContext: withParam(paramMountPermissions, "0700"),
+			volumeCap:     mountCap(gid),
+			expectedMode:  os.ModeDir | os.ModeSetgid | 0770,
+		},
+		{
+			desc:          "[Success] volume mount group ignored for read only volumes",
+			volumeContext: withParam(paramMountPermissions, "0700"),
+			volumeCap:     mountCap(gid),
+			readOnly:      true,
+			expectedMode:  os.ModeDir | 0700,
 		},
 	}
 
 	for _, tc := range tests {
 		ns := initTestNode(t)
-		ns.NodePublishVolume(context.Background(), &tc.req)
+		targetPath := filepath.Join(t.TempDir(), "target")
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:          "vol_1",
+			VolumeContext:     tc.volumeContext,
+			VolumeCapability:  tc.volumeCap,
+			StagingTargetPath: stagingPath,
+			TargetPath:        targetPath,
+			Readonly:          tc.readOnly,
+		})
+		if status.Code(err) != tc.expectedCode {
+			t.Errorf("%s: got err %v, expected code %v", tc.desc, err, tc.expectedCode)
+			continue
+		}
+		if tc.expectedMode == 0 {
+			continue
+		}
+		st, err := os.Stat(targetPath)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.desc, err)
+		}
+		if st.Mode() != tc.expectedMode {
+			t.Errorf("%s: got mode %v, expected %v", tc.desc, st.Mode(), tc.expectedMode)
+		}
+	}
+}
+
+func TestNodeUnpublishVolume(t *testing.T) {
+	const volumeID = "vol_1"
+	tests := []struct {
+		desc string
+		// setup 准备目标路径，返回请求中的目标路径
+		setup        func(t *testing.T, mounter *mount.FakeMounter) string
+		volumeID     string
+		expectedCode codes.Code
+		// removed 表示目标路径在请求成功后应已被删除
+		removed bool
+	}{
+		{
+			desc:         "[Error] volume ID missing",
+			setup:        func(t *testing.T, _ *mount.FakeMounter) string { return t.TempDir() },
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			desc:         "[Error] target path missing",
+			setup:        func(*testing.T, *mount.FakeMounter) string { return "" },
+			volumeID:     volumeID,
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			desc:     "[Success] target path does not exist",
+			setup:    func(t *testing.T, _ *mount.FakeMounter) string { return filepath.Join(t.TempDir(), "target") },
+			volumeID: volumeID,
+			removed:  true,
+		},
+		{
+			desc: "[Success] target path not mounted",
+			setup: func(t *testing.T, _ *mount.FakeMounter) string {
+				target := filepath.Join(t.TempDir(), "target")
+				if err := os.MkdirAll(target, 0750); err != nil {
+					t.Fatal(err)
+				}
+				return target
+			},
+			volumeID: volumeID,
+			removed:  true,
+		},
+		{
+			desc: "[Success] target path mounted",
+			setup: func(t *testing.T, mounter *mount.FakeMounter) string {
+				target := filepath.Join(t.TempDir(), "target")
+				if err := os.MkdirAll(target, 0750); err != nil {
+					t.Fatal(err)
+				}
+				mounter.MountPoints = append(mounter.MountPoints, mount.MountPoint{Device: "/staging", Path: target})
+				return target
+			},
+			volumeID: volumeID,
+			removed:  true,
+		},
+		{
+			desc: "[Success] corrupted mount",
+			setup: func(t *testing.T, mounter *mount.FakeMounter) string {
+				target := filepath.Join(t.TempDir(), "target")
+				if err := os.MkdirAll(target, 0750); err != nil {
+					t.Fatal(err)
+				}
+				mounter.MountPoints = append(mounter.MountPoints, mount.MountPoint{Device: "/staging", Path: target})
+				mounter.MountCheckErrors = map[string]error{target: &os.PathError{Op: "stat", Path: target, Err: syscall.ESTALE}}
+				return target
+			},
+			volumeID: volumeID,
+			removed:  true,
+		},
+		{
+			desc: "[Error] unmount failed",
+			setup: func(t *testing.T, mounter *mount.FakeMounter) string {
+				target := filepath.Join(t.TempDir(), "target")
+				if err := os.MkdirAll(target, 0750); err != nil {
+					t.Fatal(err)
+				}
+				mounter.MountPoints = append(mounter.MountPoints, mount.MountPoint{Device: "/staging", Path: target})
+				mounter.UnmountFunc = func(string) error { return syscall.EBUSY }
+				return target
+			},
+			volumeID:     volumeID,
+			expectedCode: codes.Internal,
+		},
+	}
+
+	for _, tc := range tests {
+		ns := initTestNode(t)
+		mounter := ns.Mount.(*mount.FakeMounter)
+		target := tc.setup(t, mounter)
+		_, err := ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: tc.volumeID, TargetPath: target})
+		if status.Code(err) != tc.expectedCode {
+			t.Errorf("%s: got err %v, expected code %v", tc.desc, err, tc.expectedCode)
+			continue
+		}
+		if !tc.removed {
+			continue
+		}
+		if _, err := os.Stat(target); !os.IsNotExist(err) {
+			t.Errorf("%s: target path %s not removed: %v", tc.desc, target, err)
+		}
+		if mountPoints, _ := mounter.List(); len(mountPoints) != 0 {
+			t.Errorf("%s: unexpected mount points %v", tc.desc, mountPoints)
+		}
+	}
+}
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	volumePath := t.TempDir()
+
+	tests := []struct {
+		desc          string
+		req           *csi.NodeGetVolumeStatsRequest
+		projectOutput string
+		quotaOutput   string
+		expectedCode  codes.Code
+		expectedBytes *csi.VolumeUsage
+		expectedInode *csi.VolumeUsage
+	}{
+		{
+			desc:         "[Error] volume id missing",
+			req:          &csi.NodeGetVolumeStatsRequest{VolumePath: volumePath},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			desc:         "[Error] volume path missing",
+			req:          &csi.NodeGetVolumeStatsRequest{VolumeId: "vol_1"},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			desc:         "[Error] volume path does not exist",
+			req:          &csi.NodeGetVolumeStatsRequest{VolumeId: "vol_1", VolumePath: filepath.Join(volumePath, "missing")},
+			expectedCode: codes.NotFound,
+		},
+		{
+			desc:          "[Success] statfs without project quota",
+			req:           &csi.NodeGetVolumeStatsRequest{VolumeId: "vol_1", VolumePath: volumePath},
+			projectOutput: "       0 - " + volumePath,
+		},
+		{
+			desc:          "[Success] project quota",
+			req:           &csi.NodeGetVolumeStatsRequest{VolumeId: "vol_1", VolumePath: volumePath},
+			projectOutput: "    1000 P " + volumePath,
+			quotaOutput:   volumePath + " 4 0 1048576 - 10 0 100 -",
+			expectedBytes: &csi.VolumeUsage{Unit: csi.VolumeUsage_BYTES, Total: 1 << 30, Used: 4096, Available: 1<<30 - 4096},
+			expectedInode: &csi.VolumeUsage{Unit: csi.VolumeUsage_INODES, Total: 100, Used: 10, Available: 90},
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.desc, func(t *testing.T) {
+			ns := initTestNode(t)
+			runner := ns.Driver.Runner.(*fakeCommandRunner)
+			runner.outputs["lfs project -d "+volumePath] = tc.projectOutput
+			runner.outputs["lfs quota -q -p 1000 "+volumePath] = tc.quotaOutput
+
+			resp, err := ns.NodeGetVolumeStats(context.Background(), tc.req)
+			if status.Code(err) != tc.expectedCode {
+				t.Fatalf("got err %v, expected code %v", err, tc.expectedCode)
+			}
+			if err != nil {
+				return
+			}
+			if len(resp.Usage) != 2 || resp.Usage[0].Unit != csi.VolumeUsage_BYTES || resp.Usage[1].Unit != csi.VolumeUsage_INODES {
+				t.Fatalf("unexpected usage %v", resp.Usage)
+			}
+			if tc.expectedBytes != nil && !reflect.DeepEqual(resp.Usage[0], tc.expectedBytes) {
+				t.Errorf("got bytes usage %v, expected %v", resp.Usage[0], tc.expectedBytes)
+			}
+			if tc.expectedInode != nil && !reflect.DeepEqual(resp.Usage[1], tc.expectedInode) {
+				t.Errorf("got inodes usage %v, expected %v", resp.Usage[1], tc.expectedInode)
+			}
+
+			// 第二次查询应命中缓存，不再执行 lfs 命令
+			calls := len(runner.Calls())
+			cached, err := ns.NodeGetVolumeStats(context.Background(), tc.req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cached != resp || len(runner.Calls()) != calls {
+				t.Errorf("expected stats to be served from cache")
+			}
+		})
+	}
+}
+
+func TestNodeStageUnstageVolume(t *testing.T) {
+	ns := initTestNode(t)
+	ns.Driver.NodeMountDir = t.TempDir()
+	mounter := ns.Mount.(*mount.FakeMounter)
+	volumeCap := &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}}
+
+	vol1 := &Lustre{ServerName: testServer, SubDir: "a1"}
+	vol2 := &Lustre{ServerName: testServer, SubDir: "a2"}
+	sharedPath := ns.getSharedMountPath(vol1)
+	for _, vol := range []*Lustre{vol1, vol2} {
+		if err := os.MkdirAll(filepath.Join(sharedPath, vol.SubDir), 0750); err != nil {
+			t.Fatalf("failed to prepare subdirectory: %v", err)
+		}
+	}
+	stagingDir := t.TempDir()
+	stage1, stage2 := filepath.Join(stagingDir, "1"), filepath.Join(stagingDir, "2")
+	target := filepath.Join(t.TempDir(), "target")
+
+	stage := func(vol *Lustre, stagingPath string) error {
+		_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          getVolumeIDFromLustreVol(vol),
+			StagingTargetPath: stagingPath,
+			VolumeCapability:  volumeCap,
+		})
+		return err
+	}
+	unstage := func(vol *Lustre, stagingPath string) error {
+		_, err := ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+			VolumeId:          getVolumeIDFromLustreVol(vol),
+			StagingTargetPath: stagingPath,
+		})
+		return err
+	}
+	isMounted := func(path string) bool {
+		mountPoints, _ := mounter.List()
+		for _, mp := range mountPoints {
+			if mp.Path == path {
+				return true
+			}
+		}
+		return false
+	}
+	countActions := func(action string) int {
+		n := 0
+		for _, a := range mounter.GetLog() {
+			if a.Action == action {
+				n++
+			}
+		}
+		return n
+	}
+
+	if err := stage(vol1, stage1); err != nil {
+		t.Fatalf("stage vol1: %v", err)
+	}
+	if err := stage(vol1, stage1); err != nil {
+		t.Fatalf("stage vol1 again: %v", err)
+	}
+	if err := stage(vol2, stage2); err != nil {
+		t.Fatalf("stage vol2: %v", err)
+	}
+	// 一次文件系统挂载加两次 bind mount
+	if n := countActions(mount.FakeActionMount); n != 3 {
+		t.Fatalf("got %d mounts, expected 3: %v", n, mounter.GetLog())
+	}
+
+	if _, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          getVolumeIDFromLustreVol(vol1),
+		StagingTargetPath: stage1,
+		TargetPath:        target,
+		VolumeCapability:  volumeCap,
+	}); err != nil {
+		t.Fatalf("publish vol1: %v", err)
+	}
+	if !isMounted(target) {
+		t.Fatalf("target %s is not mounted", target)
+	}
+	if _, err := ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   getVolumeIDFromLustreVol(vol1),
+		TargetPath: target,
+	}); err != nil {
+		t.Fatalf("unpublish vol1: %v", err)
+	}
+
+	if err := unstage(vol1, stage1); err != nil {
+		t.Fatalf("unstage vol1: %v", err)
+	}
+	if isMounted(stage1) || !isMounted(sharedPath) {
+		t.Fatalf("expected shared mount to be kept while vol2 is staged: %v", mounter.MountPoints)
+	}
+	if err := unstage(vol2, stage2); err != nil {
+		t.Fatalf("unstage vol2: %v", err)
+	}
+	if isMounted(sharedPath) {
+		t.Fatalf("expected shared mount to be released: %v", mounter.MountPoints)
+	}
+	if err := unstage(vol2, stage2); err != nil {
+		t.Fatalf("unstage vol2 again: %v", err)
+	}
+
+	missing := &Lustre{ServerName: testServer, SubDir: "missing"}
+	if err := stage(missing, filepath.Join(stagingDir, "3")); status.Code(err) != codes.NotFound {
+		t.Fatalf("got err %v, expected NotFound", err)
+	}
+	if isMounted(sharedPath) {
+		t.Fatalf("expected shared mount to be released after failed stage: %v", mounter.MountPoints)
+	}
+}
+
+// 只读发布通过 bind mount 加只读 remount 实现，只读和读写的使用者共享同一个 Lustre 客户端挂载
+func TestNodePublishVolumeReadOnly(t *testing.T) {
+	ns := initTestNode(t)
+	ns.Driver.NodeMountDir = t.TempDir()
+	mounter := ns.Mount.(*mount.FakeMounter)
+	vol := &Lustre{ServerName: testServer, SubDir: "a1"}
+	sharedPath := ns.getSharedMountPath(vol)
+	if err := os.MkdirAll(filepath.Join(sharedPath, vol.SubDir), 0750); err != nil {
+		t.Fatalf("failed to prepare subdirectory: %v", err)
+	}
+	volumeCap := func(mode csi.VolumeCapability_AccessMode_Mode, flags ...string) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: flags}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+		}
+	}
+	stagingPath := filepath.Join(t.TempDir(), "staging")
+	if _, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          getVolumeIDFromLustreVol(vol),
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  volumeCap(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER),
+	}); err != nil {
+		t.Fatalf("stage: %v", err)
+	}
+
+	targetDir := t.TempDir()
+	tests := []struct {
+		desc      string
+		volumeCap *csi.VolumeCapability
+		readOnly  bool
+		expectRO  bool
+	}{
+		{desc: "read write", volumeCap: volumeCap(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)},
+		{desc: "readonly request", volumeCap: volumeCap(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER), readOnly: true, expectRO: true},
+		{desc: "reader only access mode", volumeCap: volumeCap(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY), expectRO: true},
+		{desc: "single node reader only access mode", volumeCap: volumeCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY), expectRO: true},
+		{desc: "ro mount flag", volumeCap: volumeCap(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, "ro"), expectRO: true},
+	}
+	for i, tc := range tests {
+		target := filepath.Join(targetDir, strconv.Itoa(i))
+		if _, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:          getVolumeIDFromLustreVol(vol),
+			StagingTargetPath: stagingPath,
+			TargetPath:        target,
+			VolumeCapability:  tc.volumeCap,
+			Readonly:          tc.readOnly,
+		}); err != nil {
+			t.Fatalf("%s: publish: %v", tc.desc, err)
+		}
+		var mp *mount.MountPoint
+		for i := range mounter.MountPoints {
+			if mounter.MountPoints[i].Path == target {
+				mp = &mounter.MountPoints[i]
+			}
+		}
+		if mp == nil {
+			t.Fatalf("%s: target %s is not mounted", tc.desc, target)
+		}
+		if !hasMountOption(mp.Opts, "bind") || hasMountOption(mp.Opts, mountOptionReadOnly) != tc.expectRO {
+			t.Errorf("%s: got mount options %v, expected read only %v", tc.desc, mp.Opts, tc.expectRO)
+		}
+		// 目标路径来自共享挂载中的子目录，而不是新的客户端挂载
+		if source := filepath.Join(sharedPath, vol.SubDir); mp.Device != source {
+			t.Errorf("%s: got device %s, expected %s", tc.desc, mp.Device, source)
+		}
+	}
+
+	clientMounts := 0
+	for _, mp := range mounter.MountPoints {
+		if mp.Type == "lustre" {
+			clientMounts++
+			if hasMountOption(mp.Opts, mountOptionReadOnly) {
+				t.Errorf("client mount %s should not be read only: %v", mp.Path, mp.Opts)
+			}
+		}
+	}
+	if clientMounts != 1 {
+		t.Errorf("got %d lustre client mounts, expected 1: %v", clientMounts, mounter.MountPoints)
+	}
+}
+
+func TestNodeStageVolumeMountOptions(t *testing.T) {
+	ns := initTestNode(t)
+	ns.Driver.NodeMountDir = t.TempDir()
+	mounter := ns.Mount.(*mount.FakeMounter)
+
+	vol := &Lustre{ServerName: testServer, SubDir: "a1", MountOptions: []string{"flock", "noatime"}}
+	sharedPath := ns.getSharedMountPath(vol)
+	if err := os.MkdirAll(filepath.Join(sharedPath, vol.SubDir), 0750); err != nil {
+		t.Fatalf("failed to prepare subdirectory: %v", err)
+	}
+
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          getVolumeIDFromLustreVol(vol),
+		StagingTargetPath: filepath.Join(t.TempDir(), "staging"),
+		VolumeContext:     map[string]string{paramMountOptions: "noatime,ro"},
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"flock"}},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+	}
+	if _, err := ns.NodeStageVolume(context.Background(), req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mountPoints, _ := mounter.List()
+	if len(mountPoints) == 0 || mountPoints[0].Path != sharedPath || !reflect.DeepEqual(mountPoints[0].Opts, vol.MountOptions) {
+		t.Errorf("unexpected mount points %+v, expected %s mounted with %v", mountPoints, sharedPath, vol.MountOptions)
+	}
+
+	req.VolumeCapability.GetMount().MountFlags = []string{"nfsvers=4"}
+	if _, err := ns.NodeStageVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got err %v, expected InvalidArgument", err)
+	}
+}
+
+func TestNodeVolumeLocks(t *testing.T) {
+	ns := initTestNode(t)
+	volumeID := getVolumeIDFromLustreVol(&Lustre{ServerName: testServer, SubDir: "a1"})
+	volumeCap := &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}}
+	stagingPath := t.TempDir()
+	target1, target2 := filepath.Join(t.TempDir(), "1"), filepath.Join(t.TempDir(), "2")
+	publish := func(targetPath string) error {
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:          volumeID,
+			StagingTargetPath: stagingPath,
+			TargetPath:        targetPath,
+			VolumeCapability:  volumeCap,
+		})
+		return err
+	}
+
+	// 同一个卷发布到不同路径的操作互不影响
+	release, _ := ns.Driver.VolumeLocks.TryLock(volumeOperationKey(volumeID, target1), "test", LockExclusive)
+	if err := publish(target1); status.Code(err) != codes.Aborted {
+		t.Errorf("got err %v, expected Aborted", err)
+	}
+	if _, err := ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: volumeID, TargetPath: target1}); status.Code(err) != codes.Aborted {
+		t.Errorf("got err %v, expected Aborted", err)
+	}
+	if err := publish(target2); err != nil {
+		t.Errorf("publish to another target: %v", err)
+	}
+	release()
+
+	// 卷被 stage/unstage 独占时不能发布
+	release, _ = ns.Driver.VolumeLocks.TryLock(volumeID, "test", LockExclusive)
+	if err := publish(target2); status.Code(err) != codes.Aborted {
+		t.Errorf("got err %v, expected Aborted", err)
+	}
+	release()
+
+	// 锁在每个返回路径上释放，出错后重试不会返回 Aborted
+	if _, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "v1#bad",
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  volumeCap,
+	}); status.Code(err) == codes.Aborted || err == nil {
+		t.Errorf("got err %v, expected validation error", err)
+	}
+	if _, err := ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: "v1#bad", StagingTargetPath: stagingPath}); err != nil {
+		t.Errorf("unstage: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := publish(target1); err != nil {
+			t.Errorf("publish attempt %d: %v", i, err)
+		}
+		if _, err := ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: volumeID, TargetPath: target1}); err != nil {
+			t.Errorf("unpublish attempt %d: %v", i, err)
+		}
+	}
+}
+
+func TestSharedMountLocks(t *testing.T) {
+	ns := initTestNode(t)
+	ns.Driver.NodeMountDir = t.TempDir()
+	mounter := ns.Mount.(*mount.FakeMounter)
+	volumeCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+	}
+	vol1 := &Lustre{ServerName: testServer, SubDir: "a1"}
+	vol2 := &Lustre{ServerName: "172.16.100.189@tcp:/otherfs", SubDir: "a1"}
+	for _, vol := range []*Lustre{vol1, vol2} {
+		if err := os.MkdirAll(filepath.Join(ns.getSharedMountPath(vol), vol.SubDir), 0750); err != nil {
+			t.Fatalf("failed to prepare subdirectory: %v", err)
+		}
+	}
+	stage := func(ctx context.Context, vol *Lustre) error {
+		_, err := ns.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          getVolumeIDFromLustreVol(vol),
+			StagingTargetPath: filepath.Join(t.TempDir(), "staging"),
+			VolumeCapability:  volumeCap,
+		})
+		return err
+	}
+
+	// 另一个文件系统的共享挂载被占用时不影响本文件系统的卷
+	release, _ := ns.Driver.VolumeLocks.TryLock(sharedMountLockKey(ns.getSharedMountPath(vol2)), "test", LockExclusive)
+	if err := stage(context.Background(), vol1); err != nil {
+		t.Fatalf("stage vol1: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := stage(ctx, vol2); status.Code(err) != codes.Aborted {
+		t.Errorf("got err %v, expected Aborted", err)
+	}
+
+	// 被锁定的共享挂载不会被清理
+	if err := mounter.Mount(vol2.ServerName, ns.getSharedMountPath(vol2), "lustre", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.cleanupSharedMounts(); err != nil {
+		t.Fatalf("cleanupSharedMounts: %v", err)
+	}
+	if mountPoints, _ := mounter.List(); len(mountPoints) != 3 {
+		t.Errorf("expected locked shared mount to be kept: %+v", mountPoints)
+	}
+	release()
+	if err := ns.cleanupSharedMounts(); err != nil {
+		t.Fatalf("cleanupSharedMounts: %v", err)
+	}
+	if mountPoints, _ := mounter.List(); len(mountPoints) != 2 {
+		t.Errorf("expected unused shared mount to be released: %+v", mountPoints)
+	}
+}
+
+func TestGetSharedMountPath(t *testing.T) {
+	ns := initTestNode(t)
+	ns.Driver.NodeMountDir = t.TempDir()
+	path := func(server string, options ...string) string {
+		return ns.getSharedMountPath(&Lustre{ServerName: server, MountOptions: options})
+	}
+	if path("10.0.0.1@tcp:/scratch") == path("10.0.0.2@tcp:/scratch") {
+		t.Error("servers with different MGS NIDs share a mount")
+	}
+	if path("10.0.0.1@tcp:/testfs/a_b") == path("10.0.0.1@tcp:/testfs_a/b") {
+		t.Error("filesets with the same sanitised name share a mount")
+	}
+	if path(testServer) == path(testServer, "flock") {
+		t.Error("different client mount options share a mount")
+	}
+	if path(testServer, "ro") != path(testServer) {
+		t.Error("ro option creates a separate mount")
+	}
+}
+
+// 同一文件系统按不同客户端选项挂载的多个共享挂载显示相同的设备，它们之间不计为引用
+func TestCleanupSharedMountsSameDevice(t *testing.T) {
+	ns := initTestNode(t)
+	ns.Driver.NodeMountDir = t.TempDir()
+	mounter := ns.Mount.(*mount.FakeMounter)
+	volA := &Lustre{ServerName: testServer, SubDir: "a1", MountOptions: []string{"flock"}}
+	volB := &Lustre{ServerName: testServer, SubDir: "a2", MountOptions: []string{"localflock"}}
+	isMounted := func(path string) bool {
+		for _, mp := range mounter.MountPoints {
+			if mp.Path == path {
+				return true
+			}
+		}
+		return false
+	}
+
+	var sharedPaths, targets []string
+	for _, vol := range []*Lustre{volA, volB} {
+		sharedPath, err := ns.mountSharedFs(vol)
+		if err != nil {
+			t.Fatalf("mountSharedFs: %v", err)
+		}
+		source := filepath.Join(sharedPath, vol.SubDir)
+		if err := os.MkdirAll(source, 0750); err != nil {
+			t.Fatal(err)
+		}
+		target := t.TempDir()
+		if err := ns.bindMount(source, target, false); err != nil {
+			t.Fatalf("bindMount: %v", err)
+		}
+		sharedPaths = append(sharedPaths, sharedPath)
+		targets = append(targets, target)
+	}
+	if sharedPaths[0] == sharedPaths[1] {
+		t.Fatalf("expected separate shared mounts, got %s", sharedPaths[0])
+	}
 
+	for i, target := range targets {
+		if err := ns.cleanupMountPoint(target); err != nil {
+			t.Fatalf("cleanup %s: %v", target, err)
+		}
+		if err := ns.cleanupSharedMounts(); err != nil {
+			t.Fatalf("cleanupSharedMounts: %v", err)
+		}
+		if isMounted(sharedPaths[i]) {
+			t.Errorf("shared mount %s kept after its last bind mount was removed: %v", sharedPaths[i], mounter.MountPoints)
+		}
+		for _, sharedPath := range sharedPaths[i+1:] {
+			if !isMounted(sharedPath) {
+				t.Errorf("shared mount %s removed while still in use", sharedPath)
+			}
+		}
 	}
 }
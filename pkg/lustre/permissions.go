@@ -0,0 +1,78 @@
+package lustre
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// parseDirMode 解析八进制的目录权限，支持 setuid、setgid 和 sticky 位
+func parseDirMode(key, val string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(val, 8, 32)
+	if err != nil || mode > 07777 {
+		return 0, fmt.Errorf("invalid %s %q, must be an octal permission such as 0775", key, val)
+	}
+	return fileModeFromUnix(mode), nil
+}
+
+// fileModeFromUnix 将 Unix 权限位转换为 os.FileMode，os.FileMode 的特殊位与 Unix 的定义不同
+func fileModeFromUnix(mode uint64) os.FileMode {
+	fileMode := os.FileMode(mode).Perm()
+	if mode&01000 != 0 {
+		fileMode |= os.ModeSticky
+	}
+	if mode&02000 != 0 {
+		fileMode |= os.ModeSetgid
+	}
+	if mode&04000 != 0 {
+		fileMode |= os.ModeSetuid
+	}
+	return fileMode
+}
+
+// getMountPermissions 返回卷参数中的目录权限，未设置时使用 --mount-permissions，权限为 0 时使用 0777
+func (d *Driver) getMountPermissions(params map[string]string) (os.FileMode, error) {
+	mode := fileModeFromUnix(d.MountPermissions & 07777)
+	if val, ok := params[paramMountPermissions]; ok {
+		var err error
+		if mode, err = parseDirMode(paramMountPermissions, val); err != nil {
+			return 0, err
+		}
+	}
+	if mode == 0 {
+		return 0777, nil
+	}
+	return mode, nil
+}
+
+// makeDir 创建目录并设置权限。MkdirAll 受 umask 影响，目录新建时再显式 chmod 一次；
+// 已存在的目录保持原有权限，避免覆盖用户或 ControllerModifyVolume 修改过的权限
+func makeDir(path string, perm os.FileMode) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(path, perm); err != nil {
+		return err
+	}
+	return os.Chmod(path, perm)
+}
+
+// setVolumeMountGroup 按 VolumeMountGroup（即 Pod 的 fsGroup）设置卷目录的属组，并添加组读写执行权限和 setgid 位，
+// 使以该组运行的非 root 容器可以写入，新建的文件和子目录继承该属组。
+// 与 kubelet 不同，这里不递归修改已有文件，避免在大目录上遍历整个 Lustre 目录树
+func setVolumeMountGroup(path, group string) error {
+	gid, err := parseOwnerId("volume mount group", group)
+	if err != nil {
+		return err
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chown(path, -1, gid); err != nil {
+		return err
+	}
+	return os.Chmod(path, st.Mode()&(os.ModePerm|os.ModeSticky|os.ModeSetuid)|0070|os.ModeSetgid)
+}
@@ -0,0 +1,183 @@
+package lustre
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// layoutEOF 表示复合布局最后一个组件延伸到文件末尾
+	layoutEOF    = "eof"
+	layoutDoM    = "dom"
+	maxDoMSize   = 1 << 30
+	maxLayoutLen = 16
+)
+
+// layoutComponent 为复合布局中的一个组件，覆盖从上一个组件结束位置到 End 的文件范围
+type layoutComponent struct {
+	// End 为组件的结束偏移，-1 表示文件末尾
+	End int64
+	// DoM 表示该组件的数据存放在 MDT 上
+	DoM    bool
+	Stripe stripeLayout
+}
+
+// compositeLayout 为渐进式文件布局（PFL），可以以 Data-on-MDT 组件开头。
+//
+// layout 参数由分号分隔的组件组成，每个组件为 "<结束偏移>[:<选项>]"，选项为逗号分隔的
+// count=<条带数>、size=<条带大小>、pool=<OST 池>；第一个组件可以写为 "dom:<结束偏移>"，
+// 最后一个组件的结束偏移必须为 eof。例如：
+//
+//	dom:64k; 256M:count=1; 4G:count=4,size=4M; eof:count=-1,size=4M,pool=flash
+type compositeLayout []layoutComponent
+
+func parseCompositeLayout(val string) (compositeLayout, error) {
+	var layout compositeLayout
+	for _, spec := range strings.Split(val, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		comp, err := parseLayoutComponent(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s component %q: %v", paramLayout, spec, err)
+		}
+		if comp.DoM && len(layout) != 0 {
+			return nil, fmt.Errorf("invalid %s component %q: %s component must be the first one", paramLayout, spec, layoutDoM)
+		}
+		if n := len(layout); n > 0 {
+			if prev := layout[n-1].End; prev == -1 || (comp.End != -1 && comp.End <= prev) {
+				return nil, fmt.Errorf("invalid %s component %q: extent end must be greater than the previous one", paramLayout, spec)
+			}
+		}
+		layout = append(layout, comp)
+	}
+	if len(layout) == 0 {
+		return nil, fmt.Errorf("%s must contain at least one component", paramLayout)
+	}
+	if len(layout) > maxLayoutLen {
+		return nil, fmt.Errorf("%s must contain at most %d components", paramLayout, maxLayoutLen)
+	}
+	if layout[len(layout)-1].End != -1 {
+		return nil, fmt.Errorf("the last %s component must end at %s", paramLayout, layoutEOF)
+	}
+	return layout, nil
+}
+
+func parseLayoutComponent(spec string) (layoutComponent, error) {
+	comp := layoutComponent{}
+	end, opts, _ := strings.Cut(spec, ":")
+	end = strings.TrimSpace(end)
+
+	if strings.EqualFold(end, layoutDoM) {
+		// dom:<结束偏移>，DoM 组件的条带大小等于其结束偏移
+		if strings.Contains(opts, "=") {
+			return comp, fmt.Errorf("%s component does not accept options", layoutDoM)
+		}
+		size, err := parseSize(opts)
+		if err != nil || size == 0 || size > maxDoMSize || size%stripeSizeUnit != 0 {
+			return comp, fmt.Errorf("%s size must be a multiple of 64KiB and at most 1G", layoutDoM)
+		}
+		comp.DoM = true
+		comp.End = size
+		return comp, nil
+	}
+
+	if strings.EqualFold(end, layoutEOF) || end == "-1" {
+		comp.End = -1
+	} else {
+		size, err := parseSize(end)
+		if err != nil || size == 0 || size%stripeSizeUnit != 0 {
+			return comp, fmt.Errorf("extent end must be %s or a positive multiple of 64KiB", layoutEOF)
+		}
+		comp.End = size
+	}
+
+	if strings.TrimSpace(opts) == "" {
+		return comp, nil
+	}
+	for _, opt := range strings.Split(opts, ",") {
+		key, val, ok := strings.Cut(strings.TrimSpace(opt), "=")
+		if !ok {
+			return comp, fmt.Errorf("option %q must be in key=value form", opt)
+		}
+		switch key {
+		case "count":
+			count, err := parseStripeCount(val)
+			if err != nil {
+				return comp, err
+			}
+			comp.Stripe.StripeCount = strconv.Itoa(count)
+		case "size":
+			size, err := parseStripeSize(val)
+			if err != nil {
+				return comp, err
+			}
+			if comp.End != -1 && comp.End%size != 0 {
+				return comp, fmt.Errorf("extent end must be a multiple of the stripe size %s", val)
+			}
+			comp.Stripe.StripeSize = strconv.FormatInt(size, 10)
+		case "pool":
+			if err := validateOstPool(val); err != nil {
+				return comp, err
+			}
+			comp.Stripe.Pool = val
+		default:
+			return comp, fmt.Errorf("unknown option %q, supported options are count, size and pool", key)
+		}
+	}
+	return comp, nil
+}
+
+func (c compositeLayout) args() []string {
+	var args []string
+	for _, comp := range c {
+		end := "-1"
+		if comp.End != -1 {
+			end = strconv.FormatInt(comp.End, 10)
+		}
+		args = append(args, "-E", end)
+		if comp.DoM {
+			args = append(args, "-L", "mdt")
+			continue
+		}
+		args = append(args, comp.Stripe.args()...)
+	}
+	return args
+}
+
+func (c compositeLayout) params(volParam map[string]string) {
+	volParam[paramLayout] = c.String()
+}
+
+// String 返回规范化后的 layout 参数
+func (c compositeLayout) String() string {
+	specs := make([]string, 0, len(c))
+	for _, comp := range c {
+		if comp.DoM {
+			specs = append(specs, layoutDoM+":"+formatSize(comp.End))
+			continue
+		}
+		spec := layoutEOF
+		if comp.End != -1 {
+			spec = formatSize(comp.End)
+		}
+		var opts []string
+		if comp.Stripe.StripeCount != "" {
+			opts = append(opts, "count="+comp.Stripe.StripeCount)
+		}
+		if comp.Stripe.StripeSize != "" {
+			size, _ := strconv.ParseInt(comp.Stripe.StripeSize, 10, 64)
+			opts = append(opts, "size="+formatSize(size))
+		}
+		if comp.Stripe.Pool != "" {
+			opts = append(opts, "pool="+comp.Stripe.Pool)
+		}
+		if len(opts) > 0 {
+			spec += ":" + strings.Join(opts, ",")
+		}
+		specs = append(specs, spec)
+	}
+	return strings.Join(specs, ";")
+}
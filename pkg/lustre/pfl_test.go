@@ -0,0 +1,86 @@
+package lustre
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCompositeLayout(t *testing.T) {
+	testCases := []struct {
+		name     string
+		layout   string
+		args     string
+		expected string
+		wantErr  bool
+	}{
+		{
+			name:     "small files",
+			layout:   "dom:64k; eof:count=1",
+			args:     "-E 65536 -L mdt -E -1 -c 1",
+			expected: "dom:64K;eof:count=1",
+		},
+		{
+			name:     "balanced",
+			layout:   "dom:1M; 256M:count=1; 4G:count=4,size=4M; eof:count=-1,size=4M,pool=flash",
+			args:     "-E 1048576 -L mdt -E 268435456 -c 1 -E 4294967296 -c 4 -S 4194304 -E -1 -c -1 -S 4194304 -p flash",
+			expected: "dom:1M;256M:count=1;4G:count=4,size=4M;eof:count=-1,size=4M,pool=flash",
+		},
+		{
+			name:     "streaming",
+			layout:   "64M:count=4;-1:count=-1,size=16m;",
+			args:     "-E 67108864 -c 4 -E -1 -c -1 -S 16777216",
+			expected: "64M:count=4;eof:count=-1,size=16M",
+		},
+		{name: "empty", layout: " ; ", wantErr: true},
+		{name: "last component not eof", layout: "1G:count=1", wantErr: true},
+		{name: "dom not first", layout: "1G:count=1;dom:1M;eof", wantErr: true},
+		{name: "dom too large", layout: "dom:2G;eof", wantErr: true},
+		{name: "dom with options", layout: "dom:1M:count=1;eof", wantErr: true},
+		{name: "extents not increasing", layout: "1G;512M;eof", wantErr: true},
+		{name: "component after eof", layout: "eof;eof", wantErr: true},
+		{name: "extent not aligned", layout: "100k;eof", wantErr: true},
+		{name: "extent not multiple of stripe size", layout: "6M:size=4M;eof", wantErr: true},
+		{name: "unknown option", layout: "eof:stripes=4", wantErr: true},
+		{name: "option without value", layout: "eof:count", wantErr: true},
+		{name: "invalid pool", layout: "eof:pool=a b", wantErr: true},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			layout, err := parseCompositeLayout(test.layout)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got err %v, wantErr %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if args := strings.Join(layout.args(), " "); args != test.args {
+				t.Errorf("got args %q, expected %q", args, test.args)
+			}
+			if layout.String() != test.expected {
+				t.Errorf("got %q, expected %q", layout.String(), test.expected)
+			}
+		})
+	}
+}
+
+func TestParseDirLayout(t *testing.T) {
+	layout, err := parseDirLayout(map[string]string{paramLayout: "dom:64k;eof"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	volParam := map[string]string{}
+	layout.params(volParam)
+	if expected := map[string]string{paramLayout: "dom:64K;eof"}; !reflect.DeepEqual(volParam, expected) {
+		t.Errorf("got params %v, expected %v", volParam, expected)
+	}
+
+	if _, err := parseDirLayout(map[string]string{paramLayout: "eof", paramStripeCount: "1"}); err == nil {
+		t.Errorf("expected error when layout is used together with stripeCount")
+	}
+	if layout, err := parseDirLayout(map[string]string{}); err != nil || layout != nil {
+		t.Errorf("got layout %v, err %v, expected nil", layout, err)
+	}
+}
@@ -0,0 +1,126 @@
+package lustre
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// driverMetadataDir 为文件系统根目录下保存驱动元数据（卷、快照、克隆进度）的目录
+	driverMetadataDir = ".lustre-csi"
+	// volumeRegistryDir 为文件系统根目录下记录本驱动所创建卷的元数据目录，每个卷一个 JSON 文件
+	volumeRegistryDir = driverMetadataDir + "/volumes"
+)
+
+// volumeMetadata 为 CreateVolume 写入的卷元数据，ListVolumes 通过它列出卷
+type volumeMetadata struct {
+	VolumeID      string            `json:"volumeId"`
+	Name          string            `json:"name"`
+	CapacityBytes int64             `json:"capacityBytes"`
+	VolumeContext map[string]string `json:"volumeContext,omitempty"`
+	CreatedAt     time.Time         `json:"createdAt"`
+	// OnDelete 为 ControllerModifyVolume 修改后的删除策略，优先于卷 ID 中记录的策略
+	OnDelete string `json:"onDelete,omitempty"`
+}
+
+func getVolumeMetadataPath(fsRoot, name string) string {
+	return filepath.Join(fsRoot, volumeRegistryDir, strings.ReplaceAll(name, "/", "_")+".json")
+}
+
+// writeVolumeMetadata 原子地写入卷元数据，CreateVolume 重试时覆盖已有内容
+func writeVolumeMetadata(fsRoot string, meta *volumeMetadata) error {
+	return writeJSONFile(getVolumeMetadataPath(fsRoot, meta.Name), meta)
+}
+
+// readVolumeMetadata 读取指定卷的元数据，未记录时返回 nil
+func readVolumeMetadata(fsRoot, name string) (*volumeMetadata, error) {
+	meta := &volumeMetadata{}
+	found, err := readJSONFile(getVolumeMetadataPath(fsRoot, name), meta)
+	if err != nil || !found {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func removeVolumeMetadata(fsRoot, name string) error {
+	if err := os.Remove(getVolumeMetadataPath(fsRoot, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// listVolumeMetadata 返回文件系统中记录的全部卷元数据，目录不存在时返回空
+func listVolumeMetadata(fsRoot string) ([]*volumeMetadata, error) {
+	var metas []*volumeMetadata
+	err := readJSONDir(filepath.Join(fsRoot, volumeRegistryDir), func(name string, data []byte) error {
+		meta := &volumeMetadata{}
+		if err := json.Unmarshal(data, meta); err != nil {
+			return fmt.Errorf("failed to parse volume metadata %s: %v", name, err)
+		}
+		metas = append(metas, meta)
+		return nil
+	})
+	return metas, err
+}
+
+// readJSONDir 对 dir 下的每个 JSON 文件调用 fn，目录不存在时直接返回
+func readJSONDir(dir string, fn func(name string, data []byte) error) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if err := fn(entry.Name(), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeJSONFile 先写临时文件再重命名，保证读者不会看到写了一半的内容
+func writeJSONFile(path string, v interface{}) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readJSONFile 将 path 的内容解析到 v，文件不存在时返回 false
+func readJSONFile(path string, v interface{}) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,364 @@
+package lustre
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// snapshotDataDir 为文件系统根目录下存放快照数据的目录，每个快照一个子目录
+	snapshotDataDir = ".snapshots"
+	// snapshotRegistryDir 为文件系统根目录下记录快照元数据的目录，每个快照一个 JSON 文件
+	snapshotRegistryDir = driverMetadataDir + "/snapshots"
+
+	// snapshotTypeCopy 将卷的子目录复制到 .snapshots 下，不依赖文件系统的能力
+	snapshotTypeCopy = "copy"
+	// snapshotTypeLctl 通过 lctl snapshot_* 创建整个文件系统的快照，要求 ZFS 后端
+	snapshotTypeLctl = "lctl"
+	// lctl 快照在 controller 上的只读挂载目录名前缀，后接快照的文件系统名称
+	lctlSnapshotMountPrefix = "snapshot-"
+)
+
+// snapshotMetadata 为 CreateSnapshot 写入的快照元数据，ReadyToUse 在数据复制完成后置位
+type snapshotMetadata struct {
+	SnapshotID     string    `json:"snapshotId"`
+	Name           string    `json:"name"`
+	SourceVolumeID string    `json:"sourceVolumeId"`
+	SizeBytes      int64     `json:"sizeBytes"`
+	CreationTime   time.Time `json:"creationTime"`
+	ReadyToUse     bool      `json:"readyToUse"`
+	Type           string    `json:"type,omitempty"`
+	// Error 记录最近一次复制失败的原因，下次 CreateSnapshot 时会重新开始复制
+	Error string `json:"error,omitempty"`
+}
+
+func (m *snapshotMetadata) toCSI() *csi.Snapshot {
+	return &csi.Snapshot{
+		SnapshotId:     m.SnapshotID,
+		SourceVolumeId: m.SourceVolumeID,
+		SizeBytes:      m.SizeBytes,
+		CreationTime:   timestamppb.New(m.CreationTime),
+		ReadyToUse:     m.ReadyToUse,
+	}
+}
+
+// snapshotType 返回快照类型，早期的元数据没有记录类型，均为 copy
+func (m *snapshotMetadata) snapshotType() string {
+	if m.Type == "" {
+		return snapshotTypeCopy
+	}
+	return m.Type
+}
+
+// getSnapshotType 从 VolumeSnapshotClass 参数中取得快照类型，缺省为 copy
+func getSnapshotType(params map[string]string) (string, error) {
+	snapshotType, ok := params[paramSnapshotType]
+	if !ok {
+		return snapshotTypeCopy, nil
+	}
+	snapshotType = strings.ToLower(snapshotType)
+	return snapshotType, validateSnapshotType(snapshotType)
+}
+
+func validateSnapshotType(snapshotType string) error {
+	if snapshotType != snapshotTypeCopy && snapshotType != snapshotTypeLctl {
+		return fmt.Errorf("invalid %s %q, must be %q or %q", paramSnapshotType, snapshotType, snapshotTypeCopy, snapshotTypeLctl)
+	}
+	return nil
+}
+
+// snapshotCopy 为后台运行中的快照复制任务
+type snapshotCopy struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func getSnapshotPath(fsRoot, name string) string {
+	return filepath.Join(fsRoot, snapshotDataDir, name)
+}
+
+func getSnapshotMetadataPath(fsRoot, name string) string {
+	return filepath.Join(fsRoot, snapshotRegistryDir, name+".json")
+}
+
+// readSnapshotMetadata 读取指定快照的元数据，未记录时返回 nil
+func readSnapshotMetadata(fsRoot, name string) (*snapshotMetadata, error) {
+	meta := &snapshotMetadata{}
+	found, err := readJSONFile(getSnapshotMetadataPath(fsRoot, name), meta)
+	if err != nil || !found {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// listSnapshotMetadata 返回文件系统中记录的全部快照元数据
+func listSnapshotMetadata(fsRoot string) ([]*snapshotMetadata, error) {
+	var metas []*snapshotMetadata
+	err := readJSONDir(filepath.Join(fsRoot, snapshotRegistryDir), func(name string, data []byte) error {
+		meta := &snapshotMetadata{}
+		if err := json.Unmarshal(data, meta); err != nil {
+			return fmt.Errorf("failed to parse snapshot metadata %s: %v", name, err)
+		}
+		metas = append(metas, meta)
+		return nil
+	})
+	return metas, err
+}
+
+// dataVol 返回快照数据目录对应的 Lustre 卷，用作恢复时的复制源
+func (snap *lustreSnapshot) dataVol() *Lustre {
+	return &Lustre{
+		FSId:        snap.ID,
+		ServerName:  snap.Source.ServerName,
+		MountPoint:  snap.Source.MountPoint,
+		SubDir:      filepath.Join(snapshotDataDir, snap.Name),
+		StorageType: paramFsType,
+	}
+}
+
+// startSnapshotCopy 在后台复制快照数据，同一快照同时只有一个复制任务
+func (cs *ControllerServer) startSnapshotCopy(src *Lustre, meta *snapshotMetadata) {
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &snapshotCopy{cancel: cancel, done: make(chan struct{})}
+	if _, running := cs.snapshotCopies.LoadOrStore(meta.SnapshotID, job); running {
+		cancel()
+		return
+	}
+
+	go func() {
+		defer func() {
+			cs.snapshotCopies.Delete(meta.SnapshotID)
+			cancel()
+			close(job.done)
+		}()
+
+		result := *meta
+		start := time.Now()
+		copier := &treeCopier{runner: cs.Driver.Runner, parallelism: cs.Driver.CloneParallelism}
+		err := cs.copySnapshot(ctx, src, copier, meta.Name)
+		if ctx.Err() != nil {
+			// 快照已被删除
+			return
+		}
+		if err != nil {
+			klog.Errorf("failed to copy snapshot %s: %v", meta.SnapshotID, err)
+			result.Error = err.Error()
+		} else {
+			result.ReadyToUse = true
+			result.Error = ""
+			result.SizeBytes = getSnapshotSizeBytes(src, copier.bytes)
+			klog.V(2).InfoS("CreateSnapshot: snapshot ready", "snapshotId", meta.SnapshotID,
+				"files", copier.files, "skipped", copier.skipped, "bytes", copier.bytes, "duration", time.Since(start))
+		}
+		if err := writeJSONFile(getSnapshotMetadataPath(src.MountPoint, meta.Name), &result); err != nil {
+			klog.Errorf("failed to write metadata of snapshot %s: %v", meta.SnapshotID, err)
+		}
+	}()
+}
+
+// getSnapshotSizeBytes 以源卷容量作为快照大小，保证从快照恢复的卷不小于源卷；
+// 源卷没有记录容量时使用快照的数据量
+func getSnapshotSizeBytes(src *Lustre, dataBytes int64) int64 {
+	if src.UUID == "" {
+		return dataBytes
+	}
+	meta, err := readVolumeMetadata(src.MountPoint, src.UUID)
+	if err != nil || meta == nil || meta.CapacityBytes < dataBytes {
+		return dataBytes
+	}
+	return meta.CapacityBytes
+}
+
+func (cs *ControllerServer) copySnapshot(ctx context.Context, src *Lustre, copier *treeCopier, name string) error {
+	dst := getSnapshotPath(src.MountPoint, name)
+	if err := os.MkdirAll(filepath.Dir(dst), 0750); err != nil {
+		return err
+	}
+	return copier.copyTree(ctx, getInternalMountPath(src), dst)
+}
+
+// stopSnapshotCopy 取消快照的后台复制并等待其退出
+func (cs *ControllerServer) stopSnapshotCopy(snapshotID string) {
+	if val, ok := cs.snapshotCopies.Load(snapshotID); ok {
+		job := val.(*snapshotCopy)
+		job.cancel()
+		<-job.done
+	}
+}
+
+// getSnapshotCloneSource 检查快照存在、已就绪且不大于请求的容量，返回其数据目录
+func (cs *ControllerServer) getSnapshotCloneSource(ctx context.Context, snapshotID string, capacity int64) (*Lustre, error) {
+	snap, err := getLustreSnapshotFromID(snapshotID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "snapshot %s not found: %v", snapshotID, err)
+	}
+	if err := cs.mountLustreVol(ctx, snap.Source); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to mount lustre: %v", err)
+	}
+	meta, err := readSnapshotMetadata(snap.Source.MountPoint, snap.Name)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read snapshot metadata: %v", err)
+	}
+	if meta == nil {
+		return nil, status.Errorf(codes.NotFound, "snapshot %s not found", snapshotID)
+	}
+	if !meta.ReadyToUse {
+		return nil, status.Errorf(codes.Unavailable, "snapshot %s is not ready yet", snapshotID)
+	}
+	if meta.SizeBytes > capacity {
+		return nil, status.Errorf(codes.OutOfRange, "requested capacity %d is smaller than snapshot size %d", capacity, meta.SizeBytes)
+	}
+	if snap.Type == snapshotTypeLctl {
+		return cs.mountLctlSnapshotVol(ctx, snap)
+	}
+	return snap.dataVol(), nil
+}
+
+// lctlRunner 返回在 MGS 上执行 lctl snapshot_* 的 CommandRunner。这些命令在 controller 本地执行会失败，
+// 未通过 --mgs-ssh-target 配置 MGS 时返回 FailedPrecondition
+func (cs *ControllerServer) lctlRunner() (CommandRunner, error) {
+	if cs.Driver.MGSRunner == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s snapshots run lctl on the MGS, --mgs-ssh-target of the controller is not set", snapshotTypeLctl)
+	}
+	return cs.Driver.MGSRunner, nil
+}
+
+// createLctlSnapshot 通过 lctl snapshot_create 为源卷所在的整个文件系统创建快照，命令返回时快照即可用。
+// 重试时若同名快照已存在则直接使用
+func (cs *ControllerServer) createLctlSnapshot(ctx context.Context, src *Lustre, meta *snapshotMetadata) error {
+	runner, err := cs.lctlRunner()
+	if err != nil {
+		return err
+	}
+	_, fsName, _, err := splitLustreServer(src.ServerName)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	existing, err := getLctlSnapshot(ctx, runner, fsName, meta.Name)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to list snapshots of %s: %v", fsName, err)
+	}
+	if existing == nil {
+		if err := createLctlSnapshot(ctx, runner, fsName, meta.Name, "snapshot of volume "+meta.SourceVolumeID); err != nil {
+			return status.Errorf(codes.Internal, "failed to create snapshot %s of %s: %v", meta.Name, fsName, err)
+		}
+	}
+	meta.ReadyToUse = true
+	meta.SizeBytes = getSnapshotSizeBytes(src, 0)
+	if err := writeJSONFile(getSnapshotMetadataPath(src.MountPoint, meta.Name), meta); err != nil {
+		return status.Errorf(codes.Internal, "failed to write snapshot metadata: %v", err)
+	}
+	klog.V(2).InfoS("CreateSnapshot: lctl snapshot created", "snapshotId", meta.SnapshotID, "fsName", fsName)
+	return nil
+}
+
+// deleteLctlSnapshot 卸载 controller 上的快照挂载后删除快照，快照不存在时直接返回
+func (cs *ControllerServer) deleteLctlSnapshot(ctx context.Context, snap *lustreSnapshot) error {
+	runner, err := cs.lctlRunner()
+	if err != nil {
+		return err
+	}
+	_, fsName, _, err := splitLustreServer(snap.Source.ServerName)
+	if err != nil {
+		klog.Warningf("failed to parse server of snapshot %s: %v", snap.ID, err)
+		return nil
+	}
+	existing, err := getLctlSnapshot(ctx, runner, fsName, snap.Name)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to list snapshots of %s: %v", fsName, err)
+	}
+	if existing == nil {
+		return nil
+	}
+	if existing.FsName != "" {
+		mountPath := filepath.Join(cs.Driver.WorkingMountDir, lctlSnapshotMountPrefix+existing.FsName)
+		notMnt, err := cs.Mount.IsLikelyNotMountPoint(mountPath)
+		if err != nil && !os.IsNotExist(err) {
+			return status.Errorf(codes.Internal, "failed to check mount point %s: %v", mountPath, err)
+		}
+		if err == nil && !notMnt {
+			if err := cs.Mount.Unmount(mountPath); err != nil {
+				return status.Errorf(codes.Internal, "failed to unmount snapshot %s: %v", mountPath, err)
+			}
+		}
+		if err := os.Remove(mountPath); err != nil && !os.IsNotExist(err) {
+			klog.Warningf("failed to remove snapshot mount point %s: %v", mountPath, err)
+		}
+	}
+	if err := destroyLctlSnapshot(ctx, runner, fsName, snap.Name); err != nil {
+		return status.Errorf(codes.Internal, "failed to destroy snapshot %s of %s: %v", snap.Name, fsName, err)
+	}
+	return nil
+}
+
+// mountLctlSnapshotVol 在服务器端挂载快照并在 controller 上以只读方式挂载其文件系统，
+// 返回快照中源卷子目录对应的卷。挂载会保留到快照被删除，供多次恢复共用
+func (cs *ControllerServer) mountLctlSnapshotVol(ctx context.Context, snap *lustreSnapshot) (*Lustre, error) {
+	runner, err := cs.lctlRunner()
+	if err != nil {
+		return nil, err
+	}
+	nids, fsName, fileset, err := splitLustreServer(snap.Source.ServerName)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	existing, err := getLctlSnapshot(ctx, runner, fsName, snap.Name)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list snapshots of %s: %v", fsName, err)
+	}
+	if existing == nil {
+		return nil, status.Errorf(codes.NotFound, "snapshot %s not found in %s", snap.Name, fsName)
+	}
+	if existing.FsName == "" {
+		return nil, status.Errorf(codes.Internal, "snapshot %s of %s has no fsname", snap.Name, fsName)
+	}
+	if !existing.Mounted {
+		if err := mountLctlSnapshot(ctx, runner, fsName, snap.Name); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to mount snapshot %s of %s: %v", snap.Name, fsName, err)
+		}
+	}
+
+	server := nids + ":/" + existing.FsName
+	if fileset != "" {
+		server += "/" + fileset
+	}
+	vol := &Lustre{
+		FSId:        snap.ID,
+		ServerName:  server,
+		MountPoint:  filepath.Join(cs.Driver.WorkingMountDir, lctlSnapshotMountPrefix+existing.FsName),
+		SubDir:      snap.Source.SubDir,
+		StorageType: paramFsType,
+		Mount:       cs.Mount,
+	}
+	if err := os.MkdirAll(vol.MountPoint, 0750); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create %s: %v", vol.MountPoint, err)
+	}
+	notMnt, err := cs.Mount.IsLikelyNotMountPoint(vol.MountPoint)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check mount point %s: %v", vol.MountPoint, err)
+	}
+	if notMnt {
+		klog.V(2).InfoS("Mounting lctl snapshot", "snapshotId", snap.ID, "server", server, "target", vol.MountPoint)
+		if err := cs.Mount.Mount(server, vol.MountPoint, paramFsType, []string{mountOptionReadOnly}); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to mount snapshot %s: %v", server, err)
+		}
+	}
+	return vol, nil
+}
+
+// isLctlSnapshotMount 判断挂载路径是否为 mountLctlSnapshotVol 挂载的只读快照文件系统。
+// 快照中包含源文件系统的卷和快照元数据，遍历挂载列表时需要跳过，否则会返回重复的卷和快照
+func (cs *ControllerServer) isLctlSnapshotMount(path string) bool {
+	return strings.HasPrefix(path, filepath.Join(cs.Driver.WorkingMountDir, lctlSnapshotMountPrefix))
+}
@@ -0,0 +1,239 @@
+package lustre
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/mount-utils"
+)
+
+func TestSnapshotIDRoundTrip(t *testing.T) {
+	vol := &Lustre{ServerName: testServer, MountPoint: "/mnt/a#b", SubDir: "pvc-1"}
+	id := getSnapshotIDFromLustreVol(vol, "snapshot-1", snapshotTypeCopy)
+	snap, err := getLustreSnapshotFromID(id)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if snap.Name != "snapshot-1" || snap.Type != snapshotTypeCopy || snap.Source.ServerName != testServer || snap.Source.MountPoint != "/mnt/a#b" || snap.Source.SubDir != "pvc-1" {
+		t.Errorf("unexpected snapshot %+v, source %+v", snap, snap.Source)
+	}
+	snap, err = getLustreSnapshotFromID(getSnapshotIDFromLustreVol(vol, "snapshot-1", snapshotTypeLctl))
+	if err != nil || snap.Type != snapshotTypeLctl {
+		t.Errorf("unexpected snapshot %+v, %v", snap, err)
+	}
+
+	for _, id := range []string{
+		"",
+		"v1#" + testServer + "#/mnt#pvc-1",
+		getVolumeIDFromLustreVol(vol),
+		getSnapshotIDFromLustreVol(vol, "..", snapshotTypeCopy),
+		getSnapshotIDFromLustreVol(vol, "snapshot-1", "zfs"),
+		getSnapshotIDFromLustreVol(&Lustre{ServerName: testServer, MountPoint: "/mnt", SubDir: "../pvc-1"}, "snapshot-1", snapshotTypeCopy),
+	} {
+		if _, err := getLustreSnapshotFromID(id); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("id %q: got err %v, expected InvalidArgument", id, err)
+		}
+	}
+}
+
+// waitSnapshotReady 重复调用 CreateSnapshot 直到快照就绪，与 external-snapshotter 的行为一致
+func waitSnapshotReady(t *testing.T, cs *ControllerServer, req *csi.CreateSnapshotRequest) *csi.Snapshot {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, err := cs.CreateSnapshot(context.Background(), req)
+		if err != nil {
+			t.Fatalf("CreateSnapshot: %v", err)
+		}
+		if resp.GetSnapshot().GetReadyToUse() {
+			return resp.GetSnapshot()
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("snapshot %s not ready in time", req.GetName())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	cs := initTestController(t)
+	baseDir := t.TempDir()
+	volumeCaps := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+	}
+	createVolume := func(name string, capacity int64, source *csi.VolumeContentSource) (*csi.CreateVolumeResponse, error) {
+		return cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:                name,
+			VolumeCapabilities:  volumeCaps,
+			CapacityRange:       &csi.CapacityRange{RequiredBytes: capacity},
+			Parameters:          map[string]string{paramServer: testServer, paramBaseDir: baseDir},
+			VolumeContentSource: source,
+		})
+	}
+	snapshotSource := func(snapshotID string) *csi.VolumeContentSource {
+		return &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshotID},
+			},
+		}
+	}
+
+	var volumeIDs []string
+	for _, name := range []string{"pvc-a", "pvc-b"} {
+		resp, err := createVolume(name, 1<<30, nil)
+		if err != nil {
+			t.Fatalf("failed to create volume %s: %v", name, err)
+		}
+		volumeIDs = append(volumeIDs, resp.GetVolume().GetVolumeId())
+	}
+	writeTestFile(t, filepath.Join(baseDir, "pvc-a", "model", "weights"), "v1", 0644, time.Now())
+
+	snapA1 := waitSnapshotReady(t, cs, &csi.CreateSnapshotRequest{Name: "snap-a1", SourceVolumeId: volumeIDs[0]})
+	if snapA1.GetSourceVolumeId() != volumeIDs[0] || snapA1.GetSizeBytes() != 1<<30 || snapA1.GetCreationTime() == nil {
+		t.Errorf("unexpected snapshot %+v", snapA1)
+	}
+	data, err := os.ReadFile(filepath.Join(baseDir, snapshotDataDir, "snap-a1", "model", "weights"))
+	if err != nil || string(data) != "v1" {
+		t.Errorf("snapshot content %q, %v", data, err)
+	}
+
+	// 快照之后对卷的修改不影响快照
+	writeTestFile(t, filepath.Join(baseDir, "pvc-a", "model", "weights"), "v2", 0644, time.Now())
+	again := waitSnapshotReady(t, cs, &csi.CreateSnapshotRequest{Name: "snap-a1", SourceVolumeId: volumeIDs[0]})
+	if again.GetSnapshotId() != snapA1.GetSnapshotId() {
+		t.Errorf("snapshot id changed on retry: %s, %s", again.GetSnapshotId(), snapA1.GetSnapshotId())
+	}
+	if _, err := cs.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "snap-a1", SourceVolumeId: volumeIDs[1]}); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("got err %v, expected AlreadyExists", err)
+	}
+	snapA2 := waitSnapshotReady(t, cs, &csi.CreateSnapshotRequest{Name: "snap-a2", SourceVolumeId: volumeIDs[0]})
+	snapB1 := waitSnapshotReady(t, cs, &csi.CreateSnapshotRequest{Name: "snap-b1", SourceVolumeId: volumeIDs[1]})
+
+	// lctl 快照的只读挂载包含相同的快照元数据，不能重复列出
+	mounter := cs.Mount.(*mount.FakeMounter)
+	if len(mounter.MountPoints) != 1 {
+		t.Fatalf("unexpected mount points %+v", mounter.MountPoints)
+	}
+	snapshotMount := filepath.Join(cs.Driver.WorkingMountDir, lctlSnapshotMountPrefix+"4a9f1c2e")
+	if err := os.Symlink(mounter.MountPoints[0].Path, snapshotMount); err != nil {
+		t.Fatalf("failed to prepare snapshot mount: %v", err)
+	}
+	mounter.MountPoints = append(mounter.MountPoints, mount.MountPoint{Device: "172.16.100.189@tcp:/4a9f1c2e", Path: snapshotMount, Type: paramFsType, Opts: []string{"ro"}})
+
+	// 分页列出全部快照
+	var listed []string
+	token := ""
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatalf("too many pages")
+		}
+		resp, err := cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{MaxEntries: 2, StartingToken: token})
+		if err != nil {
+			t.Fatalf("ListSnapshots: %v", err)
+		}
+		if len(resp.Entries) > 2 {
+			t.Fatalf("got %d entries, expected at most 2", len(resp.Entries))
+		}
+		for _, entry := range resp.Entries {
+			listed = append(listed, entry.Snapshot.SnapshotId)
+		}
+		if token = resp.NextToken; token == "" {
+			break
+		}
+	}
+	expected := []string{snapA1.GetSnapshotId(), snapA2.GetSnapshotId(), snapB1.GetSnapshotId()}
+	if !reflect.DeepEqual(listed, expected) {
+		t.Errorf("got snapshots %v, expected %v", listed, expected)
+	}
+
+	filterCases := []struct {
+		name     string
+		req      *csi.ListSnapshotsRequest
+		expected []string
+	}{
+		{
+			name:     "by snapshot id",
+			req:      &csi.ListSnapshotsRequest{SnapshotId: snapB1.GetSnapshotId()},
+			expected: []string{snapB1.GetSnapshotId()},
+		},
+		{
+			name:     "by source volume",
+			req:      &csi.ListSnapshotsRequest{SourceVolumeId: volumeIDs[0]},
+			expected: []string{snapA1.GetSnapshotId(), snapA2.GetSnapshotId()},
+		},
+		{
+			name: "snapshot id and other source volume",
+			req:  &csi.ListSnapshotsRequest{SnapshotId: snapB1.GetSnapshotId(), SourceVolumeId: volumeIDs[0]},
+		},
+		{
+			name: "unknown snapshot id",
+			req:  &csi.ListSnapshotsRequest{SnapshotId: "bogus"},
+		},
+	}
+	for _, tc := range filterCases {
+		resp, err := cs.ListSnapshots(context.Background(), tc.req)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		var got []string
+		for _, entry := range resp.Entries {
+			got = append(got, entry.Snapshot.SnapshotId)
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s: got %v, expected %v", tc.name, got, tc.expected)
+		}
+	}
+	if _, err := cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{StartingToken: "bogus"}); status.Code(err) != codes.Aborted {
+		t.Errorf("got err %v, expected Aborted", err)
+	}
+
+	// 从快照恢复
+	if _, err := createVolume("pvc-restore", 1<<30, snapshotSource(snapA1.GetSnapshotId())); err != nil {
+		t.Fatalf("failed to restore snapshot: %v", err)
+	}
+	data, err = os.ReadFile(filepath.Join(baseDir, "pvc-restore", "model", "weights"))
+	if err != nil || string(data) != "v1" {
+		t.Errorf("restored content %q, %v", data, err)
+	}
+	if _, err := createVolume("pvc-small", 1<<20, snapshotSource(snapA1.GetSnapshotId())); status.Code(err) != codes.OutOfRange {
+		t.Errorf("got err %v, expected OutOfRange", err)
+	}
+	pending := &snapshotMetadata{
+		SnapshotID:     getSnapshotIDFromLustreVol(&Lustre{ServerName: testServer, MountPoint: baseDir, SubDir: "pvc-a"}, "snap-pending", snapshotTypeCopy),
+		Name:           "snap-pending",
+		SourceVolumeID: volumeIDs[0],
+	}
+	if err := writeJSONFile(getSnapshotMetadataPath(baseDir, pending.Name), pending); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createVolume("pvc-pending", 1<<30, snapshotSource(pending.SnapshotID)); status.Code(err) != codes.Unavailable {
+		t.Errorf("got err %v, expected Unavailable", err)
+	}
+
+	// 删除快照
+	if _, err := cs.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: snapA1.GetSnapshotId()}); err != nil {
+		t.Fatalf("DeleteSnapshot: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(baseDir, snapshotDataDir, "snap-a1")); !os.IsNotExist(err) {
+		t.Errorf("snapshot data not removed: %v", err)
+	}
+	if _, err := createVolume("pvc-deleted", 1<<30, snapshotSource(snapA1.GetSnapshotId())); status.Code(err) != codes.NotFound {
+		t.Errorf("got err %v, expected NotFound", err)
+	}
+	if _, err := cs.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: "bogus"}); err != nil {
+		t.Errorf("deleting an invalid snapshot id should succeed: %v", err)
+	}
+	if _, err := cs.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got err %v, expected InvalidArgument", err)
+	}
+}
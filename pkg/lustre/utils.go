@@ -6,9 +6,9 @@ import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	"google.golang.org/grpc"
+	"hash/fnv"
 	"k8s.io/klog/v2"
 	"strings"
-	"sync"
 )
 
 const (
@@ -31,42 +31,88 @@ func validateOnDeleteValue(onDelete string) error {
 	return fmt.Errorf("invalid value %s for OnDelete, supported values are %v", onDelete, supportedOnDeleteValues)
 }
 
-type InFlight struct {
-	mux      *sync.Mutex
-	inFlight map[string]bool
+// getMetadataReplacements 从 provisioner 传入的 PVC/PV 元数据参数构造占位符到取值的映射，
+// 取值会成为目录名，因此必须是单个合法的路径元素
+func getMetadataReplacements(params map[string]string) (map[string]string, error) {
+	replacements := map[string]string{}
+	for key, placeholder := range map[string]string{
+		pvcNameKey:      pvcNameMetadata,
+		pvcNamespaceKey: pvcNamespaceMetadata,
+		pvNameKey:       pvNameMetadata,
+	} {
+		val, ok := params[key]
+		if !ok {
+			continue
+		}
+		if val == "" || val == "." || val == ".." || strings.ContainsAny(val, "/\x00") {
+			return nil, fmt.Errorf("invalid %s %q", key, val)
+		}
+		replacements[placeholder] = val
+	}
+	return replacements, nil
 }
 
-// NewInFlight instantiates an InFlight structure.
-func NewInFlight() *InFlight {
-	return &InFlight{
-		mux:      &sync.Mutex{},
-		inFlight: make(map[string]bool),
+// replaceWithMap 将 str 中的占位符替换为 m 中对应的值
+func replaceWithMap(str string, m map[string]string) string {
+	for k, v := range m {
+		if k != "" {
+			str = strings.ReplaceAll(str, k, v)
+		}
 	}
+	return str
 }
 
-// Insert inserts the entry to the current list of inflight requests.
-// Returns false if the key already exists.
-func (db *InFlight) Insert(key string) bool {
-	db.mux.Lock()
-	defer db.mux.Unlock()
+// reservedSubDirs 为驱动在文件系统根目录下使用的目录，卷不能位于其中，否则删除卷时会删掉驱动的元数据或快照
+var reservedSubDirs = []string{driverMetadataDir, snapshotDataDir}
 
-	_, ok := db.inFlight[key]
-	if ok {
-		return false
+// validateSubDir 拒绝包含 ".." 的子目录，防止卷逃逸到文件系统中的其他目录，并拒绝位于驱动保留目录中的子目录
+func validateSubDir(subDir string) error {
+	elems := strings.Split(subDir, "/")
+	for _, elem := range elems {
+		if elem == ".." {
+			return fmt.Errorf("subdir %s must not contain '..'", subDir)
+		}
 	}
+	for _, elem := range elems {
+		if elem == "" || elem == "." {
+			continue
+		}
+		for _, reserved := range reservedSubDirs {
+			if elem == reserved {
+				return fmt.Errorf("subdir %s must not be under %s, which is reserved by the driver", subDir, reserved)
+			}
+		}
+		break
+	}
+	return nil
+}
+
+// volumeOperationKey 返回节点上针对某个路径的卷操作的锁键，同一个卷发布到不同路径的操作互不影响
+func volumeOperationKey(volumeID, path string) string {
+	return volumeID + "@" + path
+}
 
-	db.inFlight[key] = true
-	return true
+// sharedMountLockKey 返回节点上共享文件系统挂载的锁键，与卷操作的锁使用同一个 LockManager
+func sharedMountLockKey(sharedPath string) string {
+	return "shared-mount@" + sharedPath
 }
 
-// Delete removes the entry from the inFlight entries map.
-// It doesn't return anything, and will do nothing if the specified key doesn't exist.
-func (db *InFlight) Delete(key string) {
-	db.mux.Lock()
-	defer db.mux.Unlock()
+// getFsName 返回 server 中的文件系统（或 fileset）名称，可直接用作目录名，
+// 例如 172.16.100.189@tcp:/testfs/fileset 对应 testfs_fileset
+func getFsName(server string) string {
+	fsName := server
+	if idx := strings.LastIndex(fsName, ":/"); idx >= 0 {
+		fsName = fsName[idx+2:]
+	}
+	return strings.ReplaceAll(strings.Trim(fsName, "/"), "/", "_")
+}
 
-	delete(db.inFlight, key)
-	klog.V(4).InfoS("Volume operation finished", "key", key)
+// getServerMountName 返回挂载 server 时使用的目录名：文件系统名称加上完整 server 字符串（MGS NID 和 fileset）的短哈希。
+// 只用文件系统名称时，NID 不同但名称相同、或名称替换 "/" 后相同的 server 会共用同一个挂载
+func getServerMountName(server string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(strings.Trim(server, "/")))
+	return fmt.Sprintf("%s-%08x", getFsName(server), h.Sum32())
 }
 
 func ParseEndpoint(ep string) (string, string, error) {
@@ -0,0 +1,248 @@
+package lustre
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// 卷 ID 格式: v1#<server>#<base_dir>#<subdir>#<uuid>#<ondelete>
+// 各字段中的 "%" 和 "#" 会被转义为 "%25" 和 "%23"，保证路径中含有 "#" 时仍可无歧义地解析。
+const volumeIDVersion = "v1"
+
+const (
+	idVersion = iota
+	idServer
+	idBaseDir
+	idSubDir
+	idUUID
+	idOnDelete
+	totalIDElements // Always last
+)
+
+// 早期版本生成的卷 ID 没有版本前缀，固定为 10 段，server/subdir/ondelete 位于以下位置
+const (
+	legacyIDServer        = 5
+	legacyIDSubDir        = 7
+	legacyIDOnDelete      = 9
+	legacyTotalIDElements = 10
+)
+
+var (
+	idEscaper   = strings.NewReplacer("%", "%25", separator, "%23")
+	idUnescaper = strings.NewReplacer("%25", "%", "%23", separator)
+)
+
+// getVolumeIDFromLustreVol 将 Lustre 卷编码为带版本号的卷 ID
+func getVolumeIDFromLustreVol(vol *Lustre) string {
+	idElements := make([]string, totalIDElements)
+	idElements[idVersion] = volumeIDVersion
+	idElements[idServer] = strings.Trim(vol.ServerName, "/")
+	idElements[idBaseDir] = vol.MountPoint
+	idElements[idSubDir] = strings.Trim(vol.SubDir, "/")
+	idElements[idUUID] = vol.UUID
+	idElements[idOnDelete] = strings.ToLower(vol.OnDelete)
+	for i := idServer; i < totalIDElements; i++ {
+		idElements[i] = idEscaper.Replace(idElements[i])
+	}
+
+	return strings.Join(idElements, separator)
+}
+
+// getLustreVolFromID 解析 getVolumeIDFromLustreVol 生成的卷 ID，格式不合法时返回 InvalidArgument
+func getLustreVolFromID(id string) (*Lustre, error) {
+	segments := strings.Split(id, separator)
+	if len(segments) == legacyTotalIDElements && segments[0] == "" {
+		return getLustreVolFromLegacyID(id, segments)
+	}
+	if segments[0] != volumeIDVersion {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported version in volume id %q", id)
+	}
+	if len(segments) != totalIDElements {
+		return nil, status.Errorf(codes.InvalidArgument, "volume id %q has %d segments, expected %d", id, len(segments), totalIDElements)
+	}
+	for i := idServer; i < totalIDElements; i++ {
+		val, err := unescapeIDElement(segments[i])
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid volume id %q: %v", id, err)
+		}
+		segments[i] = val
+	}
+
+	vol := &Lustre{
+		FSId:        id,
+		ServerName:  segments[idServer],
+		MountPoint:  segments[idBaseDir],
+		SubDir:      segments[idSubDir],
+		UUID:        segments[idUUID],
+		OnDelete:    segments[idOnDelete],
+		StorageType: paramFsType,
+	}
+	if err := validateLustreVol(vol); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid volume id %q: %v", id, err)
+	}
+	return vol, nil
+}
+
+// getLustreVolFromRequest 优先从卷 ID 解析卷信息；对于静态创建、卷 ID 不是由本驱动生成的 PV，
+// 回退到 volume context 中的 server 和 subdir
+func getLustreVolFromRequest(volID string, volumeContext map[string]string) (*Lustre, error) {
+	vol, err := getLustreVolFromID(volID)
+	if err == nil {
+		return vol, nil
+	}
+	if strings.HasPrefix(volID, volumeIDVersion+separator) {
+		return nil, err
+	}
+	server, subDir := volumeContext[paramServer], strings.Trim(volumeContext[paramSubDir], "/")
+	if server == "" || subDir == "" {
+		return nil, err
+	}
+	vol = &Lustre{
+		FSId:        volID,
+		ServerName:  server,
+		SubDir:      subDir,
+		StorageType: paramFsType,
+	}
+	if err := validateLustreVol(vol); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid volume context: %v", err)
+	}
+	return vol, nil
+}
+
+func getLustreVolFromLegacyID(id string, segments []string) (*Lustre, error) {
+	vol := &Lustre{
+		FSId:        id,
+		ServerName:  segments[legacyIDServer],
+		SubDir:      segments[legacyIDSubDir],
+		OnDelete:    segments[legacyIDOnDelete],
+		StorageType: paramFsType,
+	}
+	for i, seg := range segments {
+		if seg != "" && i != legacyIDServer && i != legacyIDSubDir && i != legacyIDOnDelete {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid volume id %q: unexpected segment %d", id, i)
+		}
+	}
+	if err := validateLustreVol(vol); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid volume id %q: %v", id, err)
+	}
+	return vol, nil
+}
+
+func validateLustreVol(vol *Lustre) error {
+	if vol.ServerName == "" {
+		return fmt.Errorf("server is empty")
+	}
+	if vol.SubDir == "" {
+		return fmt.Errorf("subdir is empty")
+	}
+	if vol.MountPoint != "" && !path.IsAbs(vol.MountPoint) {
+		return fmt.Errorf("base_dir %s is not an absolute path", vol.MountPoint)
+	}
+	if err := validateSubDir(vol.SubDir); err != nil {
+		return err
+	}
+	return validateOnDeleteValue(vol.OnDelete)
+}
+
+func unescapeIDElement(s string) (string, error) {
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			continue
+		}
+		if !strings.HasPrefix(s[i:], "%25") && !strings.HasPrefix(s[i:], "%23") {
+			return "", fmt.Errorf("invalid escape sequence at %d in %q", i, s)
+		}
+		i += 2
+	}
+	return idUnescaper.Replace(s), nil
+}
+
+// 快照 ID 格式: v1#<server>#<base_dir>#<源卷 subdir>#<快照名>[#<快照类型>]，转义规则与卷 ID 相同。
+// 快照类型缺省为 copy，数据位于 <base_dir>/.snapshots/<快照名>；lctl 类型为整个文件系统的快照
+const (
+	snapIDServer = iota + 1
+	snapIDBaseDir
+	snapIDSubDir
+	snapIDName
+	snapIDType
+	totalSnapIDElements // Always last
+)
+
+// lustreSnapshot 为从快照 ID 解析出的快照信息，Source 描述源卷所在的文件系统与子目录
+type lustreSnapshot struct {
+	ID     string
+	Name   string
+	Type   string
+	Source *Lustre
+}
+
+func getSnapshotIDFromLustreVol(vol *Lustre, name, snapshotType string) string {
+	idElements := make([]string, totalSnapIDElements)
+	idElements[idVersion] = volumeIDVersion
+	idElements[snapIDServer] = strings.Trim(vol.ServerName, "/")
+	idElements[snapIDBaseDir] = vol.MountPoint
+	idElements[snapIDSubDir] = strings.Trim(vol.SubDir, "/")
+	idElements[snapIDName] = name
+	idElements[snapIDType] = snapshotType
+	for i := snapIDServer; i < totalSnapIDElements; i++ {
+		idElements[i] = idEscaper.Replace(idElements[i])
+	}
+	if snapshotType == snapshotTypeCopy {
+		// copy 类型省略类型字段，与早期生成的快照 ID 保持一致
+		idElements = idElements[:snapIDType]
+	}
+	return strings.Join(idElements, separator)
+}
+
+// getLustreSnapshotFromID 解析 getSnapshotIDFromLustreVol 生成的快照 ID，格式不合法时返回 InvalidArgument
+func getLustreSnapshotFromID(id string) (*lustreSnapshot, error) {
+	segments := strings.Split(id, separator)
+	if len(segments) == snapIDType {
+		segments = append(segments, snapshotTypeCopy)
+	}
+	if segments[0] != volumeIDVersion || len(segments) != totalSnapIDElements {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid snapshot id %q", id)
+	}
+	for i := snapIDServer; i < totalSnapIDElements; i++ {
+		val, err := unescapeIDElement(segments[i])
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid snapshot id %q: %v", id, err)
+		}
+		segments[i] = val
+	}
+
+	snap := &lustreSnapshot{
+		ID:   id,
+		Name: segments[snapIDName],
+		Type: segments[snapIDType],
+		Source: &Lustre{
+			FSId:        id,
+			ServerName:  segments[snapIDServer],
+			MountPoint:  segments[snapIDBaseDir],
+			SubDir:      segments[snapIDSubDir],
+			StorageType: paramFsType,
+		},
+	}
+	if err := validateLustreVol(snap.Source); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid snapshot id %q: %v", id, err)
+	}
+	if err := validateSnapshotName(snap.Name); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid snapshot id %q: %v", id, err)
+	}
+	if err := validateSnapshotType(snap.Type); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid snapshot id %q: %v", id, err)
+	}
+	return snap, nil
+}
+
+// validateSnapshotName 保证快照名可以直接用作 .snapshots 下的目录名
+func validateSnapshotName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid snapshot name %q", name)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package lustre
+
+import (
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestVolumeIDRoundTrip(t *testing.T) {
+	testCases := []struct {
+		name string
+		vol  *Lustre
+		id   string
+	}{
+		{
+			name: "all fields",
+			vol: &Lustre{
+				ServerName: testServer,
+				MountPoint: "/mnt/testfs",
+				SubDir:     "ns/pvc-1",
+				UUID:       "pvc-1",
+				OnDelete:   archive,
+			},
+			id: "v1#172.16.100.189@tcp:/testfs#/mnt/testfs#ns/pvc-1#pvc-1#archive",
+		},
+		{
+			name: "separator and percent in subdir",
+			vol: &Lustre{
+				ServerName: testServer,
+				SubDir:     "a#b%23c",
+				OnDelete:   retain,
+			},
+			id: "v1#172.16.100.189@tcp:/testfs##a%23b%2523c##retain",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			id := getVolumeIDFromLustreVol(test.vol)
+			if id != test.id {
+				t.Fatalf("got id %q, expected %q", id, test.id)
+			}
+			vol, err := getLustreVolFromID(id)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			test.vol.FSId = id
+			test.vol.StorageType = paramFsType
+			if !reflect.DeepEqual(vol, test.vol) {
+				t.Errorf("got vol %+v, expected %+v", vol, test.vol)
+			}
+		})
+	}
+}
+
+func TestGetLustreVolFromID(t *testing.T) {
+	testCases := []struct {
+		name     string
+		id       string
+		expected *Lustre
+		errCode  codes.Code
+	}{
+		{
+			name: "legacy id",
+			id:   "#####172.16.100.189@tcp:/testfs##a1##retain",
+			expected: &Lustre{
+				FSId:        "#####172.16.100.189@tcp:/testfs##a1##retain",
+				ServerName:  testServer,
+				SubDir:      "a1",
+				OnDelete:    retain,
+				StorageType: paramFsType,
+			},
+		},
+		{name: "empty id", id: "", errCode: codes.InvalidArgument},
+		{name: "unknown version", id: "v9#server##a1##", errCode: codes.InvalidArgument},
+		{name: "too few segments", id: "v1#server#a1", errCode: codes.InvalidArgument},
+		{name: "too many segments", id: "v1#server##a1###delete", errCode: codes.InvalidArgument},
+		{name: "missing server", id: "v1###a1##", errCode: codes.InvalidArgument},
+		{name: "missing subdir", id: "v1#server####", errCode: codes.InvalidArgument},
+		{name: "relative base dir", id: "v1#server#mnt#a1##", errCode: codes.InvalidArgument},
+		{name: "path traversal", id: "v1#server##a1/../..##", errCode: codes.InvalidArgument},
+		{name: "driver metadata dir", id: "v1#server##.lustre-csi##delete", errCode: codes.InvalidArgument},
+		{name: "under snapshot dir", id: "v1#server##./.snapshots/snap-a1##delete", errCode: codes.InvalidArgument},
+		{name: "invalid ondelete", id: "v1#server##a1##keep", errCode: codes.InvalidArgument},
+		{name: "invalid escape", id: "v1#server##a%41##", errCode: codes.InvalidArgument},
+		{name: "legacy id with extra segment", id: "x####server##a1##", errCode: codes.InvalidArgument},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			vol, err := getLustreVolFromID(test.id)
+			if status.Code(err) != test.errCode {
+				t.Fatalf("got err %v, expected code %v", err, test.errCode)
+			}
+			if !reflect.DeepEqual(vol, test.expected) {
+				t.Errorf("got vol %+v, expected %+v", vol, test.expected)
+			}
+		})
+	}
+}
+
+func TestGetLustreVolFromRequest(t *testing.T) {
+	volumeContext := map[string]string{paramServer: testServer, paramSubDir: "/static"}
+
+	vol, err := getLustreVolFromRequest("static-pv", volumeContext)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if vol.ServerName != testServer || vol.SubDir != "static" {
+		t.Errorf("unexpected vol %+v", vol)
+	}
+
+	if _, err := getLustreVolFromRequest("static-pv", nil); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got err %v, expected InvalidArgument", err)
+	}
+	if _, err := getLustreVolFromRequest("v1#bad", volumeContext); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got err %v, expected InvalidArgument", err)
+	}
+}